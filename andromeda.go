@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/EkzikP/sdk_andromeda_go_v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultUpdateTimeout  = 60        //Время обработки одного обновления по умолчанию, сек.
+	defaultRequestTimeout = "default" //Ключ времени ожидания для методов, не указанных в настройках явно
+)
+
+// defaultRequestTimeouts время ожидания ответа ПО "Центр охраны" по умолчанию, сек.
+// Клиент SDK сам ограничивает каждый HTTP-запрос 5 сек., поэтому большие значения не продлевают отдельный запрос.
+// Обработка, выполняющая несколько запросов подряд (объекты пользователя MyAlarm), ограничена временем обработки обновления
+var defaultRequestTimeouts = map[string]int{
+	defaultRequestTimeout: 5,
+	"GetSites":            3,
+	"GetCustomer":         3,
+	"GetCheckPanic":       3,
+}
+
+// andromedaMethods методы API ПО "Центр охраны", для которых можно задать время ожидания
+var andromedaMethods = []string{
+	"GetSites", "GetCustomers", "GetCustomer", "PostCheckPanic", "GetCheckPanic", "GetUsersMyAlarm",
+	"GetUserObjectMyAlarm", "PutChangeUserMyAlarm", "PutChangeKTSUserMyAlarm", "GetParts", "GetZones",
+}
+
+// andromedaClient описывает методы API ПО "Центр охраны", которые использует бот.
+// Реализуется клиентом SDK, а также обертками над ним (кэширование, повторы, метрики) и заглушками для тестов
+type andromedaClient interface {
+	GetSites(ctx context.Context, input andromeda.GetSitesInput) (andromeda.GetSitesResponse, error)
+	GetCustomers(ctx context.Context, input andromeda.GetCustomersInput) ([]andromeda.GetCustomerResponse, error)
+	GetCustomer(ctx context.Context, input andromeda.GetCustomerInput) (andromeda.GetCustomerResponse, error)
+	PostCheckPanic(ctx context.Context, input andromeda.PostCheckPanicInput) (andromeda.PostCheckPanicResponse, error)
+	GetCheckPanic(ctx context.Context, input andromeda.GetCheckPanicInput) (andromeda.GetCheckPanicResponse, error)
+	GetUsersMyAlarm(ctx context.Context, input andromeda.GetUsersMyAlarmInput) ([]andromeda.UserMyAlarmResponse, error)
+	GetUserObjectMyAlarm(ctx context.Context, input andromeda.GetUserObjectMyAlarmInput) ([]andromeda.GetUserObjectMyAlarmResponse, error)
+	PutChangeUserMyAlarm(ctx context.Context, input andromeda.PutChangeUserMyAlarmInput) (andromeda.PutChangeUserMyAlarmResponse, error)
+	PutChangeKTSUserMyAlarm(ctx context.Context, input andromeda.PutChangeKTSUserMyAlarmInput) error
+	GetParts(ctx context.Context, input andromeda.GetPartsInput) ([]andromeda.GetPartsResponse, error)
+	GetZones(ctx context.Context, input andromeda.GetZonesInput) ([]andromeda.GetZonesResponse, error)
+}
+
+var _ andromedaClient = (*andromeda.Client)(nil)
+
+// timeoutClient ограничивает время ожидания ответа на каждый запрос к ПО "Центр охраны" в зависимости от метода
+type timeoutClient struct {
+	client   andromedaClient
+	timeouts map[string]time.Duration
+}
+
+var _ andromedaClient = (*timeoutClient)(nil)
+
+// newTimeoutClient создает клиент со временем ожидания по методам, сек.
+func newTimeoutClient(client andromedaClient, timeouts map[string]int) *timeoutClient {
+
+	c := &timeoutClient{client: client, timeouts: make(map[string]time.Duration, len(timeouts))}
+	for method, seconds := range timeouts {
+		c.timeouts[method] = time.Duration(seconds) * time.Second
+	}
+	return c
+}
+
+// withTimeout возвращает контекст запроса метода method
+func (c *timeoutClient) withTimeout(ctx context.Context, method string) (context.Context, context.CancelFunc) {
+
+	timeout, ok := c.timeouts[method]
+	if !ok {
+		timeout = c.timeouts[defaultRequestTimeout]
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (c *timeoutClient) GetSites(ctx context.Context, input andromeda.GetSitesInput) (andromeda.GetSitesResponse, error) {
+	ctx, cancel := c.withTimeout(ctx, "GetSites")
+	defer cancel()
+	return c.client.GetSites(ctx, input)
+}
+
+func (c *timeoutClient) GetCustomers(ctx context.Context, input andromeda.GetCustomersInput) ([]andromeda.GetCustomerResponse, error) {
+	ctx, cancel := c.withTimeout(ctx, "GetCustomers")
+	defer cancel()
+	return c.client.GetCustomers(ctx, input)
+}
+
+func (c *timeoutClient) GetCustomer(ctx context.Context, input andromeda.GetCustomerInput) (andromeda.GetCustomerResponse, error) {
+	ctx, cancel := c.withTimeout(ctx, "GetCustomer")
+	defer cancel()
+	return c.client.GetCustomer(ctx, input)
+}
+
+func (c *timeoutClient) PostCheckPanic(ctx context.Context, input andromeda.PostCheckPanicInput) (andromeda.PostCheckPanicResponse, error) {
+	ctx, cancel := c.withTimeout(ctx, "PostCheckPanic")
+	defer cancel()
+	return c.client.PostCheckPanic(ctx, input)
+}
+
+func (c *timeoutClient) GetCheckPanic(ctx context.Context, input andromeda.GetCheckPanicInput) (andromeda.GetCheckPanicResponse, error) {
+	ctx, cancel := c.withTimeout(ctx, "GetCheckPanic")
+	defer cancel()
+	return c.client.GetCheckPanic(ctx, input)
+}
+
+func (c *timeoutClient) GetUsersMyAlarm(ctx context.Context, input andromeda.GetUsersMyAlarmInput) ([]andromeda.UserMyAlarmResponse, error) {
+	ctx, cancel := c.withTimeout(ctx, "GetUsersMyAlarm")
+	defer cancel()
+	return c.client.GetUsersMyAlarm(ctx, input)
+}
+
+func (c *timeoutClient) GetUserObjectMyAlarm(ctx context.Context, input andromeda.GetUserObjectMyAlarmInput) ([]andromeda.GetUserObjectMyAlarmResponse, error) {
+	ctx, cancel := c.withTimeout(ctx, "GetUserObjectMyAlarm")
+	defer cancel()
+	return c.client.GetUserObjectMyAlarm(ctx, input)
+}
+
+func (c *timeoutClient) PutChangeUserMyAlarm(ctx context.Context, input andromeda.PutChangeUserMyAlarmInput) (andromeda.PutChangeUserMyAlarmResponse, error) {
+	ctx, cancel := c.withTimeout(ctx, "PutChangeUserMyAlarm")
+	defer cancel()
+	return c.client.PutChangeUserMyAlarm(ctx, input)
+}
+
+func (c *timeoutClient) PutChangeKTSUserMyAlarm(ctx context.Context, input andromeda.PutChangeKTSUserMyAlarmInput) error {
+	ctx, cancel := c.withTimeout(ctx, "PutChangeKTSUserMyAlarm")
+	defer cancel()
+	return c.client.PutChangeKTSUserMyAlarm(ctx, input)
+}
+
+func (c *timeoutClient) GetParts(ctx context.Context, input andromeda.GetPartsInput) ([]andromeda.GetPartsResponse, error) {
+	ctx, cancel := c.withTimeout(ctx, "GetParts")
+	defer cancel()
+	return c.client.GetParts(ctx, input)
+}
+
+func (c *timeoutClient) GetZones(ctx context.Context, input andromeda.GetZonesInput) ([]andromeda.GetZonesResponse, error) {
+	ctx, cancel := c.withTimeout(ctx, "GetZones")
+	defer cancel()
+	return c.client.GetZones(ctx, input)
+}
+
+// sdkStatusError текст ошибки SDK, когда сервер ответил неожиданным кодом HTTP. SDK не сообщает код ответа:
+// так же завершаются и ответы 502-504 прокси или сервера на обслуживании, и, например, 404 или 500
+// на конкретный запрос. Ошибки соединения SDK дополняет причиной, а на ответы 400, 401 и 403 возвращает другой текст
+const sdkStatusError = "Не удалось выполнить запрос"
+
+// isUnavailable проверяет, что запрос не выполнен из-за недоступности сервера ПО "Центр охраны":
+// истекло время ожидания ответа или не удалось установить соединение. Только такие ошибки учитываются
+// при повторе запросов, прекращении запросов к недоступному серверу и переключении на резервный адрес.
+// Ответ неожиданным кодом HTTP недоступностью не считается: SDK не сообщает код, и отличить 502-504 от ошибки
+// самого запроса нельзя
+func isUnavailable(err error) bool {
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errServiceUnavailable) {
+		return true
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isStatusError проверяет, что сервер ПО "Центр охраны" ответил неожиданным кодом HTTP
+func isStatusError(err error) bool {
+	return err != nil && errors.Cause(err).Error() == sdkStatusError
+}
+
+// isRetryable проверяет, что пользователю можно предложить повторить запрос: сервер ПО "Центр охраны"
+// недоступен или ответил неожиданным кодом HTTP, например 503 при обслуживании
+func isRetryable(err error) bool {
+	return isUnavailable(err) || isStatusError(err)
+}
+
+// unavailableText возвращает сообщение о невыполненном запросе к ПО "Центр охраны"
+func unavailableText(err error) string {
+	switch {
+	case errors.Is(err, errServiceUnavailable):
+		return "Сервер Центра охраны временно недоступен."
+	case isStatusError(err):
+		return "Сервер Центра охраны не смог выполнить запрос."
+	}
+	return "Сервер Центра охраны не отвечает."
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	auditOK      = "ok"      //Действие выполнено
+	auditDenied  = "denied"  //Отказ в доступе
+	auditFailed  = "failed"  //Запрос к ПО "Центр охраны" не выполнен
+	auditPending = "pending" //Действие ожидает подтверждения пользователя
+
+	actionAudit = "Audit" //Просмотр журнала аудита командой /audit
+
+	auditLimit = 20 //Количество последних записей журнала, которые выводит команда /audit
+)
+
+type (
+	// auditEntry запись журнала аудита
+	auditEntry struct {
+		chatID    int64
+		phone     string
+		role      string
+		object    string //Пультовый номер объекта
+		server    string //Сервер ПО "Центр охраны", на котором находится объект
+		action    string //Пункт меню или действие: "OpenObject", "GetUserObjectMyAlarm", "Grant"
+		target    string //Пользователь или объект, над которым выполняется действие
+		result    string
+		details   string
+		createdAt time.Time
+	}
+
+	AuditStore struct {
+		db *sql.DB
+	}
+)
+
+func NewAuditStore(db *sql.DB) AuditStore {
+	return AuditStore{db: db}
+}
+
+// Add добавляет запись в журнал аудита
+func (s AuditStore) Add(entry auditEntry) error {
+	_, err := s.db.Exec("INSERT INTO audit (chatId, phone, role, object, server, action, target, result, details, createdAt) "+
+		"VALUES (:chatId, :phone, :role, :object, :server, :action, :target, :result, :details, :createdAt)",
+		sql.Named("chatId", entry.chatID),
+		sql.Named("phone", entry.phone),
+		sql.Named("role", entry.role),
+		sql.Named("object", entry.object),
+		sql.Named("server", entry.server),
+		sql.Named("action", entry.action),
+		sql.Named("target", entry.target),
+		sql.Named("result", entry.result),
+		sql.Named("details", entry.details),
+		sql.Named("createdAt", entry.createdAt.Unix()))
+	return err
+}
+
+// List возвращает последние limit записей журнала аудита объекта object сервера server в порядке добавления.
+// Пустой object - записи всех объектов, limit 0 - все записи
+func (s AuditStore) List(object, server string, limit int) ([]auditEntry, error) {
+
+	query := "SELECT chatId, phone, role, object, server, action, target, result, details, createdAt FROM audit " +
+		"WHERE :object = '' OR (object = :object AND server = :server) ORDER BY id DESC"
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+	rows, err := s.db.Query(query, sql.Named("object", object), sql.Named("server", server))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var entries []auditEntry
+	for rows.Next() {
+		var entry auditEntry
+		var createdAt int64
+		if err = rows.Scan(&entry.chatID, &entry.phone, &entry.role, &entry.object, &entry.server, &entry.action, &entry.target,
+			&entry.result, &entry.details, &createdAt); err != nil {
+			return nil, err
+		}
+		entry.createdAt = time.Unix(createdAt, 0)
+		entries = append(entries, entry)
+	}
+	slices.Reverse(entries)
+	return entries, rows.Err()
+}
+
+// auditCSV формирует файл CSV с записями журнала аудита. Файл начинается с BOM,
+// чтобы Excel открывал его в кодировке UTF-8
+func auditCSV(entries []auditEntry) ([]byte, error) {
+
+	var buf bytes.Buffer
+	buf.WriteString("\uFEFF")
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{"Время", "Чат", "Телефон", "Роль", "Объект", "Сервер", "Действие", "Пользователь", "Результат", "Подробности"})
+	for _, entry := range entries {
+		_ = w.Write([]string{entry.createdAt.Format("2006-01-02 15:04:05"), strconv.FormatInt(entry.chatID, 10), entry.phone,
+			entry.role, entry.object, entry.server, entry.action, entry.target, entry.result, entry.details})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// audit записывает действие пользователя чата chatID в журнал аудита. Телефон и роль инженера заполняются,
+// если не заданы. Ошибка записи не прерывает работу пользователя
+func (a *app) audit(chatID int64, entry auditEntry) {
+
+	entry.chatID = chatID
+	entry.createdAt = time.Now()
+	if entry.phone == "" {
+		entry.phone = a.tgUser.Phone(chatID)
+	}
+	if e, ok := a.engineers.Get(entry.phone); ok && e.active && entry.role == "" {
+		entry.role = e.role
+	}
+
+	log.Printf("Аудит: чат %d, %s (%s), объект %s, %s %s: %s %s", entry.chatID, entry.phone, entry.role, entry.object, entry.action, entry.target, entry.result, entry.details)
+	if err := a.auditLog.Add(entry); err != nil {
+		log.Printf("Не удалось записать в журнал аудита действие %s чата %d: %v", entry.action, chatID, err)
+	}
+}
+
+// auditView записывает в журнал аудита просмотр данных объекта пунктом меню action. Ошибка err - запрос
+// к ПО "Центр охраны" не выполнен. Данные, полученные при открытии объекта, выводятся без запроса (err = nil)
+func (a *app) auditView(chatID int64, operation *operation, action string, err error) {
+
+	entry := auditEntry{role: operation.userRole, object: operation.numberObject, server: a.backendOf(operation).name, action: action, result: auditOK}
+	if err != nil {
+		entry.result, entry.details = auditFailed, err.Error()
+	}
+	a.audit(chatID, entry)
+}
+
+// canAudit проверяет, что инженер phone может просматривать журнал аудита объекта number сервера server.
+// Журнал всех объектов (number 0) доступен инженеру, за которым закреплены все объекты
+func (a *app) canAudit(phone, server string, number int) (string, bool) {
+
+	e, ok := a.engineers.Get(phone)
+	if !ok || !e.active || !slices.Contains(a.settings().Roles[e.role], actionAudit) {
+		return fmt.Sprintf("Журнал аудита недоступен для роли «%s».", roleName(e.role)), false
+	}
+	scope := a.engineerScope(e)
+	if number == 0 && !scope.all() {
+		return fmt.Sprintf("Журнал всех объектов вам недоступен. Ваши объекты: %s", scope), false
+	}
+	if number != 0 && !scope.covers(server, number) {
+		return fmt.Sprintf("Объект %d не закреплен за вами. Ваши объекты: %s", number, scope), false
+	}
+	return "", true
+}
+
+// auditCommand выводит последние записи журнала аудита объекта по команде /audit 1234.
+// Команда /audit 1234 csv присылает весь журнал объекта файлом CSV, /audit csv - журнал всех объектов.
+// Сервер объекта указывается после номера: /audit 1234@Север
+func (a *app) auditCommand(chatID int64, operation *operation, phone, args string) tgbotapi.MessageConfig {
+
+	usage := "Введите: /audit номер_объекта - последние записи журнала аудита объекта\n" +
+		"/audit номер_объекта csv - журнал объекта файлом CSV\n/audit csv - журнал всех объектов файлом CSV"
+	if len(a.backends) > 1 {
+		usage += "\nСервер объекта: /audit номер_объекта@сервер"
+	}
+
+	fields := strings.Fields(args)
+	asCSV := len(fields) > 0 && strings.EqualFold(fields[len(fields)-1], "csv")
+	if asCSV {
+		fields = fields[:len(fields)-1]
+	}
+
+	var object, server string
+	var number int
+	switch {
+	case len(fields) == 1:
+		numberObject, serverName := splitObjectNumber(fields[0])
+		if _, ok := checkNumberObject(numberObject); !ok {
+			return tgbotapi.NewMessage(chatID, "Неверный формат команды.\n"+usage)
+		}
+		object = numberObject
+		number, _ = strconv.Atoi(object)
+		srv, text := a.objectServer(number, serverName)
+		if srv == nil {
+			return tgbotapi.NewMessage(chatID, text)
+		}
+		server = srv.name
+	case len(fields) > 1, !asCSV:
+		return tgbotapi.NewMessage(chatID, "Неверный формат команды.\n"+usage)
+	}
+
+	if text, ok := a.canAudit(phone, server, number); !ok {
+		return tgbotapi.NewMessage(chatID, text)
+	}
+
+	limit := auditLimit
+	if asCSV {
+		limit = 0
+	}
+	entries, err := a.auditLog.List(object, server, limit)
+	if err != nil {
+		log.Printf("Не удалось прочитать журнал аудита объекта %s: %v", object, err)
+		return tgbotapi.NewMessage(chatID, "Не удалось получить данные, попробуйте позже.")
+	}
+
+	title := "Журнал аудита объекта " + a.objectTitle(object, server)
+	if object == "" {
+		title = "Журнал аудита всех объектов"
+	}
+	if len(entries) == 0 {
+		return tgbotapi.NewMessage(chatID, title+" пуст.")
+	}
+
+	if !asCSV {
+		items := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			items = append(items, entry.String())
+		}
+		return commandListMessage(chatID, operation, title+", последние записи:", items)
+	}
+
+	data, err := auditCSV(entries)
+	if err != nil {
+		log.Printf("Не удалось сформировать файл журнала аудита объекта %s: %v", object, err)
+		return tgbotapi.NewMessage(chatID, "Не удалось сформировать файл, попробуйте позже.")
+	}
+	name := "audit"
+	if object != "" {
+		name += "_" + object
+	}
+	if len(a.backends) > 1 && server != "" {
+		name += "_" + server
+	}
+	document := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: fmt.Sprintf("%s_%s.csv", name, time.Now().Format("20060102_150405")), Bytes: data})
+	document.Caption = fmt.Sprintf("%s: записей %d", title, len(entries))
+	if _, err = a.bot.Send(document); err != nil {
+		log.Printf("Не удалось отправить файл журнала аудита в чат %d: %v", chatID, err)
+		return tgbotapi.NewMessage(chatID, "Не удалось отправить файл, попробуйте позже.")
+	}
+	log.Printf("Журнал аудита %s выгружен в чат %d (%s): записей %d", object, chatID, phone, len(entries))
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("%s выгружен, записей: %d.", title, len(entries)))
+}
+
+// String возвращает запись журнала аудита для пользователя
+func (e auditEntry) String() string {
+
+	text := fmt.Sprintf("%s %s", e.createdAt.Format("02/01/2006 15:04:05"), e.phone)
+	if e.role != "" {
+		text += " (" + roleName(e.role) + ")"
+	}
+	if e.object != "" {
+		text += ", объект " + e.object
+	}
+	text += "\n" + e.action
+	if e.target != "" {
+		text += " " + e.target
+	}
+	text += ": " + e.result
+	if e.details != "" {
+		text += ", " + e.details
+	}
+	return text
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+)
+
+const (
+	callbackVersion   = "1" //Версия формата данных кнопок
+	callbackSeparator = "|" //Разделитель полей в данных кнопок
+	callbackMaxLength = 64  //Ограничение Telegram на длину данных кнопки, байт
+	callbackMACLength = 11  //Длина подписи в данных кнопки, символов base64
+)
+
+// callbackCodes содержит короткие коды действий кнопок, чтобы данные кнопки укладывались в ограничение Telegram
+var callbackCodes = map[string]string{
+	"GetInfoObject":        "io",
+	"GetCustomers":         "cu",
+	"ChecksKTS":            "ck",
+	"ResultCheckKTS":       "rk",
+	"MyAlarm":              "ma",
+	"GetParts":             "pa",
+	"GetZones":             "zo",
+	"GetUsersMyAlarm":      "mu",
+	"GetUserObjectMyAlarm": "mo",
+	"PutDelUserMyAlarm":    "md",
+	"PutAddUserMyAlarm":    "mn",
+	"PutChangeVirtualKTS":  "mk",
+	"SelectUser":           "su",
+	"SelectRole":           "sr",
+	"SelectKTS":            "sk",
+	"Page":                 "pg",
+	"CommandPage":          "cp",
+	"Retry":                "rt",
+	"Back":                 "bk",
+	"Finish":               "fi",
+}
+
+var (
+	errCallbackExpired = errors.New("Действие устарело и недоступно на текущем шаге")
+	errCallbackFormat  = errors.New("Кнопка устарела")
+	errCallbackSession = errors.New("Кнопка относится к завершенной сессии")
+	errCallbackObject  = errors.New("Кнопка относится к другому объекту")
+)
+
+// callbackKey ключ подписи данных кнопок
+var callbackKey []byte
+
+type callbackData struct {
+	action string //Действие кнопки
+	object string //Номер объекта, для которого создана кнопка
+	target string //Идентификатор выбранного значения: ответственного лица, роли и т.п.
+}
+
+// setCallbackKey задает ключ подписи данных кнопок. Если ключ не задан в настройках, он вычисляется из токена бота,
+// чтобы кнопки сохраненных сессий оставались действительными после перезапуска
+func setCallbackKey(configuration config) {
+	if configuration.CallbackSecret != "" {
+		callbackKey = []byte(configuration.CallbackSecret)
+		return
+	}
+	key := sha256.Sum256([]byte("callback:" + configuration.TelegramBotToken))
+	callbackKey = key[:]
+}
+
+// newSessionId создает случайный идентификатор сессии, к которому привязываются кнопки
+func newSessionId() string {
+	buf := make([]byte, 6)
+	_, _ = rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// signCallback вычисляет подпись данных кнопки для сессии
+func signCallback(sessionId, payload string) string {
+	mac := hmac.New(sha256.New, callbackKey)
+	mac.Write([]byte(sessionId + callbackSeparator + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))[:callbackMACLength]
+}
+
+// encodeCallback кодирует данные кнопки: версия, действие, номер объекта, выбранное значение и подпись
+func encodeCallback(operation *operation, action, target string) string {
+
+	payload := strings.Join([]string{callbackVersion, callbackCodes[action], operation.numberObject, target}, callbackSeparator)
+	data := payload + callbackSeparator + signCallback(operation.sessionId, payload)
+	if len(data) > callbackMaxLength {
+		log.Printf("Данные кнопки %q превышают %d байт", data, callbackMaxLength)
+	}
+	return data
+}
+
+// decodeCallback проверяет подпись и номер объекта в данных кнопки и возвращает действие
+func decodeCallback(data string, operation *operation) (callbackData, error) {
+
+	fields := strings.Split(data, callbackSeparator)
+	if len(fields) != 5 || fields[0] != callbackVersion {
+		return callbackData{}, errCallbackFormat
+	}
+
+	payload := strings.Join(fields[:4], callbackSeparator)
+	if !hmac.Equal([]byte(fields[4]), []byte(signCallback(operation.sessionId, payload))) {
+		return callbackData{}, errCallbackSession
+	}
+
+	if fields[2] != operation.numberObject {
+		return callbackData{}, errCallbackObject
+	}
+
+	for action, code := range callbackCodes {
+		if code == fields[1] {
+			return callbackData{action: action, object: fields[2], target: fields[3]}, nil
+		}
+	}
+	return callbackData{}, errCallbackFormat
+}
+
+// callbackButton создает кнопку с подписанными данными
+func callbackButton(operation *operation, text, action, target string) tgbotapi.InlineKeyboardButton {
+	return tgbotapi.NewInlineKeyboardButtonData(text, encodeCallback(operation, action, target))
+}
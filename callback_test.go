@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCallbackRoundTrip(t *testing.T) {
+
+	setCallbackKey(config{CallbackSecret: "test"})
+	operation := newOperation()
+	operation.numberObject = "1234"
+
+	for action := range callbackCodes {
+		data := encodeCallback(operation, action, "42")
+		if len(data) > callbackMaxLength {
+			t.Errorf("%s: данные %q длиннее %d байт", action, data, callbackMaxLength)
+		}
+		cb, err := decodeCallback(data, operation)
+		if err != nil {
+			t.Fatalf("%s: %v", action, err)
+		}
+		if cb != (callbackData{action: action, object: "1234", target: "42"}) {
+			t.Errorf("%s: %+v", action, cb)
+		}
+	}
+}
+
+func TestDecodeCallbackRejected(t *testing.T) {
+
+	setCallbackKey(config{CallbackSecret: "test"})
+	session := newOperation()
+	session.numberObject = "1234"
+	data := encodeCallback(session, "GetZones", "")
+	tampered := data[:len(data)-1] + "x"
+	if tampered == data {
+		tampered = data[:len(data)-1] + "y"
+	}
+
+	other := newOperation()
+	other.numberObject = "1234"
+
+	otherObject := *session
+	otherObject.numberObject = "5678"
+
+	tests := []struct {
+		name      string
+		data      string
+		operation *operation
+		want      error
+	}{
+		{name: "данные старого формата", data: "GetZones", operation: session, want: errCallbackFormat},
+		{name: "другая версия", data: "0" + data[1:], operation: session, want: errCallbackFormat},
+		{name: "подпись изменена", data: tampered, operation: session, want: errCallbackSession},
+		{name: "действие изменено", data: strings.Replace(data, "|zo|", "|ck|", 1), operation: session, want: errCallbackSession},
+		{name: "другая сессия", data: data, operation: other, want: errCallbackSession},
+		{name: "другой объект", data: encodeCallback(&otherObject, "GetZones", ""), operation: session, want: errCallbackObject},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCallback(tt.data, tt.operation); !errors.Is(err, tt.want) {
+				t.Errorf("ошибка %v, ожидалась %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryCallbackLength(t *testing.T) {
+
+	setCallbackKey(config{CallbackSecret: "test"})
+	operation := newOperation()
+	operation.numberObject = "9999"
+
+	name := strings.Repeat("ю", maxServerNameLength/2)
+	if problems := checkServers([]serverConfig{{Name: name, Host: "http://localhost", ApiKey: "key"}}); len(problems) > 0 {
+		t.Fatalf("название длиной %d байт отклонено: %v", len(name), problems)
+	}
+	if problems := checkServers([]serverConfig{{Name: name + "ю", Host: "http://localhost", ApiKey: "key"}}); len(problems) == 0 {
+		t.Fatalf("название длиной %d байт не отклонено", len(name)+2)
+	}
+
+	data := encodeCallback(operation, "Retry", "9999"+serverSeparator+name)
+	if len(data) > callbackMaxLength {
+		t.Errorf("данные %q длиннее %d байт", data, callbackMaxLength)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLog передает вывод сценариев в журнал теста
+type testLog struct {
+	t *testing.T
+}
+
+func (l testLog) Write(p []byte) (int, error) {
+	l.t.Log(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// TestE2E выполняет сценарии диалогов для всех способов получения обновлений ботом.
+// Бот собирается один раз, с -short сценарии пропускаются
+func TestE2E(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip("сквозные сценарии пропускаются с -short")
+	}
+
+	botPath := filepath.Join(t.TempDir(), "bot")
+	build := exec.Command("go", "build", "-o", botPath, ".")
+	build.Dir = filepath.Join("..", "..")
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("не удалось собрать бота: %v\n%s", err, output)
+	}
+
+	for _, mode := range []string{"polling", "webhook", "webhook-tls"} {
+		t.Run(mode, func(t *testing.T) {
+			failed, err := runScenarios(options{botPath: botPath, timeout: 10 * time.Second, mode: mode}, testLog{t})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if failed > 0 {
+				t.Errorf("не пройдено сценариев: %d", failed)
+			}
+		})
+	}
+}
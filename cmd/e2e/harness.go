@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"tg-bot-security-center-v2/fakeandromeda"
+	"tg-bot-security-center-v2/faketelegram"
+)
+
+// harness ведет диалог с ботом от имени одного пользователя и проверяет ответы бота
+type harness struct {
+	tg        *faketelegram.Server
+	andromeda *fakeandromeda.Server //Основной сервер ПО "Центр охраны"
+	south     *fakeandromeda.Server //Сервер объектов с номерами 7000-7999
+	standby   *fakeandromeda.Server //Резервный адрес сервера south
+	bot       *botProcess           //Процесс бота
+	dir       string                //Каталог запуска бота с его настройками, БД и журналом
+	//Настройки бота, записанные в файл. Сценарий, изменивший файл, должен восстановить его
+	configuration map[string]any
+	chatID        int64
+	timeout       time.Duration
+}
+
+// send отправляет боту текст от имени пользователя
+func (h *harness) send(text string) {
+	h.tg.SendText(h.chatID, text)
+}
+
+// contact отправляет боту собственный контакт пользователя
+func (h *harness) contact(phone string) {
+	h.tg.SendContact(h.chatID, h.chatID, phone)
+}
+
+// press нажимает кнопку в последнем сообщении бота с инлайн клавиатурой
+func (h *harness) press(text string) error {
+	return h.tg.PressButton(h.chatID, text)
+}
+
+// waitFor ожидает запрос бота method, текст сообщения которого содержит contains.
+// Предшествующие запросы других методов пропускаются
+func (h *harness) waitFor(method, contains string) (faketelegram.Call, error) {
+
+	var skipped []string
+	deadline := time.Now().Add(h.timeout)
+	for {
+		call, err := h.tg.Next(h.chatID, time.Until(deadline))
+		if err != nil {
+			return faketelegram.Call{}, fmt.Errorf("ожидался %s с текстом %q, получены: %s", method, contains, strings.Join(skipped, "; "))
+		}
+		if call.Method == method && strings.Contains(call.Message.Text, contains) {
+			return call, nil
+		}
+		skipped = append(skipped, fmt.Sprintf("%s %q", call.Method, call.Message.Text))
+	}
+}
+
+// expectReply ожидает новое или измененное сообщение бота, содержащее текст contains и кнопки buttons
+func (h *harness) expectReply(contains string, buttons ...string) (faketelegram.Message, error) {
+
+	var skipped []string
+	deadline := time.Now().Add(h.timeout)
+	for {
+		call, err := h.tg.Next(h.chatID, time.Until(deadline))
+		if err != nil {
+			return faketelegram.Message{}, fmt.Errorf("ожидался ответ с текстом %q, получены: %s", contains, strings.Join(skipped, "; "))
+		}
+		isReply := call.Method == "sendMessage" || call.Method == "editMessageText"
+		if !isReply || call.Error != "" || !strings.Contains(call.Message.Text, contains) {
+			skipped = append(skipped, fmt.Sprintf("%s %q", call.Method, call.Message.Text))
+			continue
+		}
+
+		present := buttonTexts(call.Message)
+		for _, button := range buttons {
+			if !slices.Contains(present, button) {
+				return call.Message, fmt.Errorf("в ответе %q нет кнопки %q, есть: %q", call.Message.Text, button, present)
+			}
+		}
+		return call.Message, nil
+	}
+}
+
+// expectNoPinned проверяет, что в чате нет закрепленных сообщений
+func (h *harness) expectNoPinned() error {
+	if pinned := h.tg.Pinned(h.chatID); len(pinned) > 0 {
+		return fmt.Errorf("остались закрепленные сообщения: %q", pinned[0].Text)
+	}
+	return nil
+}
+
+// expectNoKeyboard проверяет, что бот удалил клавиатуру сообщения
+func (h *harness) expectNoKeyboard(message faketelegram.Message) error {
+	current, ok := h.tg.Message(h.chatID, message.ID)
+	if ok && len(current.InlineKeyboard) > 0 {
+		return fmt.Errorf("у сообщения %q осталась клавиатура", current.Text)
+	}
+	return nil
+}
+
+// expectAllAnswered проверяет, что бот ответил на все нажатия кнопок
+func (h *harness) expectAllAnswered() error {
+	deadline := time.Now().Add(h.timeout)
+	for h.tg.Unanswered() > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("бот не ответил на %d нажатий кнопок", h.tg.Unanswered())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// buttonTexts возвращает тексты инлайн и обычных кнопок сообщения
+func buttonTexts(message faketelegram.Message) []string {
+	var texts []string
+	for _, row := range message.InlineKeyboard {
+		for _, button := range row {
+			texts = append(texts, button.Text)
+		}
+	}
+	for _, row := range message.ReplyKeyboard {
+		for _, button := range row {
+			texts = append(texts, button.Text)
+		}
+	}
+	return texts
+}
+
+// otherChat возвращает участника диалога с ботом в другом чате, для сценариев с несколькими пользователями
+func (h *harness) otherChat() *harness {
+	other := *h
+	other.chatID += 1000
+	return &other
+}
+
+// writeConfig перезаписывает файл настроек бота
+func (h *harness) writeConfig(configuration map[string]any) error {
+	return writeConfig(filepath.Join(h.dir, botConfig), configuration)
+}
+
+// expectLog ожидает появления в журнале бота строки, содержащей contains
+func (h *harness) expectLog(contains string) error {
+
+	deadline := time.Now().Add(h.timeout)
+	for {
+		data, err := os.ReadFile(filepath.Join(h.dir, "bot.log"))
+		if err != nil {
+			return err
+		}
+		if strings.Contains(string(data), contains) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("в журнале бота нет строки %q", contains)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// restart останавливает бота по сигналу и запускает снова с теми же настройками и БД
+func (h *harness) restart() error {
+	if err := stopBot(h.bot.cmd, h.tg, h.timeout); err != nil {
+		return err
+	}
+	return h.start()
+}
+
+// start запускает остановленного бота. В режиме вебхука обновления отправляются после того,
+// как новый процесс установит вебхук
+func (h *harness) start() error {
+
+	hooks := h.countCalls("setWebhook")
+	if err := h.bot.start(); err != nil {
+		return err
+	}
+
+	if h.configuration["update_mode"] != "webhook" {
+		return nil
+	}
+	deadline := time.Now().Add(h.timeout)
+	for h.countCalls("setWebhook") == hooks {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("бот не установил вебхук после перезапуска")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// countCalls возвращает количество запросов бота method
+func (h *harness) countCalls(method string) int {
+	count := 0
+	for _, call := range h.tg.Calls() {
+		if call.Method == method {
+			count++
+		}
+	}
+	return count
+}
+
+// steps выполняет шаги сценария до первой ошибки
+func steps(fns ...func() error) error {
+	for i, fn := range fns {
+		if err := fn(); err != nil {
+			return fmt.Errorf("шаг %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,571 @@
+// Команда e2e проверяет диалоги бота от начала до конца без доступа к сети.
+// Бот собирается из исходников и запускается отдельным процессом с имитаторами Telegram Bot API
+// и API ПО "Центр охраны", после чего по очереди выполняются сценарии диалогов.
+//
+// Сценарии выполняются тестом TestE2E для всех способов получения обновлений (go test ./..., без -short)
+// или командой из корня репозитория:
+//
+//	go run ./cmd/e2e
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/EkzikP/sdk_andromeda_go_v2"
+	"gopkg.in/yaml.v3"
+	_ "modernc.org/sqlite"
+
+	"tg-bot-security-center-v2/fakeandromeda"
+	"tg-bot-security-center-v2/faketelegram"
+)
+
+const (
+	botToken  = "1000:e2e-token"
+	apiKey    = "e2e-api-key"
+	firstChat = 101 //Идентификатор чата первого сценария, у каждого сценария свой чат
+
+	webhookSecret = "e2e-webhook-secret"
+
+	serverNorth = "Север"
+	serverSouth = "Юг"
+
+	botConfig = "bot.yaml" //Файл настроек бота в каталоге запуска
+
+	objectLongList = 3333 //Объект первого сервера, список шлейфов которого выводится на нескольких страницах
+	longListZones  = 150  //Количество шлейфов объекта objectLongList
+)
+
+// options параметры прогона сценариев
+type options struct {
+	src     string        //Каталог с исходниками бота
+	botPath string        //Собранный бот, по умолчанию собирается из src
+	run     string        //Выполнить только сценарии, название которых содержит строку
+	timeout time.Duration //Время ожидания ответа бота
+	verbose bool          //Выводить журнал бота
+	mode    string        //Способ получения обновлений ботом: polling, webhook или webhook-tls
+}
+
+func main() {
+
+	var opts options
+	flag.StringVar(&opts.src, "src", ".", "каталог с исходниками бота")
+	flag.StringVar(&opts.botPath, "bot", "", "собранный бот, по умолчанию собирается из -src")
+	flag.StringVar(&opts.run, "run", "", "выполнить только сценарии, название которых содержит строку")
+	flag.DurationVar(&opts.timeout, "timeout", 10*time.Second, "время ожидания ответа бота")
+	flag.BoolVar(&opts.verbose, "v", false, "выводить журнал бота")
+	flag.StringVar(&opts.mode, "mode", "polling", "способ получения обновлений ботом: polling, webhook или webhook-tls (с самоподписанным сертификатом)")
+	flag.Parse()
+
+	failed, err := runScenarios(opts, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if failed > 0 {
+		fmt.Printf("Не пройдено сценариев: %d\n", failed)
+		os.Exit(1)
+	}
+}
+
+// runScenarios запускает бота с имитаторами и выполняет сценарии, выводя результаты в out.
+// Возвращает количество непройденных сценариев. Ошибка - не удалось подготовить запуск сценариев
+func runScenarios(opts options, out io.Writer) (int, error) {
+
+	dir, err := os.MkdirTemp("", "tg-bot-e2e")
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	botPath := opts.botPath
+	if botPath == "" {
+		botPath = filepath.Join(dir, "bot")
+		build := exec.Command("go", "build", "-o", botPath, ".")
+		build.Dir = opts.src
+		build.Stdout, build.Stderr = out, out
+		if err = build.Run(); err != nil {
+			return 0, fmt.Errorf("не удалось собрать бота: %w", err)
+		}
+	}
+
+	andromedaServer, southServer, standbyServer, err := startAndromeda()
+	if err != nil {
+		return 0, err
+	}
+	defer andromedaServer.Close()
+	defer southServer.Close()
+	defer standbyServer.Close()
+
+	tg := faketelegram.Start(botToken)
+	defer tg.Close()
+
+	//Токен бота и API ключ передаются боту через переменные окружения
+	configuration := map[string]any{
+		"db_path": "bot.db",
+		"servers": []map[string]any{
+			{"name": serverNorth, "host": andromedaServer.URL()},
+			{
+				"name":     serverSouth,
+				"host":     southServer.URL(),
+				"accounts": []map[string]int{{"from": 7000, "to": 7999}},
+				"standby":  []map[string]string{{"host": standbyServer.URL()}},
+			},
+		},
+		"phone_engineer":         map[string]string{phoneEngineer: "Инженер", phoneAdmin: "Администратор"},
+		"super_admins":           []string{phoneAdmin},
+		"object_groups":          map[string]any{"Север": []map[string]int{{"from": 5000, "to": 5999}}},
+		"telegram_api_endpoint":  tg.Endpoint(),
+		"update_mode":            opts.mode,
+		"notify_restart":         true,
+		"reload_interval":        1,
+		"session_check_interval": 1,
+		//Короткое время ожидания, чтобы сценарии с медленным сервером не растягивались
+		"request_timeouts": map[string]int{"GetSites": 1, "GetParts": 1},
+		"resilience": map[string]int{
+			"retry_attempts":   2,
+			"retry_delay":      50,
+			"breaker_failures": 4,
+			"breaker_timeout":  1,
+			"health_interval":  1,
+		},
+	}
+
+	var hookURL string
+	webhook := strings.HasPrefix(opts.mode, "webhook")
+	if webhook {
+		listen, err := freeAddr()
+		if err != nil {
+			return 0, err
+		}
+		hookURL = "http://" + listen + "/telegram"
+		hookConfig := map[string]any{
+			"listen":       listen,
+			"secret_token": webhookSecret,
+		}
+		if opts.mode == "webhook-tls" {
+			hookURL = "https://" + listen + "/telegram"
+			hookConfig["cert_file"], hookConfig["key_file"], err = writeSelfSignedCert(dir)
+			if err != nil {
+				return 0, err
+			}
+			hookConfig["upload_cert"] = true
+		}
+		hookConfig["url"] = hookURL
+		configuration["update_mode"] = "webhook"
+		configuration["webhook"] = hookConfig
+	}
+
+	failed := 0
+	if err = checkInvalidConfig(botPath, dir, opts.timeout); err != nil {
+		failed++
+		fmt.Fprintf(out, "FAIL проверка настроек\n    %v\n", err)
+	} else {
+		fmt.Fprintln(out, "ok   бот не запускается с неверными настройками и перечисляет все ошибки")
+	}
+
+	if err = checkMigrate(botPath, dir, opts.timeout); err != nil {
+		failed++
+		fmt.Fprintf(out, "FAIL миграции БД\n    %v\n", err)
+	} else {
+		fmt.Fprintln(out, "ok   команда migrate обновляет схему БД, созданной до появления миграций")
+	}
+
+	if err = writeConfig(filepath.Join(dir, botConfig), configuration); err != nil {
+		return 0, err
+	}
+
+	bot := &botProcess{path: botPath, dir: dir, verbose: opts.verbose}
+	if err = bot.start(); err != nil {
+		return 0, err
+	}
+
+	if webhook {
+		if err = checkWebhook(tg, hookURL, opts.mode == "webhook-tls", opts.timeout); err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL вебхук\n    %v\n", err)
+		} else {
+			fmt.Fprintln(out, "ok   вебхук отклоняет запросы без секрета")
+		}
+	}
+
+	for i, sc := range scenarios {
+		if !strings.Contains(sc.name, opts.run) {
+			continue
+		}
+		h := &harness{
+			tg: tg, andromeda: andromedaServer, south: southServer, standby: standbyServer,
+			bot: bot, dir: dir, configuration: configuration,
+			chatID: int64(firstChat + i), timeout: opts.timeout,
+		}
+		started := time.Now()
+		if err := sc.run(h); err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL %s (%s)\n    %v\n", sc.name, time.Since(started).Round(time.Millisecond), err)
+			continue
+		}
+		fmt.Fprintf(out, "ok   %s (%s)\n", sc.name, time.Since(started).Round(time.Millisecond))
+	}
+
+	if webhook && tg.Rejected() > 0 {
+		failed++
+		fmt.Fprintf(out, "FAIL вебхук бота отклонил %d доставок обновлений\n", tg.Rejected())
+	}
+
+	if err = stopBot(bot.cmd, tg, opts.timeout); err != nil {
+		failed++
+		fmt.Fprintf(out, "FAIL остановка бота\n    %v\n", err)
+	} else {
+		fmt.Fprintln(out, "ok   остановка бота по сигналу с предупреждением инженера")
+	}
+
+	if failed > 0 && !opts.verbose {
+		printLog(dir, out)
+	}
+	return failed, nil
+}
+
+// startAndromeda запускает имитаторы двух серверов ПО "Центр охраны" и резервного адреса второго сервера.
+// Объект 4444 есть на обоих серверах и по номеру относится к первому, объект 7777 относится ко второму серверу
+// по диапазону номеров. У объекта 3333 длинный список шлейфов
+func startAndromeda() (*fakeandromeda.Server, *fakeandromeda.Server, *fakeandromeda.Server, error) {
+
+	defaults := fakeandromeda.DefaultFixtures()
+
+	north := fakeandromeda.DefaultFixtures()
+	for _, number := range []int{4444, objectLongList} {
+		if err := north.CopySite(defaults, 1234, number); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	//Список шлейфов объекта не помещается на одну страницу сообщения
+	i := slices.IndexFunc(north.Sites, func(site andromeda.GetSitesResponse) bool { return site.AccountNumber == objectLongList })
+	zones := make([]andromeda.GetZonesResponse, 0, longListZones)
+	for number := 1; number <= longListZones; number++ {
+		zones = append(zones, andromeda.GetZonesResponse{
+			Id:         fmt.Sprintf("z0000000-0000-4000-8000-%012d", 3000+number),
+			ZoneNumber: number,
+			ZoneDesc:   fmt.Sprintf("Извещатель %d, помещение %d", number, (number+9)/10),
+		})
+	}
+	north.Zones[north.Sites[i].Id] = zones
+
+	south := fakeandromeda.Fixtures{}
+	for _, number := range []int{4444, 7777} {
+		if err := south.CopySite(defaults, 1234, number); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	northServer := fakeandromeda.Start(north, apiKey)
+	northServer.SetCheckPanic(time.Minute, fakeandromeda.PanicTimeOut)
+	return northServer, fakeandromeda.Start(south, apiKey), fakeandromeda.Start(south, apiKey), nil
+}
+
+// writeConfig записывает настройки бота в формате JSON или YAML, в зависимости от расширения файла
+func writeConfig(path string, configuration map[string]any) error {
+	marshal := func(v any) ([]byte, error) { return json.MarshalIndent(v, "", "  ") }
+	if filepath.Ext(path) == ".yaml" {
+		marshal = yaml.Marshal
+	}
+	data, err := marshal(configuration)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// checkInvalidConfig запускает бота с неверными настройками и проверяет, что он завершается
+// и сообщает обо всех ошибках сразу
+func checkInvalidConfig(path, dir string, timeout time.Duration) error {
+
+	invalid := map[string]any{
+		"host":           "192.168.0.10:9002",
+		"api_key":        apiKey,
+		"phone_engineer": map[string]string{"89990000000": "Инженер"},
+		"roles":          map[string][]string{"dispatcher": {"GetZones", "DeleteObject"}},
+		"object_groups":  map[string]any{"Север": []map[string]int{{"from": 5999, "to": 5000}}},
+		"update_mode":    "webhook",
+		"webhook":        map[string]any{"listen": "127.0.0.1:0"},
+	}
+	if err := writeConfig(filepath.Join(dir, "invalid.json"), invalid); err != nil {
+		return err
+	}
+
+	bot := exec.Command(path, "-config", "invalid.json")
+	bot.Dir = dir
+	bot.Env = append(os.Environ(), "TELEGRAM_BOT_TOKEN=", "WEBHOOK_SECRET_TOKEN=")
+	done := make(chan struct{})
+	var output []byte
+	var err error
+	go func() {
+		output, err = bot.CombinedOutput()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		_ = bot.Process.Kill()
+		return fmt.Errorf("бот с неверными настройками не завершился за %s", timeout)
+	}
+	if err == nil {
+		return fmt.Errorf("бот с неверными настройками завершился без ошибки")
+	}
+	for _, problem := range []string{"не задан токен бота", "неверный адрес \"192.168.0.10:9002\"", "телефон инженера \"89990000000\"", "неизвестный пункт меню \"DeleteObject\"", "неверный диапазон номеров объектов 5999-5000 группы \"Север\"",
+		"не задан адрес вебхука webhook.url", "не задан секрет вебхука"} {
+		if !strings.Contains(string(output), problem) {
+			return fmt.Errorf("в выводе бота нет ошибки %q:\n%s", problem, output)
+		}
+	}
+	return nil
+}
+
+// checkMigrate проверяет команду migrate на БД, созданной до появления миграций:
+// пробный запуск не изменяет БД, а миграции сохраняют данные пользователей
+func checkMigrate(path, dir string, timeout time.Duration) error {
+
+	const dbPath = "legacy.db"
+	db, err := sql.Open("sqlite", filepath.Join(dir, dbPath))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+
+	_, err = db.Exec(`CREATE TABLE users (chatId INTEGER PRIMARY KEY, phone TEXT NOT NULL);
+		INSERT INTO users (chatId, phone) VALUES (1, '` + phoneCustomer + `')`)
+	if err != nil {
+		return err
+	}
+
+	migrate := func(args ...string) (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, path, append([]string{"migrate", "-db", dbPath}, args...)...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("migrate %s: %v\n%s", strings.Join(args, " "), err, output)
+		}
+		return string(output), nil
+	}
+	migrated := func() (bool, error) {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'schema_migrations'").Scan(&count)
+		return count > 0, err
+	}
+
+	output, err := migrate("-dry-run")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(output, "версия схемы 0") || !strings.Contains(output, "0002_sessions") {
+		return fmt.Errorf("пробный запуск не показал миграции:\n%s", output)
+	}
+	if ok, err := migrated(); err != nil || ok {
+		return fmt.Errorf("пробный запуск изменил БД (%v)", err)
+	}
+
+	if output, err = migrate(); err != nil {
+		return err
+	}
+	if !strings.Contains(output, "Применены миграции: 0001_users, 0002_sessions") {
+		return fmt.Errorf("миграции не применены:\n%s", output)
+	}
+	var phone string
+	if err = db.QueryRow("SELECT phone FROM users WHERE chatId = 1").Scan(&phone); err != nil || phone != phoneCustomer {
+		return fmt.Errorf("после миграции потерян пользователь: %q (%v)", phone, err)
+	}
+
+	if output, err = migrate("-dry-run"); err != nil {
+		return err
+	}
+	if !strings.Contains(output, "новых миграций нет") {
+		return fmt.Errorf("повторный запуск предлагает миграции:\n%s", output)
+	}
+	return nil
+}
+
+// botProcess запущенный процесс бота. Сценарий перезапуска заменяет процесс новым
+type botProcess struct {
+	path    string
+	dir     string
+	verbose bool
+	cmd     *exec.Cmd
+}
+
+// start запускает новый процесс бота
+func (b *botProcess) start() error {
+	cmd, err := startBot(b.path, b.dir, b.verbose)
+	b.cmd = cmd
+	return err
+}
+
+// startBot запускает бота в каталоге dir, где находятся его настройки и БД
+func startBot(path, dir string, verbose bool) (*exec.Cmd, error) {
+
+	//Журнал перезапущенного бота дописывается к журналу предыдущего запуска
+	logFile, err := os.OpenFile(filepath.Join(dir, "bot.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	bot := exec.Command(path, "-config", botConfig)
+	bot.Dir = dir
+	bot.Env = append(os.Environ(), "TELEGRAM_BOT_TOKEN="+botToken, "API_KEY="+apiKey)
+	bot.Stdout, bot.Stderr = logFile, logFile
+	if verbose {
+		output := io.MultiWriter(os.Stdout, logFile)
+		bot.Stdout, bot.Stderr = output, output
+	}
+	return bot, bot.Start()
+}
+
+// printLog выводит журнал бота в out
+func printLog(dir string, out io.Writer) {
+	data, err := os.ReadFile(filepath.Join(dir, "bot.log"))
+	if err != nil {
+		return
+	}
+	_, _ = fmt.Fprintf(out, "Журнал бота:\n%s\n", data)
+}
+
+// freeAddr возвращает свободный локальный адрес для приема запросов вебхука
+func freeAddr() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = listener.Close() }()
+	return listener.Addr().String(), nil
+}
+
+// checkWebhook ожидает регистрации вебхука ботом и проверяет, что запросы без секрета отклоняются
+func checkWebhook(tg *faketelegram.Server, hookURL string, uploadCert bool, timeout time.Duration) error {
+
+	deadline := time.Now().Add(timeout)
+	for tg.Webhook() == nil {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("бот не зарегистрировал вебхук за %s", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := tg.Webhook().Get("url"); got != hookURL {
+		return fmt.Errorf("зарегистрирован вебхук %q, ожидался %q", got, hookURL)
+	}
+	if got := tg.Webhook().Get("secret_token"); got != webhookSecret {
+		return fmt.Errorf("вебхук зарегистрирован с секретом %q", got)
+	}
+	if uploadCert && tg.Webhook().Get("certificate") == "" {
+		return fmt.Errorf("сертификат не загружен в Telegram")
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	for _, secret := range []string{"", "wrong-secret"} {
+		request, err := http.NewRequest(http.MethodPost, hookURL, strings.NewReader(`{"update_id":1}`))
+		if err != nil {
+			return err
+		}
+		if secret != "" {
+			request.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		_ = response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized {
+			return fmt.Errorf("запрос с секретом %q принят с кодом %d", secret, response.StatusCode)
+		}
+	}
+	return nil
+}
+
+// writeSelfSignedCert создает самоподписанный сертификат для 127.0.0.1 и возвращает пути к сертификату и ключу
+func writeSelfSignedCert(dir string) (string, string, error) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyData, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile := filepath.Join(dir, "webhook.pem")
+	keyFile := filepath.Join(dir, "webhook.key")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0o600)
+	if err != nil {
+		return "", "", err
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyData}), 0o600)
+	return certFile, keyFile, err
+}
+
+// stopBot останавливает бота сигналом SIGTERM и проверяет, что он завершился без ошибок
+// и предупредил инженера с незавершенной работой с объектом о перезапуске
+func stopBot(bot *exec.Cmd, tg *faketelegram.Server, timeout time.Duration) error {
+
+	if err := bot.Process.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- bot.Wait() }()
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			return fmt.Errorf("бот завершился с ошибкой: %v", err)
+		}
+	case <-time.After(timeout):
+		_ = bot.Process.Kill()
+		return fmt.Errorf("бот не остановился за %s", timeout)
+	}
+
+	for _, call := range tg.Calls() {
+		if call.Method == "sendMessage" && strings.Contains(call.Message.Text, "Бот перезапускается") {
+			return nil
+		}
+	}
+	return fmt.Errorf("инженер не предупрежден о перезапуске")
+}
@@ -0,0 +1,1297 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"tg-bot-security-center-v2/fakeandromeda"
+	"tg-bot-security-center-v2/faketelegram"
+)
+
+const (
+	phoneCustomer   = "+79001112233" //Ответственное лицо объекта 1234, администратор MyAlarm
+	phoneStranger   = "+79004445566" //Ответственное лицо объекта 1234, нет прав на объект 5678
+	phoneEngineer   = "+79990000000" //Инженер
+	phoneNewcomer   = "+79007778899" //Новый инженер, добавляется в настройки во время работы бота
+	phoneAdmin      = "+79990000001" //Супер-администратор, ведет список инженеров
+	phoneTrainee    = "+79005550011" //Инженер, которого добавляет и отключает супер-администратор
+	phoneDispatcher = "+79005550022" //Инженер, которому супер-администратор назначает роли с ограниченными правами
+	phoneContractor = "+79005550033" //Инженер подрядчика, за которым закреплена часть объектов
+	phoneInstaller  = "+79005550044" //Монтажник сторонней организации, получает временный доступ к объекту
+	objectCustomer  = "1234"
+	objectAlarm     = "5678"
+)
+
+// scenario сценарий диалога с ботом
+type scenario struct {
+	name string
+	run  func(h *harness) error
+}
+
+var scenarios = []scenario{
+	{"ответственное лицо проверяет КТС и завершает работу с объектом", customerChecksKTS},
+	{"нет прав на объект", noRights},
+	{"объект не найден", objectNotFound},
+	{"инженер предоставляет доступ к MyAlarm", engineerAddsMyAlarmUser},
+	{"проверка КТС при тревоге по объекту", checkKTSWithAlarm},
+	{"сервер Центра охраны не отвечает", andromedaNotResponding},
+	{"повтор запросов при сбоях сети и прекращение запросов к недоступному серверу", networkFailures},
+	{"сервер Центра охраны отвечает ошибкой 503", serverError},
+	{"объекты на нескольких серверах Центра охраны", severalServers},
+	{"переключение на резервный адрес сервера и обратно", standbyFailover},
+	{"перечитывание настроек без перезапуска", reloadConfig},
+	{"супер-администратор ведет список инженеров", manageEngineers},
+	{"роли инженеров ограничивают пункты меню объекта", engineerRoles},
+	{"инженер работает только с закрепленными за ним объектами", engineerScope},
+	{"временный доступ к объекту", temporaryGrant},
+	{"журнал аудита действий с объектами", auditLog},
+	{"контакт принимается только от его владельца", foreignContact},
+	{"длинные ответы служебных команд выводятся по страницам", commandPages},
+	{"сессия восстанавливается после перезапуска бота", sessionRestored},
+	{"работа с объектом завершается при бездействии пользователя", sessionExpired},
+	{"длинный список шлейфов листается по страницам", longZoneList},
+	{"команда /start завершает работу с объектом", restartDialog},
+}
+
+// login отправляет /start и контакт пользователя
+func login(h *harness, phone string) error {
+	h.send("/start")
+	if _, err := h.expectReply("номер телефона", "Отправить номер телефона"); err != nil {
+		return err
+	}
+	h.contact(phone)
+	_, err := h.expectReply("Введите пультовый номер объекта!")
+	return err
+}
+
+// openObject вводит номер объекта и ожидает закрепленное сообщение и главное меню
+func openObject(h *harness, number string) (faketelegram.Message, error) {
+	h.send(number)
+	if _, err := h.waitFor("sendMessage", "Работа с объектом "+number); err != nil {
+		return faketelegram.Message{}, err
+	}
+	if _, err := h.waitFor("pinChatMessage", "Работа с объектом "+number); err != nil {
+		return faketelegram.Message{}, err
+	}
+	return h.expectReply("Выберите пункт меню", "Проверка КТС", "Завершить работу с объектом")
+}
+
+// pressAndExpect нажимает кнопку и ожидает ответ с текстом contains и кнопками buttons
+func pressAndExpect(h *harness, button, contains string, buttons ...string) error {
+	if err := h.press(button); err != nil {
+		return err
+	}
+	_, err := h.expectReply(contains, buttons...)
+	return err
+}
+
+func customerChecksKTS(h *harness) error {
+
+	var menu faketelegram.Message
+
+	return steps(
+		func() error { return login(h, phoneCustomer) },
+		func() (err error) { menu, err = openObject(h, objectCustomer); return err },
+		func() error {
+			return pressAndExpect(h, "Проверка КТС", "проверка КТС начата", "Получить результат проверки КТС")
+		},
+		func() error {
+			return pressAndExpect(h, "Получить результат проверки КТС", "проверка КТС продолжается", "Получить результат проверки КТС")
+		},
+		func() error {
+			h.andromeda.PressPanic(1234)
+			return pressAndExpect(h, "Получить результат проверки КТС", "проверка КТС успешно завершена", "Назад")
+		},
+		func() error {
+			return pressAndExpect(h, "Назад", "Выберите пункт меню", "Получить список шлейфов")
+		},
+		func() error {
+			return pressAndExpect(h, "Получить список шлейфов", "Кнопка КТС", "Назад")
+		},
+		func() error {
+			return pressAndExpect(h, "Завершить работу с объектом", "Введите пультовый номер объекта!")
+		},
+		h.expectNoPinned,
+		func() error { return h.expectNoKeyboard(menu) },
+		func() error {
+			//Кнопка завершенной сессии не должна выполнять действие
+			if err := h.tg.PressButtonIn(menu, "Проверка КТС"); err != nil {
+				return err
+			}
+			_, err := h.expectReply("Кнопка относится к завершенной сессии")
+			return err
+		},
+		h.expectAllAnswered,
+	)
+}
+
+func noRights(h *harness) error {
+	return steps(
+		func() error { return login(h, phoneStranger) },
+		func() error {
+			h.send(objectAlarm)
+			_, err := h.expectReply("У вас нет прав на этот объект!")
+			return err
+		},
+	)
+}
+
+func objectNotFound(h *harness) error {
+	return steps(
+		func() error { return login(h, phoneCustomer) },
+		func() error {
+			h.send("9999")
+			_, err := h.expectReply("Объект не найден")
+			return err
+		},
+	)
+}
+
+func engineerAddsMyAlarmUser(h *harness) error {
+	return steps(
+		func() error { return login(h, phoneEngineer) },
+		func() error { _, err := openObject(h, objectCustomer); return err },
+		func() error {
+			return pressAndExpect(h, "Управление доступом в MyAlarm", "Подменю MyAlarm", "Предоставить доступ к MyAlarm")
+		},
+		func() error {
+			return pressAndExpect(h, "Предоставить доступ к MyAlarm", "Выберите пользователя", "Петров Петр Петрович, +79004445566")
+		},
+		func() error {
+			return pressAndExpect(h, "Петров Петр Петрович, +79004445566", "Выберите права пользователя", "Пользователь")
+		},
+		func() error {
+			return pressAndExpect(h, "Пользователь", "Пользователь MyAlarm успешно добавлен")
+		},
+		func() error {
+			for _, user := range h.andromeda.UsersMyAlarm(1234) {
+				if user.MyAlarmPhone == phoneStranger && user.Role == "user" {
+					return nil
+				}
+			}
+			return fmt.Errorf("пользователь %s не добавлен в MyAlarm", phoneStranger)
+		},
+		func() error { return pressAndExpect(h, "Назад", "Подменю MyAlarm") },
+		h.expectAllAnswered,
+	)
+}
+
+func checkKTSWithAlarm(h *harness) error {
+	return steps(
+		func() error { return login(h, phoneEngineer) },
+		func() error { _, err := openObject(h, objectAlarm); return err },
+		func() error {
+			return pressAndExpect(h, "Проверка КТС", "по объекту есть тревога", "Назад")
+		},
+		h.expectAllAnswered,
+	)
+}
+
+func andromedaNotResponding(h *harness) error {
+
+	//Задержка больше времени ожидания запросов, заданного в настройках бота
+	const slow = 2 * time.Second
+	defer h.andromeda.Delay("/Sites", 0)
+	defer h.andromeda.Delay("/Parts", 0)
+
+	return steps(
+		func() error { return login(h, phoneCustomer) },
+		func() error {
+			h.andromeda.Delay("/Sites", slow)
+			h.send(objectCustomer)
+			_, err := h.expectReply("Сервер Центра охраны не отвечает", "Повторить")
+			return err
+		},
+		func() error {
+			h.andromeda.Delay("/Sites", 0)
+			if err := h.press("Повторить"); err != nil {
+				return err
+			}
+			_, err := h.expectReply("Выберите пункт меню", "Получить список разделов")
+			return err
+		},
+		func() error {
+			h.andromeda.Delay("/Parts", slow)
+			return pressAndExpect(h, "Получить список разделов", "Сервер Центра охраны не отвечает", "Повторить", "Назад")
+		},
+		func() error {
+			h.andromeda.Delay("/Parts", 0)
+			return pressAndExpect(h, "Повторить", "Номер раздела", "Назад")
+		},
+		h.expectAllAnswered,
+	)
+}
+
+// requestCount возвращает количество запросов method к path, полученных основным имитатором ПО "Центр охраны"
+func requestCount(h *harness, method, path string) int {
+	return serverRequestCount(h.andromeda, method, path)
+}
+
+// serverRequestCount возвращает количество запросов method к path, полученных имитатором server
+func serverRequestCount(server *fakeandromeda.Server, method, path string) int {
+	count := 0
+	for _, request := range server.Requests() {
+		if request.Method == method && request.Path == path {
+			count++
+		}
+	}
+	return count
+}
+
+func networkFailures(h *harness) error {
+
+	defer h.andromeda.Drop("/Parts", 0)
+
+	var sites, checks, parts int
+
+	return steps(
+		func() error { return login(h, phoneCustomer) },
+		func() error {
+			//Запрос на чтение повторяется незаметно для пользователя
+			sites = requestCount(h, "GET", "/Sites")
+			h.andromeda.Drop("/Sites", 1)
+			_, err := openObject(h, objectCustomer)
+			return err
+		},
+		func() error {
+			if got := requestCount(h, "GET", "/Sites") - sites; got != 2 {
+				return fmt.Errorf("запросов объекта %d, ожидалось 2", got)
+			}
+			return nil
+		},
+		func() error {
+			//Запрос на изменение не повторяется автоматически
+			checks = requestCount(h, "POST", "/CheckPanic")
+			h.andromeda.Drop("/CheckPanic", 1)
+			return pressAndExpect(h, "Проверка КТС", "Сервер Центра охраны не отвечает", "Повторить")
+		},
+		func() error {
+			if got := requestCount(h, "POST", "/CheckPanic") - checks; got != 1 {
+				return fmt.Errorf("запросов начала проверки КТС %d, ожидался 1", got)
+			}
+			return pressAndExpect(h, "Повторить", "проверка КТС начата", "Получить результат проверки КТС")
+		},
+		func() error {
+			return pressAndExpect(h, "Назад", "Выберите пункт меню", "Получить список разделов")
+		},
+		func() error {
+			h.andromeda.Drop("/Parts", 100)
+			return pressAndExpect(h, "Получить список разделов", "Сервер Центра охраны не отвечает", "Повторить")
+		},
+		func() error {
+			//Текст и кнопки не меняются, Telegram отвечает, что сообщение не изменено
+			if err := h.press("Повторить"); err != nil {
+				return err
+			}
+			_, err := h.waitFor("editMessageText", "Сервер Центра охраны не отвечает")
+			return err
+		},
+		func() error {
+			//После нескольких неудачных запросов подряд бот отвечает сразу, не обращаясь к серверу
+			parts = requestCount(h, "GET", "/Parts")
+			return pressAndExpect(h, "Повторить", "временно недоступен", "Повторить")
+		},
+		func() error {
+			if got := requestCount(h, "GET", "/Parts") - parts; got != 0 {
+				return fmt.Errorf("к недоступному серверу отправлено запросов: %d", got)
+			}
+			h.andromeda.Drop("/Parts", 0)
+			time.Sleep(1100 * time.Millisecond)
+			return pressAndExpect(h, "Повторить", "Номер раздела", "Назад")
+		},
+		h.expectAllAnswered,
+	)
+}
+
+func serverError(h *harness) error {
+
+	defer h.andromeda.Fail("/Zones", 0)
+
+	var zones int
+
+	return steps(
+		func() error { return login(h, phoneCustomer) },
+		func() error { _, err := openObject(h, objectCustomer); return err },
+		//SDK не сообщает код ответа, поэтому ответ 503 не считается недоступностью сервера: запрос не повторяется
+		//автоматически, но пользователь может повторить его кнопкой
+		func() error {
+			zones = requestCount(h, "GET", "/Zones")
+			h.andromeda.Fail("/Zones", http.StatusServiceUnavailable)
+			return pressAndExpect(h, "Получить список шлейфов", "Сервер Центра охраны не смог выполнить запрос", "Повторить", "Назад")
+		},
+		func() error {
+			if got := requestCount(h, "GET", "/Zones") - zones; got != 1 {
+				return fmt.Errorf("запросов шлейфов %d, ожидался 1", got)
+			}
+			//Невыполненный запрос записывается в журнал аудита как неудачный
+			if err := h.expectLog("объект " + objectCustomer + ", GetZones : failed"); err != nil {
+				return err
+			}
+			h.andromeda.Fail("/Zones", 0)
+			return pressAndExpect(h, "Повторить", "Кнопка КТС", "Назад")
+		},
+		func() error {
+			return pressAndExpect(h, "Завершить работу с объектом", "Введите пультовый номер объекта!")
+		},
+		h.expectAllAnswered,
+	)
+}
+
+func severalServers(h *harness) error {
+
+	var northSites, southParts, southZones int
+
+	return steps(
+		func() error { return login(h, phoneEngineer) },
+		func() error {
+			//Объект ищется только на сервере, к которому относится по номеру
+			northSites = serverRequestCount(h.andromeda, "GET", "/Sites")
+			_, err := openObject(h, "7777")
+			return err
+		},
+		func() error {
+			if got := serverRequestCount(h.andromeda, "GET", "/Sites") - northSites; got != 0 {
+				return fmt.Errorf("объект 7777 искали на сервере %s: %d запросов", serverNorth, got)
+			}
+			southParts = serverRequestCount(h.south, "GET", "/Parts")
+			return pressAndExpect(h, "Получить список разделов", "Номер раздела", "Назад")
+		},
+		func() error {
+			if got := serverRequestCount(h.south, "GET", "/Parts") - southParts; got != 1 {
+				return fmt.Errorf("запросов разделов к серверу %s: %d, ожидался 1", serverSouth, got)
+			}
+			return pressAndExpect(h, "Завершить работу с объектом", "Введите пультовый номер объекта!")
+		},
+		func() error {
+			//Номер вне диапазонов ищется на серверах без диапазонов
+			h.send("4444")
+			if _, err := h.waitFor("sendMessage", "Работа с объектом 4444 (сервер "+serverNorth+")"); err != nil {
+				return err
+			}
+			_, err := h.expectReply("Выберите пункт меню", "Завершить работу с объектом")
+			return err
+		},
+		func() error {
+			return pressAndExpect(h, "Завершить работу с объектом", "Введите пультовый номер объекта!")
+		},
+		func() error {
+			//Сервер выбран явно
+			h.send("4444@юг")
+			if _, err := h.waitFor("sendMessage", "Работа с объектом 4444 (сервер "+serverSouth+")"); err != nil {
+				return err
+			}
+			_, err := h.expectReply("Выберите пункт меню", "Получить список шлейфов")
+			return err
+		},
+		func() error {
+			southZones = serverRequestCount(h.south, "GET", "/Zones")
+			return pressAndExpect(h, "Получить список шлейфов", "Номер шлейфа", "Назад")
+		},
+		func() error {
+			if got := serverRequestCount(h.south, "GET", "/Zones") - southZones; got != 1 {
+				return fmt.Errorf("запросов шлейфов к серверу %s: %d, ожидался 1", serverSouth, got)
+			}
+			return nil
+		},
+		h.expectAllAnswered,
+	)
+}
+
+// activeHost запрашивает командой /status активный адрес сервера server
+func activeHost(h *harness, server string) (string, error) {
+
+	h.send("/status")
+	msg, err := h.expectReply("Серверы Центра охраны")
+	if err != nil {
+		return "", err
+	}
+
+	_, section, _ := strings.Cut(msg.Text, "\n"+server+"\n")
+	for _, line := range strings.Split(section, "\n") {
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "► ") {
+			return strings.TrimPrefix(line, "► "), nil
+		}
+	}
+	return "", fmt.Errorf("в ответе %q нет активного адреса сервера %s", msg.Text, server)
+}
+
+func standbyFailover(h *harness) error {
+
+	defer h.south.SetDown(false)
+	defer h.south.Fail("/Zones", 0)
+
+	var standbySites, southParts, standbyZones int
+
+	return steps(
+		func() error { return login(h, phoneEngineer) },
+		func() error {
+			h.south.SetDown(true)
+			standbySites = serverRequestCount(h.standby, "GET", "/Sites")
+			_, err := openObject(h, "7777")
+			return err
+		},
+		func() error {
+			if serverRequestCount(h.standby, "GET", "/Sites") == standbySites {
+				return fmt.Errorf("объект не запрошен на резервном адресе")
+			}
+			active, err := activeHost(h, serverSouth)
+			if err == nil && !strings.HasPrefix(active, "резервный") {
+				err = fmt.Errorf("активен адрес %q, ожидался резервный", active)
+			}
+			return err
+		},
+		func() error {
+			//После восстановления основного адреса запросы возвращаются на него
+			h.south.SetDown(false)
+			return waitForActiveHost(h, serverSouth, "основной")
+		},
+		func() error {
+			southParts = serverRequestCount(h.south, "GET", "/Parts")
+			return pressAndExpect(h, "Получить список разделов", "Номер раздела", "Назад")
+		},
+		func() error {
+			if got := serverRequestCount(h.south, "GET", "/Parts") - southParts; got != 1 {
+				return fmt.Errorf("запросов разделов к основному адресу: %d, ожидался 1", got)
+			}
+			return nil
+		},
+		//Ответ 503 основного адреса не переключает запросы на резервный: SDK не сообщает код ответа,
+		//и отличить недоступность сервера от ошибки запроса нельзя
+		func() error {
+			return pressAndExpect(h, "Назад", "Выберите пункт меню", "Получить список шлейфов")
+		},
+		func() error {
+			h.south.Fail("/Zones", http.StatusServiceUnavailable)
+			standbyZones = serverRequestCount(h.standby, "GET", "/Zones")
+			return pressAndExpect(h, "Получить список шлейфов", "Сервер Центра охраны не смог выполнить запрос", "Повторить", "Назад")
+		},
+		func() error {
+			if serverRequestCount(h.standby, "GET", "/Zones") != standbyZones {
+				return fmt.Errorf("шлейфы запрошены на резервном адресе")
+			}
+			active, err := activeHost(h, serverSouth)
+			if err == nil && !strings.HasPrefix(active, "основной") {
+				err = fmt.Errorf("активен адрес %q, ожидался основной", active)
+			}
+			return err
+		},
+		func() error {
+			h.south.Fail("/Zones", 0)
+			return waitForActiveHost(h, serverSouth, "основной")
+		},
+		h.expectAllAnswered,
+	)
+}
+
+// waitForActiveHost ожидает, пока активным адресом сервера server не станет адрес kind: "основной" или "резервный"
+func waitForActiveHost(h *harness, server, kind string) error {
+
+	deadline := time.Now().Add(h.timeout)
+	for {
+		active, err := activeHost(h, server)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(active, kind) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("запросы не вернулись на %s адрес, активен %q", kind, active)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// waitForEngineer отправляет /status, пока бот не начнет (engineer) или не перестанет считать пользователя инженером
+func waitForEngineer(h *harness, engineer bool) error {
+
+	deadline := time.Now().Add(h.timeout)
+	for {
+		h.send("/status")
+		msg, err := h.expectReply("")
+		if err != nil {
+			return err
+		}
+		if strings.Contains(msg.Text, "Серверы Центра охраны") == engineer {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("настройки не перечитаны, ответ на /status: %q", msg.Text)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func reloadConfig(h *harness) error {
+
+	//Восстанавливается исходный файл настроек, даже если сценарий не пройден
+	defer func() { _ = h.writeConfig(h.configuration) }()
+
+	changed := maps.Clone(h.configuration)
+	changed["phone_engineer"] = map[string]string{phoneEngineer: "Инженер", phoneNewcomer: "Новый инженер"}
+	changed["db_path"] = "other.db"
+
+	return steps(
+		func() error { return login(h, phoneNewcomer) },
+		func() error {
+			h.send("/status")
+			_, err := h.expectReply("Введите пультовый номер объекта!")
+			return err
+		},
+		//Изменение файла настроек применяется без сигнала
+		func() error { return h.writeConfig(changed) },
+		func() error { return waitForEngineer(h, true) },
+		func() error {
+			return h.expectLog("phone_engineer: добавлен инженер " + phoneNewcomer + " (Новый инженер)")
+		},
+		func() error {
+			return h.expectLog("Настройка db_path не может быть изменена без перезапуска бота")
+		},
+		//Ошибка в файле настроек не отменяет действующие настройки
+		func() error {
+			invalid := maps.Clone(changed)
+			invalid["phone_engineer"] = map[string]string{"8999": "Инженер"}
+			return h.writeConfig(invalid)
+		},
+		func() error {
+			return h.expectLog("Настройки не перечитаны, действуют прежние")
+		},
+		func() error { return waitForEngineer(h, true) },
+		//Исходные настройки восстанавливаются по сигналу SIGHUP. Настройки только заполняют список инженеров,
+		//поэтому инженер, удаленный из настроек, остается в списке
+		func() error { return h.writeConfig(h.configuration) },
+		func() error { return h.bot.cmd.Process.Signal(syscall.SIGHUP) },
+		func() error {
+			return h.expectLog("phone_engineer: удален инженер " + phoneNewcomer + " (Новый инженер), в списке инженеров он остается")
+		},
+		func() error { return waitForEngineer(h, true) },
+	)
+}
+
+// command отправляет команду и ожидает ответ с текстом contains
+func command(h *harness, text, contains string) error {
+	h.send(text)
+	_, err := h.expectReply(contains)
+	return err
+}
+
+func manageEngineers(h *harness) error {
+
+	trainee := h.otherChat()
+
+	return steps(
+		func() error { return login(h, phoneAdmin) },
+		func() error {
+			return command(h, "/engineers", "Инженер, "+phoneEngineer+"\nРоль: старший инженер, действует")
+		},
+		func() error { return command(h, "/add_engineer 123", "Неверный формат команды") },
+		func() error {
+			return command(h, "/add_engineer "+phoneTrainee, "Укажите имя инженера")
+		},
+		func() error {
+			return command(h, "/add_engineer "+phoneTrainee+" Сидоров Сидор", "Инженер Сидоров Сидор ("+phoneTrainee+") добавлен, роль старший инженер.")
+		},
+		func() error {
+			return command(h, "/engineers", "Сидоров Сидор, "+phoneTrainee+"\nРоль: старший инженер, действует\nОбъекты: все\nИзменен: ")
+		},
+		func() error { return login(trainee, phoneTrainee) },
+		func() error { return waitForEngineer(trainee, true) },
+		//Инженеру команды супер-администратора недоступны
+		func() error {
+			return command(trainee, "/disable_engineer "+phoneAdmin, "Команда доступна только супер-администратору.")
+		},
+		func() error {
+			return command(h, "/disable_engineer "+phoneAdmin, "Нельзя отключить самого себя.")
+		},
+		func() error {
+			return command(h, "/disable_engineer "+phoneTrainee, "Инженер Сидоров Сидор ("+phoneTrainee+") отключен.")
+		},
+		func() error { return waitForEngineer(trainee, false) },
+		func() error {
+			return command(h, "/engineers", "Роль: старший инженер, отключен\nОбъекты: все\nИзменен: ")
+		},
+		func() error { return command(h, "/engineers", "Администратор ("+phoneAdmin+")") },
+		func() error {
+			return command(h, "/add_engineer "+phoneTrainee, "Инженер Сидоров Сидор ("+phoneTrainee+") снова включен.")
+		},
+		func() error { return waitForEngineer(trainee, true) },
+	)
+}
+
+// expectMenu ожидает меню с кнопками buttons и без кнопок hidden
+func expectMenu(h *harness, contains string, buttons, hidden []string) error {
+	msg, err := h.expectReply(contains, buttons...)
+	if err != nil {
+		return err
+	}
+	for _, button := range hidden {
+		if slices.Contains(buttonTexts(msg), button) {
+			return fmt.Errorf("в меню %q есть недоступная роли кнопка %q", msg.Text, button)
+		}
+	}
+	return nil
+}
+
+func engineerRoles(h *harness) error {
+
+	dispatcher := h.otherChat()
+
+	return steps(
+		func() error { return login(h, phoneAdmin) },
+		func() error {
+			return command(h, "/add_engineer "+phoneDispatcher+" Диспетчер Дарья", "Инженер Диспетчер Дарья ("+phoneDispatcher+") добавлен, роль старший инженер.")
+		},
+		func() error {
+			return command(h, "/set_role "+phoneDispatcher, "Неверный формат команды")
+		},
+		func() error {
+			return command(h, "/set_role "+phoneDispatcher+" customer", "Роль customer не может быть назначена инженеру.")
+		},
+		func() error {
+			return command(h, "/set_role "+phoneDispatcher+" dispatcher", "Инженер Диспетчер Дарья ("+phoneDispatcher+"): роль старший инженер → диспетчер.")
+		},
+		func() error { return login(dispatcher, phoneDispatcher) },
+		func() error { return waitForEngineer(dispatcher, true) },
+		//Диспетчер только просматривает данные объекта
+		func() error {
+			dispatcher.send(objectCustomer)
+			return expectMenu(dispatcher, "Выберите пункт меню", []string{"Получить список шлейфов", "Управление доступом в MyAlarm"}, []string{"Проверка КТС"})
+		},
+		func() error {
+			if err := dispatcher.press("Управление доступом в MyAlarm"); err != nil {
+				return err
+			}
+			return expectMenu(dispatcher, "Подменю MyAlarm", []string{"Список пользователей MyAlarm объекта"},
+				[]string{"Предоставить доступ к MyAlarm", "Забрать доступ к MyAlarm", "Модифицировать виртуальную КТС"})
+		},
+		//Права проверяются и для кнопок меню, выведенного до изменения роли
+		func() error {
+			return command(h, "/set_role "+phoneDispatcher+" technician", "роль диспетчер → выездной техник.")
+		},
+		func() error {
+			if err := dispatcher.press("Список пользователей MyAlarm объекта"); err != nil {
+				return err
+			}
+			return expectMenu(dispatcher, "Действие недоступно для роли «выездной техник».", []string{"Проверка КТС"}, []string{"Управление доступом в MyAlarm"})
+		},
+		func() error {
+			return h.expectLog("объект " + objectCustomer + ", GetUsersMyAlarm : denied пункт меню недоступен роли")
+		},
+		func() error {
+			return pressAndExpect(dispatcher, "Получить список шлейфов", "Кнопка КТС", "Назад")
+		},
+		func() error {
+			return pressAndExpect(dispatcher, "Завершить работу с объектом", "Введите пультовый номер объекта!")
+		},
+		dispatcher.expectAllAnswered,
+	)
+}
+
+func engineerScope(h *harness) error {
+
+	contractor := h.otherChat()
+
+	return steps(
+		func() error { return login(h, phoneAdmin) },
+		func() error {
+			return command(h, "/add_engineer "+phoneContractor+" Подрядчик Павел", "Инженер Подрядчик Павел ("+phoneContractor+") добавлен")
+		},
+		func() error {
+			return command(h, "/set_scope "+phoneContractor+" Юг", "Группа объектов Юг не найдена. Группы: Север")
+		},
+		func() error {
+			return command(h, "/set_scope "+phoneContractor+" 1000-1999", "Инженер Подрядчик Павел ("+phoneContractor+"): объекты все → 1000-1999.")
+		},
+		func() error { return login(contractor, phoneContractor) },
+		func() error { return waitForEngineer(contractor, true) },
+		func() error { _, err := openObject(contractor, objectCustomer); return err },
+		func() error {
+			return pressAndExpect(contractor, "Завершить работу с объектом", "Введите пультовый номер объекта!")
+		},
+		//Объект вне закрепленных за инженером
+		func() error {
+			return command(contractor, objectAlarm, "Объект "+objectAlarm+" не закреплен за вами. Ваши объекты: 1000-1999")
+		},
+		func() error {
+			return h.expectLog("Аудит: чат " + fmt.Sprint(contractor.chatID) + ", " + phoneContractor + " (senior), объект " + objectAlarm + ", OpenObject : denied")
+		},
+		func() error {
+			return command(h, "/set_scope "+phoneContractor+" Север", "объекты 1000-1999 → Север.")
+		},
+		func() error {
+			return command(h, "/engineers", "Подрядчик Павел, "+phoneContractor+"\nРоль: старший инженер, действует\nОбъекты: Север")
+		},
+		func() error { _, err := openObject(contractor, objectAlarm); return err },
+		//Объекты пользователя MyAlarm вне закрепленных за инженером не выводятся
+		func() error {
+			return pressAndExpect(contractor, "Управление доступом в MyAlarm", "Подменю MyAlarm", "Список объектов пользователя MyAlarm")
+		},
+		func() error {
+			return pressAndExpect(contractor, "Список объектов пользователя MyAlarm", "Введите номер телефона пользователя")
+		},
+		func() error {
+			contractor.send(phoneCustomer)
+			msg, err := contractor.expectReply("Объекты, не закрепленные за вами, скрыты: ")
+			if err == nil && strings.Contains(msg.Text, "№ объекта: "+objectCustomer) {
+				err = fmt.Errorf("выведен объект %s, не закрепленный за инженером:\n%s", objectCustomer, msg.Text)
+			}
+			return err
+		},
+		func() error {
+			return h.expectLog("объект " + objectAlarm + ", GetUserObjectMyAlarm " + phoneCustomer + ": denied скрыты объекты, не закрепленные за инженером: ")
+		},
+		func() error { return pressAndExpect(contractor, "Назад", "Подменю MyAlarm") },
+		//Изменение закрепленных объектов применяется к начатой работе с объектом
+		func() error {
+			return command(h, "/set_scope "+phoneContractor+" 1000-1999", "объекты Север → 1000-1999.")
+		},
+		func() error {
+			if err := contractor.press("Список пользователей MyAlarm объекта"); err != nil {
+				return err
+			}
+			_, err := contractor.expectReply("Завершена работа с объектом " + objectAlarm + ": у вас больше нет прав на этот объект")
+			return err
+		},
+		//Объект с тем же номером на другом сервере не закреплен за инженером
+		func() error {
+			return command(h, "/set_scope "+phoneContractor+" 4444@Запад", "Сервер Запад не найден. Серверы: "+serverNorth+", "+serverSouth)
+		},
+		func() error {
+			return command(h, "/set_scope "+phoneContractor+" 4444@север", "объекты 1000-1999 → 4444@"+serverNorth+".")
+		},
+		func() error {
+			contractor.send("4444@" + serverNorth)
+			if _, err := contractor.waitFor("sendMessage", "Работа с объектом 4444 (сервер "+serverNorth+")"); err != nil {
+				return err
+			}
+			_, err := contractor.expectReply("Выберите пункт меню", "Завершить работу с объектом")
+			return err
+		},
+		func() error {
+			return pressAndExpect(contractor, "Завершить работу с объектом", "Введите пультовый номер объекта!")
+		},
+		func() error {
+			return command(contractor, "4444@"+serverSouth, "Объект 4444 не закреплен за вами. Ваши объекты: 4444@"+serverNorth)
+		},
+		func() error {
+			return command(contractor, "/audit 4444", "Журнал аудита объекта 4444 (сервер "+serverNorth+"), последние записи:")
+		},
+		func() error {
+			return command(contractor, "/audit 4444@"+serverSouth, "Объект 4444 не закреплен за вами.")
+		},
+		contractor.expectAllAnswered,
+	)
+}
+
+func temporaryGrant(h *harness) error {
+
+	installer := h.otherChat()
+
+	return steps(
+		func() error { return login(h, phoneEngineer) },
+		func() error { return login(installer, phoneInstaller) },
+		func() error {
+			return command(installer, objectAlarm, "У вас нет прав на этот объект!")
+		},
+		func() error {
+			return command(h, "/grant "+phoneInstaller+" "+objectAlarm, "Неверный формат команды")
+		},
+		func() error {
+			return command(h, "/grant "+phoneInstaller+" "+objectAlarm+" 8d", "Неверный срок доступа")
+		},
+		//Доступ на несколько секунд: предупреждение об окончании приходит сразу, затем доступ заканчивается
+		func() error {
+			return command(h, "/grant "+phoneInstaller+" "+objectAlarm+" 4s", "Пользователю "+phoneInstaller+" выдан временный доступ к объекту "+objectAlarm+" (сервер "+serverNorth+") до ")
+		},
+		func() error {
+			_, err := installer.expectReply("Вам выдан временный доступ к объекту " + objectAlarm + " (сервер " + serverNorth + ") до ")
+			return err
+		},
+		func() error {
+			_, err := installer.expectReply("Временный доступ к объекту " + objectAlarm + " (сервер " + serverNorth + ") закончится ")
+			return err
+		},
+		func() error {
+			installer.send(objectAlarm)
+			return expectMenu(installer, "Выберите пункт меню", []string{"Проверка КТС"}, []string{"Управление доступом в MyAlarm"})
+		},
+		func() error {
+			return command(h, "/grants", phoneInstaller+", объект "+objectAlarm+" (сервер "+serverNorth+")\nДо ")
+		},
+		func() error {
+			_, err := installer.expectReply("Временный доступ к объекту " + objectAlarm + " (сервер " + serverNorth + ") закончился.")
+			return err
+		},
+		func() error {
+			if err := installer.press("Получить список шлейфов"); err != nil {
+				return err
+			}
+			_, err := installer.expectReply("Завершена работа с объектом " + objectAlarm + ": у вас больше нет прав на этот объект")
+			return err
+		},
+		func() error {
+			return command(installer, objectAlarm, "У вас нет прав на этот объект!")
+		},
+		//Отозванный доступ
+		func() error {
+			return command(h, "/grant "+phoneInstaller+" "+objectAlarm+" 1d", "выдан временный доступ к объекту "+objectAlarm)
+		},
+		func() error {
+			_, err := installer.expectReply("Вам выдан временный доступ к объекту " + objectAlarm)
+			return err
+		},
+		func() error { _, err := openObject(installer, objectAlarm); return err },
+		func() error {
+			return command(h, "/revoke "+phoneInstaller+" "+objectAlarm, "Временный доступ "+phoneInstaller+" к объекту "+objectAlarm+" (сервер "+serverNorth+") отозван.")
+		},
+		func() error {
+			_, err := installer.expectReply("Временный доступ к объекту " + objectAlarm + " (сервер " + serverNorth + ") отозван.")
+			return err
+		},
+		func() error {
+			return h.expectLog("объект " + objectAlarm + ", Revoke " + phoneInstaller + ": ok")
+		},
+		func() error {
+			if err := installer.press("Получить список шлейфов"); err != nil {
+				return err
+			}
+			_, err := installer.expectReply("у вас больше нет прав на этот объект")
+			return err
+		},
+		func() error {
+			return command(h, "/grants", "Действующих временных доступов нет.")
+		},
+		//Доступ к объекту одного сервера не дает доступа к объекту с тем же номером на другом сервере
+		func() error {
+			return command(h, "/grant "+phoneInstaller+" 4444@Запад 1h", "Сервер Запад не найден. Серверы: "+serverNorth+", "+serverSouth)
+		},
+		func() error {
+			return command(h, "/grant "+phoneInstaller+" 4444@юг 1h", "выдан временный доступ к объекту 4444 (сервер "+serverSouth+")")
+		},
+		func() error {
+			_, err := installer.expectReply("Вам выдан временный доступ к объекту 4444 (сервер " + serverSouth + ")")
+			return err
+		},
+		func() error {
+			return command(installer, "4444", "У вас нет прав на этот объект!")
+		},
+		func() error {
+			installer.send("4444@" + serverSouth)
+			if _, err := installer.waitFor("sendMessage", "Работа с объектом 4444 (сервер "+serverSouth+")"); err != nil {
+				return err
+			}
+			_, err := installer.expectReply("Выберите пункт меню", "Завершить работу с объектом")
+			return err
+		},
+		func() error {
+			return pressAndExpect(installer, "Завершить работу с объектом", "Введите пультовый номер объекта!")
+		},
+		func() error {
+			return command(h, "/revoke "+phoneInstaller+" 4444@"+serverSouth, "Временный доступ "+phoneInstaller+" к объекту 4444 (сервер "+serverSouth+") отозван.")
+		},
+		installer.expectAllAnswered,
+	)
+}
+
+func auditLog(h *harness) error {
+
+	customer := h.otherChat()
+	admin := customer.otherChat()
+	contractor := admin.otherChat()
+
+	return steps(
+		func() error { return login(customer, phoneCustomer) },
+		func() error { _, err := openObject(customer, objectCustomer); return err },
+		func() error {
+			//Завершается проверка КТС, начатая в предыдущих сценариях
+			h.andromeda.PressPanic(1234)
+			return pressAndExpect(customer, "Проверка КТС", "проверка КТС начата", "Получить результат проверки КТС")
+		},
+		func() error {
+			h.andromeda.PressPanic(1234)
+			return pressAndExpect(customer, "Получить результат проверки КТС", "проверка КТС успешно завершена", "Назад")
+		},
+		func() error {
+			return pressAndExpect(customer, "Завершить работу с объектом", "Введите пультовый номер объекта!")
+		},
+		func() error { return login(h, phoneEngineer) },
+		func() error { return command(h, "/audit", "Неверный формат команды") },
+		func() error { return command(h, "/audit 12ab", "Неверный формат команды") },
+		func() error {
+			return command(h, "/audit "+objectCustomer, "Журнал аудита объекта "+objectCustomer+" (сервер "+serverNorth+"), последние записи:")
+		},
+		func() error {
+			return command(h, "/audit "+objectCustomer, phoneCustomer+" (ответственное лицо), объект "+objectCustomer+"\nChecksKTS: ok, PostCheckPanic: success")
+		},
+		func() error {
+			h.send("/audit " + objectCustomer + " csv")
+			call, err := h.waitFor("sendDocument", "Журнал аудита объекта "+objectCustomer+" (сервер "+serverNorth+"): записей ")
+			if err != nil {
+				return err
+			}
+			for _, want := range []string{"Время,Чат,Телефон,Роль,Объект,Сервер,Действие,Пользователь,Результат,Подробности",
+				"," + phoneCustomer + ",customer," + objectCustomer + "," + serverNorth + ",ResultCheckKTS,,ok,GetCheckPanic: success"} {
+				if !strings.Contains(string(call.Message.Document), want) {
+					return fmt.Errorf("в файле %s нет строки %q:\n%s", call.Message.DocumentName, want, call.Message.Document)
+				}
+			}
+			_, err = h.expectReply("Журнал аудита объекта " + objectCustomer + " (сервер " + serverNorth + ") выгружен")
+			return err
+		},
+		//Инженеру с частью объектов недоступны журналы других объектов
+		func() error { return login(admin, phoneAdmin) },
+		func() error {
+			return command(admin, "/add_engineer "+phoneContractor+" Подрядчик Павел", phoneContractor)
+		},
+		func() error { return command(admin, "/set_scope "+phoneContractor+" 1000-1999", "1000-1999") },
+		func() error { return login(contractor, phoneContractor) },
+		func() error { return waitForEngineer(contractor, true) },
+		func() error {
+			return command(contractor, "/audit "+objectCustomer, "Журнал аудита объекта "+objectCustomer)
+		},
+		func() error {
+			return command(contractor, "/audit "+objectAlarm, "Объект "+objectAlarm+" не закреплен за вами. Ваши объекты: 1000-1999")
+		},
+		func() error {
+			return command(contractor, "/audit csv", "Журнал всех объектов вам недоступен.")
+		},
+		//Записи журнала нельзя изменить или удалить
+		func() error {
+			db, err := openDB(h)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = db.Close() }()
+			if _, err = db.Exec("DELETE FROM audit"); err == nil || !strings.Contains(err.Error(), "записи журнала аудита нельзя удалять") {
+				return fmt.Errorf("удаление записей журнала аудита: %v", err)
+			}
+			if _, err = db.Exec("UPDATE audit SET result = 'ok'"); err == nil || !strings.Contains(err.Error(), "журнал аудита нельзя изменять") {
+				return fmt.Errorf("изменение записей журнала аудита: %v", err)
+			}
+			return nil
+		},
+		customer.expectAllAnswered,
+	)
+}
+
+func foreignContact(h *harness) error {
+	return steps(
+		func() error { return command(h, "/start", "Отправьте ваш номер телефона") },
+		//Пересланный контакт ответственного лица не дает его прав
+		func() error {
+			h.tg.SendContact(h.chatID, h.chatID+1, phoneCustomer)
+			_, err := h.expectReply("Контакт другого пользователя не принимается.", "Отправить номер телефона")
+			return err
+		},
+		func() error {
+			return h.expectLog(fmt.Sprintf("Безопасность: чат %d () отправил чужой контакт %s пользователя %d, контакт отклонен", h.chatID, phoneCustomer, h.chatID+1))
+		},
+		func() error {
+			return command(h, objectCustomer, "Отправьте ваш номер телефона")
+		},
+		func() error {
+			h.contact(phoneStranger)
+			_, err := h.expectReply("Введите пультовый номер объекта!")
+			return err
+		},
+		//Смена номера требует повторной отправки контакта
+		func() error {
+			h.contact(phoneCustomer)
+			_, err := h.expectReply("Номер телефона "+phoneCustomer+" отличается от подтвержденного ранее "+phoneStranger+". Для смены номера подтвердите его еще раз.", "Отправить номер телефона")
+			return err
+		},
+		//Другие сообщения и перезапуск бота не отменяют смену номера: ожидающий подтверждения номер хранится в сессии
+		func() error { return command(h, objectAlarm, "У вас нет прав на этот объект!") },
+		h.restart,
+		func() error {
+			data, err := savedSession(h)
+			if err == nil && !strings.Contains(data, `"pendingPhone":"`+phoneCustomer+`"`) {
+				err = fmt.Errorf("в сохраненной сессии нет номера, ожидающего подтверждения: %s", data)
+			}
+			return err
+		},
+		func() error {
+			h.contact(phoneCustomer)
+			if _, err := h.expectReply("Номер телефона изменен: " + phoneStranger + " → " + phoneCustomer + "."); err != nil {
+				return err
+			}
+			_, err := h.expectReply("Введите пультовый номер объекта!")
+			return err
+		},
+		func() error {
+			return h.expectLog("ChangePhone " + phoneStranger + ": ok " + phoneStranger + " → " + phoneCustomer)
+		},
+		func() error { _, err := openObject(h, objectCustomer); return err },
+		func() error {
+			return pressAndExpect(h, "Завершить работу с объектом", "Введите пультовый номер объекта!")
+		},
+		h.expectAllAnswered,
+	)
+}
+
+func commandPages(h *harness) error {
+
+	var menu, engineers faketelegram.Message
+	addEngineers := make([]func() error, 0, 30)
+	for i := range 30 {
+		//Фамилии на "Я" выводятся в конце списка инженеров
+		phone := fmt.Sprintf("+7900600%04d", i)
+		addEngineers = append(addEngineers, func() error {
+			return command(h, fmt.Sprintf("/add_engineer %s Яковлев Инженер%02d", phone, i), "добавлен")
+		})
+	}
+	addGrants := make([]func() error, 0, 55)
+	for i := range 55 {
+		phone := fmt.Sprintf("+7900610%04d", i)
+		addGrants = append(addGrants, func() error {
+			return command(h, "/grant "+phone+" "+objectCustomer+" 1h", "выдан временный доступ")
+		})
+	}
+
+	return steps(
+		func() error { return login(h, phoneAdmin) },
+		func() error {
+			var err error
+			menu, err = openObject(h, objectCustomer)
+			return err
+		},
+		func() error { return steps(addEngineers...) },
+		func() error {
+			h.send("/engineers")
+			var err error
+			engineers, err = h.expectReply("Страница 1 из 2\n\nИнженеры:", "▶")
+			return err
+		},
+		func() error { return pressAndExpect(h, "▶", "Яковлев Инженер29", "◀") },
+		func() error { return pressAndExpect(h, "◀", "Страница 1 из 2", "▶") },
+		func() error { return steps(addGrants...) },
+		func() error {
+			h.send("/grants")
+			_, err := h.expectReply("Страница 1 из 2\n\nВременные доступы:\n\n+79006100000", "▶")
+			return err
+		},
+		func() error { return pressAndExpect(h, "▶", "+79006100054, объект "+objectCustomer, "◀") },
+		//Листать можно только последний выведенный список
+		func() error { return h.expectNoKeyboard(engineers) },
+		//Служебная команда не прерывает работу с объектом
+		func() error {
+			if err := h.tg.PressButtonIn(menu, "Завершить работу с объектом"); err != nil {
+				return err
+			}
+			_, err := h.expectReply("Введите пультовый номер объекта!")
+			return err
+		},
+		func() error {
+			return pressAndExpect(h, "◀", "Кнопка относится к завершенной сессии")
+		},
+		h.expectAllAnswered,
+	)
+}
+
+// openDB открывает БД бота
+func openDB(h *harness) (*sql.DB, error) {
+	return sql.Open("sqlite", filepath.Join(h.dir, "bot.db")+"?_pragma=busy_timeout(5000)")
+}
+
+// savedSession возвращает данные сессии чата, сохраненные в БД бота
+func savedSession(h *harness) (string, error) {
+
+	db, err := openDB(h)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = db.Close() }()
+
+	var data string
+	err = db.QueryRow("SELECT data FROM sessions WHERE chatId = ?", h.chatID).Scan(&data)
+	return data, err
+}
+
+func sessionRestored(h *harness) error {
+
+	return steps(
+		func() error { return login(h, phoneEngineer) },
+		func() error { _, err := openObject(h, objectCustomer); return err },
+		func() error {
+			return pressAndExpect(h, "Получить список разделов", "Номер раздела", "Назад")
+		},
+		h.restart,
+		func() error {
+			_, err := h.waitFor("sendMessage", "Бот перезапускается")
+			return err
+		},
+		func() error {
+			data, err := savedSession(h)
+			if err != nil {
+				return err
+			}
+			for _, field := range []string{`"numberObject":"` + objectCustomer + `"`, `"state":"showingResult"`, `"pages":[`} {
+				if !strings.Contains(data, field) {
+					return fmt.Errorf("в сохраненной сессии нет %s: %s", field, data)
+				}
+			}
+			return nil
+		},
+		//Работа с объектом продолжается с того же шага
+		func() error {
+			return pressAndExpect(h, "Назад", "Выберите пункт меню", "Получить список шлейфов")
+		},
+		func() error {
+			return pressAndExpect(h, "Получить список шлейфов", "Номер шлейфа", "Назад")
+		},
+		//Данные объекта не удалось обновить после перезапуска: прав по устаревшим данным нет
+		h.restart,
+		func() error {
+			h.andromeda.Fail("/Sites", http.StatusServiceUnavailable)
+			if err := h.press("Назад"); err != nil {
+				return err
+			}
+			_, err := h.expectReply("Завершена работа с объектом " + objectCustomer + ": не удалось обновить данные объекта после перезапуска бота")
+			return err
+		},
+		func() error {
+			h.andromeda.Fail("/Sites", 0)
+			if _, err := h.waitFor("unpinAllChatMessages", ""); err != nil {
+				return err
+			}
+			return h.expectNoPinned()
+		},
+		func() error {
+			//Сессия сохраняется после ответа пользователю
+			deadline := time.Now().Add(h.timeout)
+			for {
+				data, err := savedSession(h)
+				if err != nil || strings.Contains(data, `"numberObject":""`) {
+					return err
+				}
+				if time.Now().After(deadline) {
+					return fmt.Errorf("сессия не завершена: %s", data)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		},
+		h.expectAllAnswered,
+	)
+}
+
+func sessionExpired(h *harness) error {
+
+	var menu faketelegram.Message
+
+	return steps(
+		func() error { return login(h, phoneCustomer) },
+		func() error {
+			var err error
+			menu, err = openObject(h, objectCustomer)
+			return err
+		},
+		//Последнее действие пользователя переносится на час назад, пока бот остановлен:
+		//время бездействия задается в минутах, а проверка выполняется каждую секунду
+		func() error { return stopBot(h.bot.cmd, h.tg, h.timeout) },
+		func() error {
+			db, err := openDB(h)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = db.Close() }()
+			_, err = db.Exec("UPDATE sessions SET updatedAt = updatedAt - 3600 WHERE chatId = ?", h.chatID)
+			return err
+		},
+		h.start,
+		func() error {
+			_, err := h.expectReply("Работа с объектом " + objectCustomer + " завершена из-за отсутствия активности.\nВведите пультовый номер объекта!")
+			return err
+		},
+		func() error {
+			if _, err := h.waitFor("unpinAllChatMessages", ""); err != nil {
+				return err
+			}
+			return h.expectNoPinned()
+		},
+		func() error { return h.expectNoKeyboard(menu) },
+		func() error { return command(h, objectAlarm, "У вас нет прав на этот объект!") },
+	)
+}
+
+func longZoneList(h *harness) error {
+
+	number := strconv.Itoa(objectLongList)
+
+	return steps(
+		func() error { return login(h, phoneEngineer) },
+		func() error { _, err := openObject(h, number); return err },
+		func() error {
+			return pressAndExpect(h, "Получить список шлейфов", "Страница 1 из 3\n\nНомер шлейфа: 1\n", "▶", "Назад")
+		},
+		func() error {
+			return pressAndExpect(h, "▶", "Страница 2 из 3\n\nНомер шлейфа: ", "◀", "▶", "Назад")
+		},
+		func() error {
+			return pressAndExpect(h, "▶", fmt.Sprintf("Номер шлейфа: %d\nОписание шлейфа: Извещатель %d,", longListZones, longListZones), "◀", "Назад")
+		},
+		func() error {
+			if err := h.press("◀"); err != nil {
+				return err
+			}
+			msg, err := h.expectReply("Страница 2 из 3", "◀", "▶")
+			if err != nil {
+				return err
+			}
+			if length := len([]rune(msg.Text)); length > 4096 {
+				return fmt.Errorf("страница списка длиннее сообщения Telegram: %d символов", length)
+			}
+			return nil
+		},
+		func() error { return pressAndExpect(h, "◀", "Страница 1 из 3", "▶") },
+		func() error {
+			return pressAndExpect(h, "Назад", "Выберите пункт меню", "Получить список шлейфов")
+		},
+		func() error {
+			return pressAndExpect(h, "Завершить работу с объектом", "Введите пультовый номер объекта!")
+		},
+		h.expectAllAnswered,
+	)
+}
+
+func restartDialog(h *harness) error {
+
+	var menu faketelegram.Message
+
+	return steps(
+		func() error { return login(h, phoneEngineer) },
+		func() (err error) { menu, err = openObject(h, objectCustomer); return err },
+		func() error {
+			h.send("/start")
+			if _, err := h.waitFor("sendMessage", "Завершена работа с объектом "+objectCustomer); err != nil {
+				return err
+			}
+			if _, err := h.waitFor("unpinAllChatMessages", ""); err != nil {
+				return err
+			}
+			_, err := h.expectReply("Введите пультовый номер объекта!")
+			return err
+		},
+		h.expectNoPinned,
+		func() error { return h.expectNoKeyboard(menu) },
+		func() error {
+			if err := h.tg.PressButtonIn(menu, "Проверка КТС"); err != nil {
+				return err
+			}
+			_, err := h.expectReply("Кнопка относится к завершенной сессии")
+			return err
+		},
+		func() error { _, err := openObject(h, objectCustomer); return err },
+		h.expectAllAnswered,
+	)
+}
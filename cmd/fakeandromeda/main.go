@@ -0,0 +1,45 @@
+// Команда fakeandromeda запускает имитатор API ПО "Центр охраны".
+// Для работы бота без реального сервера укажите в config.json "host": "http://127.0.0.1:8090"
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"tg-bot-security-center-v2/fakeandromeda"
+)
+
+func main() {
+
+	addr := flag.String("addr", "127.0.0.1:8090", "адрес, на котором принимаются запросы")
+	fixturesPath := flag.String("fixtures", "", "JSON файл с данными, по умолчанию встроенный набор")
+	apiKey := flag.String("apikey", "", "API ключ, который должны передавать запросы, по умолчанию не проверяется")
+	delay := flag.Duration("panic-delay", 0, "время до завершения проверки КТС, по умолчанию из данных")
+	result := flag.String("panic-result", "", "результат проверки КТС: success или \"time out\", по умолчанию из данных")
+	flag.Parse()
+
+	fixtures := fakeandromeda.DefaultFixtures()
+	if *fixturesPath != "" {
+		var err error
+		fixtures, err = fakeandromeda.LoadFixtures(*fixturesPath)
+		if err != nil {
+			log.Fatalf("Не удалось загрузить данные: %v", err)
+		}
+	}
+
+	server := fakeandromeda.New(fixtures, *apiKey)
+	if *delay != 0 || *result != "" {
+		if *delay == 0 {
+			*delay = time.Duration(fixtures.CheckPanic.Delay)
+		}
+		if *result == "" {
+			*result = fixtures.CheckPanic.Result
+		}
+		server.SetCheckPanic(*delay, *result)
+	}
+
+	log.Printf("Имитатор API ПО \"Центр охраны\" запущен на http://%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
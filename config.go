@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultConfigPath             = "config.json" //Файл настроек по умолчанию
+	defaultDBPath                 = "users.db"    //Файл БД пользователей и сессий по умолчанию
+	defaultSessionTimeoutEngineer = 120           //Время бездействия инженера по умолчанию, мин.
+	defaultSessionTimeoutCustomer = 30            //Время бездействия ответственного лица по умолчанию, мин.
+	defaultSessionCheckInterval   = 60            //Интервал проверки бездействия пользователей по умолчанию, сек.
+)
+
+// config настройки бота
+type config struct {
+	TelegramBotToken       string                    `json:"telegram_bot_token"`       //API токен бота
+	ApiKey                 string                    `json:"api_key"`                  //API ключ ПО "Центр охраны"
+	Host                   string                    `json:"host"`                     //IP адрес сервера ПО "Центр охраны", если не задан список servers
+	Servers                []serverConfig            `json:"servers"`                  //Серверы ПО "Центр охраны" с диапазонами номеров объектов, вместо host и api_key
+	PhoneEngineer          map[string]string         `json:"phone_engineer"`           //Телефоны и имена инженеров ПО "Центр охраны", которые добавляются в список инженеров в БД
+	SuperAdmins            []string                  `json:"super_admins"`             //Телефоны супер-администраторов, которые ведут список инженеров командами бота
+	SessionTimeoutEngineer int                       `json:"session_timeout_engineer"` //Время бездействия инженера до завершения работы с объектом, мин.
+	SessionTimeoutCustomer int                       `json:"session_timeout_customer"` //Время бездействия ответственного лица до завершения работы с объектом, мин.
+	SessionCheckInterval   int                       `json:"session_check_interval"`   //Интервал проверки бездействия пользователей, сек.
+	CallbackSecret         string                    `json:"callback_secret"`          //Ключ подписи данных кнопок, по умолчанию вычисляется из токена бота
+	UpdateMode             string                    `json:"update_mode"`              //Способ получения обновлений: "polling" (по умолчанию) или "webhook"
+	Webhook                webhookConfig             `json:"webhook"`                  //Настройки вебхука для режима "webhook"
+	ShutdownTimeout        int                       `json:"shutdown_timeout"`         //Время ожидания обработки принятых обновлений при остановке бота, сек.
+	NotifyRestart          bool                      `json:"notify_restart"`           //Предупреждать инженеров, работающих с объектом, о перезапуске бота
+	TelegramAPIEndpoint    string                    `json:"telegram_api_endpoint"`    //Адрес Bot API в формате "https://api.telegram.org/bot%s/%s", для локального сервера Bot API или имитатора
+	Resilience             resilienceConfig          `json:"resilience"`               //Повторы запросов к ПО "Центр охраны" и прекращение запросов к недоступному серверу
+	RequestTimeouts        map[string]int            `json:"request_timeouts"`         //Время ожидания ответа ПО "Центр охраны" по методам API, сек. Ключ "default" - для остальных методов
+	UpdateTimeout          int                       `json:"update_timeout"`           //Время обработки одного обновления, включая все запросы к ПО "Центр охраны", сек.
+	DBPath                 string                    `json:"db_path"`                  //Файл БД пользователей и сессий, по умолчанию "users.db"
+	ReloadInterval         int                       `json:"reload_interval"`          //Интервал проверки изменения файла настроек, сек. Настройки также перечитываются по сигналу SIGHUP
+	Roles                  map[string][]string       `json:"roles"`                    //Пункты меню объекта, доступные ролям. Заменяют права ролей по умолчанию и добавляют роли инженеров
+	GrantNotice            int                       `json:"grant_notice"`             //За сколько минут до окончания временного доступа предупреждать пользователя
+	ObjectGroups           map[string][]accountRange `json:"object_groups"`            //Группы объектов по диапазонам пультовых номеров, закрепляются за инженерами командой /set_scope
+}
+
+// phoneFormat формат телефона инженера в настройках
+var phoneFormat = regexp.MustCompile(`^\+7\d{10}$`)
+
+// envOverrides переменные окружения, значения которых заменяют настройки из файла.
+// Так секреты можно не хранить в файле настроек
+var envOverrides = []struct {
+	name  string
+	apply func(configuration *config, value string)
+}{
+	{"TELEGRAM_BOT_TOKEN", func(c *config, v string) { c.TelegramBotToken = v }},
+	{"API_KEY", func(c *config, v string) { c.ApiKey = v }},
+	{"CALLBACK_SECRET", func(c *config, v string) { c.CallbackSecret = v }},
+	{"WEBHOOK_SECRET_TOKEN", func(c *config, v string) { c.Webhook.SecretToken = v }},
+	{"DB_PATH", func(c *config, v string) { c.DBPath = v }},
+}
+
+// configFlags разбирает параметры командной строки и возвращает путь к файлу настроек.
+// Команда (migrate) и ее параметры остаются в flag.Args()
+func configFlags() string {
+	path := flag.String("config", defaultConfigPath, "файл настроек в формате JSON или YAML (.yaml, .yml)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Использование: %s [-config файл] [migrate [-dry-run] [-db файл]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	return *path
+}
+
+// readConfig читает настройки из файла path, заменяет их значениями переменных окружения,
+// заполняет незаданные значениями по умолчанию и проверяет. Ошибка содержит все найденные проблемы
+func readConfig(path string) (config, error) {
+
+	configuration := config{}
+	if err := decodeConfig(path, &configuration); err != nil {
+		return config{}, errors.Wrapf(err, "не удалось прочитать настройки из %s", path)
+	}
+	log.Printf("Настройки прочитаны из %s", path)
+
+	var overridden []string
+	for _, env := range envOverrides {
+		if value, ok := os.LookupEnv(env.name); ok && value != "" {
+			env.apply(&configuration, value)
+			overridden = append(overridden, env.name)
+		}
+	}
+	if len(overridden) > 0 {
+		log.Printf("Настройки из переменных окружения: %s", strings.Join(overridden, ", "))
+	}
+
+	configuration.setDefaults()
+
+	if problems := configuration.validate(); len(problems) > 0 {
+		return config{}, errors.Errorf("ошибки в настройках %s:\n  - %s", path, strings.Join(problems, "\n  - "))
+	}
+	return configuration, nil
+}
+
+// decodeConfig читает файл настроек. Формат определяется по расширению файла
+func decodeConfig(path string, configuration *config) error {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		//Настройки в YAML используют те же названия полей, что и в JSON
+		var document yaml.Node
+		if err = yaml.Unmarshal(data, &document); err != nil {
+			return err
+		}
+		value, err := yamlValue(&document)
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(value); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, configuration)
+}
+
+// yamlValue преобразует документ YAML в значения, которые можно записать в JSON.
+// Ключи берутся как есть: телефон +79990000000 остается строкой, а не становится числом
+func yamlValue(node *yaml.Node) (any, error) {
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return yamlValue(node.Content[0])
+	case yaml.AliasNode:
+		return yamlValue(node.Alias)
+	case yaml.MappingNode:
+		value := make(map[string]any, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			item, err := yamlValue(node.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			value[node.Content[i].Value] = item
+		}
+		return value, nil
+	case yaml.SequenceNode:
+		value := make([]any, 0, len(node.Content))
+		for _, itemNode := range node.Content {
+			item, err := yamlValue(itemNode)
+			if err != nil {
+				return nil, err
+			}
+			value = append(value, item)
+		}
+		return value, nil
+	}
+
+	var value any
+	if err := node.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// setDefaults заполняет незаданные настройки значениями по умолчанию
+func (c *config) setDefaults() {
+
+	if c.SessionTimeoutEngineer <= 0 {
+		c.SessionTimeoutEngineer = defaultSessionTimeoutEngineer
+	}
+	if c.SessionTimeoutCustomer <= 0 {
+		c.SessionTimeoutCustomer = defaultSessionTimeoutCustomer
+	}
+	if c.SessionCheckInterval <= 0 {
+		c.SessionCheckInterval = defaultSessionCheckInterval
+	}
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if c.DBPath == "" {
+		c.DBPath = defaultDBPath
+	}
+	if c.GrantNotice <= 0 {
+		c.GrantNotice = defaultGrantNotice
+	}
+	if c.ReloadInterval <= 0 {
+		c.ReloadInterval = defaultReloadInterval
+	}
+	if c.TelegramAPIEndpoint == "" {
+		c.TelegramAPIEndpoint = tgbotapi.APIEndpoint
+	}
+
+	//Один сервер, заданный по-старому
+	if len(c.Servers) == 0 && c.Host != "" {
+		c.Servers = []serverConfig{{
+			Name: defaultServerName,
+			Host: c.Host,
+		}}
+	}
+	//API ключ api_key (или переменная API_KEY) используется для серверов, у которых свой ключ не задан
+	for i := range c.Servers {
+		if c.Servers[i].ApiKey == "" {
+			c.Servers[i].ApiKey = c.ApiKey
+		}
+	}
+
+	c.Resilience.setDefaults()
+	if c.UpdateTimeout <= 0 {
+		c.UpdateTimeout = defaultUpdateTimeout
+	}
+
+	roles := maps.Clone(defaultRoles)
+	maps.Copy(roles, c.Roles)
+	c.Roles = roles
+
+	requestTimeouts := maps.Clone(defaultRequestTimeouts)
+	maps.Copy(requestTimeouts, c.RequestTimeouts)
+	c.RequestTimeouts = requestTimeouts
+
+	if c.UpdateMode == "" {
+		c.UpdateMode = updateModePolling
+	}
+}
+
+// validate проверяет настройки и возвращает описания всех найденных ошибок
+func (c *config) validate() []string {
+
+	var problems []string
+
+	if c.TelegramBotToken == "" {
+		problems = append(problems, "не задан токен бота: telegram_bot_token или переменная окружения TELEGRAM_BOT_TOKEN")
+	}
+
+	problems = append(problems, checkServers(c.Servers)...)
+
+	for _, phone := range slices.Sorted(maps.Keys(c.PhoneEngineer)) {
+		if !phoneFormat.MatchString(phone) {
+			problems = append(problems, fmt.Sprintf("телефон инженера %q (%s) должен быть в формате +7XXXXXXXXXX", phone, c.PhoneEngineer[phone]))
+		}
+	}
+
+	for _, phone := range c.SuperAdmins {
+		if !phoneFormat.MatchString(phone) {
+			problems = append(problems, fmt.Sprintf("телефон супер-администратора %q должен быть в формате +7XXXXXXXXXX", phone))
+		}
+	}
+
+	problems = append(problems, checkRoles(c.Roles)...)
+	problems = append(problems, checkObjectGroups(c.ObjectGroups)...)
+
+	for _, method := range slices.Sorted(maps.Keys(c.RequestTimeouts)) {
+		if method != defaultRequestTimeout && !slices.Contains(andromedaMethods, method) {
+			problems = append(problems, fmt.Sprintf("неизвестный метод API ПО \"Центр охраны\" %q в request_timeouts", method))
+		} else if c.RequestTimeouts[method] <= 0 {
+			problems = append(problems, fmt.Sprintf("время ожидания метода %q должно быть больше нуля", method))
+		}
+	}
+
+	switch c.UpdateMode {
+	case updateModePolling:
+	case updateModeWebhook:
+		problems = append(problems, checkWebhook(c.Webhook)...)
+	default:
+		problems = append(problems, fmt.Sprintf("неизвестный способ получения обновлений %q, допустимо %q или %q", c.UpdateMode, updateModePolling, updateModeWebhook))
+	}
+
+	return problems
+}
+
+// checkHost проверяет адрес сервера ПО "Центр охраны": "http://192.168.0.10:9002"
+func checkHost(host string) error {
+	hostURL, err := url.Parse(host)
+	if err != nil || hostURL.Host == "" || (hostURL.Scheme != "http" && hostURL.Scheme != "https") {
+		return errors.Errorf("неверный адрес %q, ожидается адрес вида http://192.168.0.10:9002", host)
+	}
+	return nil
+}
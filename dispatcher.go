@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	dispatcherWorkerIdle = 5 * time.Minute //Время простоя, после которого обработчик чата завершается
+	dispatcherQueueSize  = 16              //Количество заданий, ожидающих в очереди одного чата
+)
+
+var (
+	errDispatcherStopped = errors.New("бот завершает работу")
+	errChatBusy          = errors.New("очередь обновлений чата заполнена")
+)
+
+type (
+	// dispatcher распределяет обработку обновлений по чатам: у каждого чата свой обработчик,
+	// поэтому обновления разных чатов обрабатываются параллельно, а обновления одного чата — строго по очереди
+	dispatcher struct {
+		mu      sync.Mutex
+		workers map[int64]*chatWorker
+		closed  bool
+		quit    chan struct{}
+		wg      sync.WaitGroup
+	}
+
+	// chatWorker очередь заданий одного чата
+	chatWorker struct {
+		jobs    chan func()
+		pending int //Количество переданных в очередь, но еще не полученных обработчиком заданий
+	}
+)
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{
+		workers: make(map[int64]*chatWorker),
+		quit:    make(chan struct{}),
+	}
+}
+
+// Dispatch ставит задание в очередь чата, при необходимости запуская обработчик чата.
+// Диспетчер вызывается из основного цикла бота и не ждет: если очередь чата заполнена, например обработчик
+// ждет ответа ПО "Центр охраны", задание не принимается и возвращается errChatBusy.
+// Если диспетчер уже остановлен, возвращается errDispatcherStopped
+func (d *dispatcher) Dispatch(chatID int64, job func()) error {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return errDispatcherStopped
+	}
+
+	worker, ok := d.workers[chatID]
+	if !ok {
+		worker = &chatWorker{jobs: make(chan func(), dispatcherQueueSize)}
+		d.workers[chatID] = worker
+		d.wg.Add(1)
+		go d.work(chatID, worker)
+	}
+
+	select {
+	case worker.jobs <- job:
+		worker.pending++
+		return nil
+	default:
+		return errChatBusy
+	}
+}
+
+// Stop перестает принимать новые задания и ждет выполнения всех уже поставленных в очереди
+func (d *dispatcher) Stop() {
+
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.quit)
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+// work выполняет задания чата по очереди. Обработчик завершается после простоя
+// или после остановки диспетчера, когда очередь чата опустеет
+func (d *dispatcher) work(chatID int64, worker *chatWorker) {
+
+	defer d.wg.Done()
+
+	idle := time.NewTimer(dispatcherWorkerIdle)
+	defer idle.Stop()
+
+	for {
+		select {
+		case job := <-worker.jobs:
+			d.mu.Lock()
+			worker.pending--
+			d.mu.Unlock()
+
+			job()
+			idle.Reset(dispatcherWorkerIdle)
+		case <-idle.C:
+			if d.release(chatID, worker) {
+				return
+			}
+			idle.Reset(dispatcherWorkerIdle)
+		case <-d.quit:
+			for !d.release(chatID, worker) {
+				job := <-worker.jobs
+				d.mu.Lock()
+				worker.pending--
+				d.mu.Unlock()
+
+				job()
+			}
+			return
+		}
+	}
+}
+
+// release удаляет обработчик чата, если в его очереди не осталось заданий
+func (d *dispatcher) release(chatID int64, worker *chatWorker) bool {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if worker.pending > 0 {
+		return false
+	}
+	delete(d.workers, chatID)
+	return true
+}
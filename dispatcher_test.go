@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDispatcherChatBusy(t *testing.T) {
+
+	d := newDispatcher()
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	//Обработчик чата занят первым заданием, остальные ждут в очереди
+	if err := d.Dispatch(1, func() { close(started); <-release }); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	var mu sync.Mutex
+	var done []int
+	for i := range dispatcherQueueSize {
+		if err := d.Dispatch(1, func() { mu.Lock(); done = append(done, i); mu.Unlock() }); err != nil {
+			t.Fatalf("задание %d: %v", i, err)
+		}
+	}
+	if err := d.Dispatch(1, func() {}); !errors.Is(err, errChatBusy) {
+		t.Fatalf("заполненная очередь: ошибка %v, ожидалась %v", err, errChatBusy)
+	}
+
+	//Очередь одного чата не задерживает другие чаты
+	other := make(chan struct{})
+	if err := d.Dispatch(2, func() { close(other) }); err != nil {
+		t.Fatal(err)
+	}
+	<-other
+
+	close(release)
+	d.Stop()
+
+	if len(done) != dispatcherQueueSize {
+		t.Fatalf("выполнено %d заданий, ожидалось %d", len(done), dispatcherQueueSize)
+	}
+	for i, job := range done {
+		if job != i {
+			t.Fatalf("задания выполнены не по порядку: %v", done)
+		}
+	}
+	if err := d.Dispatch(1, func() {}); !errors.Is(err, errDispatcherStopped) {
+		t.Errorf("остановленный диспетчер: ошибка %v, ожидалась %v", err, errDispatcherStopped)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const changedByConfig = "config" //Изменение внесено из настроек бота
+
+type (
+	// engineer инженер ПО "Центр охраны"
+	engineer struct {
+		phone     string
+		name      string
+		role      string    //Роль инженера из настроек roles
+		scope     []string  //Объекты, закрепленные за инженером: диапазоны номеров, номера и группы объектов. Пустой - все объекты
+		active    bool      //Отключенный инженер не имеет прав инженера, запись о нем сохраняется
+		changedBy string    //Телефон супер-администратора, внесшего последнее изменение, или "config"
+		changedAt time.Time //Время последнего изменения
+	}
+
+	EngineersStore struct {
+		db *sql.DB
+	}
+
+	// engineersRegistry список инженеров, хранящийся в БД, с копией в памяти.
+	// Безопасен для использования из нескольких горутин
+	engineersRegistry struct {
+		store EngineersStore
+		mu    sync.RWMutex
+		items map[string]engineer
+	}
+)
+
+func NewEngineersStore(db *sql.DB) EngineersStore {
+	return EngineersStore{db: db}
+}
+
+// All возвращает всех инженеров, включая отключенных
+func (s EngineersStore) All() ([]engineer, error) {
+
+	rows, err := s.db.Query("SELECT phone, name, role, scope, active, changedBy, changedAt FROM engineers")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var engineers []engineer
+	for rows.Next() {
+		var e engineer
+		var scope string
+		var changedAt int64
+		if err = rows.Scan(&e.phone, &e.name, &e.role, &scope, &e.active, &e.changedBy, &changedAt); err != nil {
+			return nil, err
+		}
+		if scope != "" {
+			e.scope = strings.Split(scope, ",")
+		}
+		e.changedAt = time.Unix(changedAt, 0)
+		engineers = append(engineers, e)
+	}
+	return engineers, rows.Err()
+}
+
+// Save сохраняет инженера и запись об изменении details в истории изменений
+func (s EngineersStore) Save(e engineer, details string) error {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.Exec("INSERT INTO engineers (phone, name, role, scope, active, changedBy, changedAt) "+
+		"VALUES (:phone, :name, :role, :scope, :active, :changedBy, :changedAt) "+
+		"ON CONFLICT(phone) DO UPDATE SET name = excluded.name, role = excluded.role, scope = excluded.scope, "+
+		"active = excluded.active, changedBy = excluded.changedBy, changedAt = excluded.changedAt",
+		sql.Named("phone", e.phone),
+		sql.Named("name", e.name),
+		sql.Named("role", e.role),
+		sql.Named("scope", strings.Join(e.scope, ",")),
+		sql.Named("active", e.active),
+		sql.Named("changedBy", e.changedBy),
+		sql.Named("changedAt", e.changedAt.Unix()))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO engineer_changes (phone, details, changedBy, changedAt) VALUES (:phone, :details, :changedBy, :changedAt)",
+		sql.Named("phone", e.phone),
+		sql.Named("details", details),
+		sql.Named("changedBy", e.changedBy),
+		sql.Named("changedAt", e.changedAt.Unix()))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// newEngineersRegistry читает список инженеров из БД
+func newEngineersRegistry(store EngineersStore) (*engineersRegistry, error) {
+
+	engineers, err := store.All()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &engineersRegistry{store: store, items: make(map[string]engineer)}
+	for _, e := range engineers {
+		r.items[e.phone] = e
+	}
+	return r, nil
+}
+
+// Get возвращает инженера по телефону
+func (r *engineersRegistry) Get(phone string) (engineer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.items[phone]
+	return e, ok
+}
+
+// isActive проверяет, что телефон принадлежит действующему инженеру
+func (r *engineersRegistry) isActive(phone string) bool {
+	e, ok := r.Get(phone)
+	return ok && e.active
+}
+
+// isAdmin проверяет, что телефон принадлежит действующему супер-администратору
+func (r *engineersRegistry) isAdmin(phone string) bool {
+	e, ok := r.Get(phone)
+	return ok && e.active && e.role == roleAdmin
+}
+
+// List возвращает всех инженеров по алфавиту
+func (r *engineersRegistry) List() []engineer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.SortedFunc(maps.Values(r.items), func(a, b engineer) int {
+		return strings.Compare(a.name, b.name)
+	})
+}
+
+// save сохраняет изменение инженера в БД и в памяти
+func (r *engineersRegistry) save(e engineer, details string) error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e.changedAt = time.Now()
+	if err := r.store.Save(e, details); err != nil {
+		return err
+	}
+	r.items[e.phone] = e
+
+	log.Printf("Инженер %s (%s): %s, изменил %s", e.phone, e.name, details, e.changedBy)
+	return nil
+}
+
+// seed добавляет в список инженеров из настроек бота, которых в нем еще нет, и назначает супер-администраторов.
+// Инженеры, удаленные из настроек, остаются в списке: их отключает супер-администратор
+func (r *engineersRegistry) seed(configuration config) {
+
+	for _, phone := range slices.Sorted(maps.Keys(configuration.PhoneEngineer)) {
+		if _, ok := r.Get(phone); ok {
+			continue
+		}
+		role := roleSenior
+		if slices.Contains(configuration.SuperAdmins, phone) {
+			role = roleAdmin
+		}
+		e := engineer{phone: phone, name: configuration.PhoneEngineer[phone], role: role, active: true, changedBy: changedByConfig}
+		if err := r.save(e, "добавлен из настроек, роль "+roleName(role)); err != nil {
+			log.Printf("Не удалось добавить инженера %s из настроек: %v", phone, err)
+		}
+	}
+
+	//Супер-администраторы из настроек не могут быть отключены командами бота,
+	//иначе управлять списком инженеров будет некому
+	for _, phone := range configuration.SuperAdmins {
+		e, ok := r.Get(phone)
+		if ok && e.active && e.role == roleAdmin {
+			continue
+		}
+		if !ok {
+			e = engineer{phone: phone, name: configuration.PhoneEngineer[phone]}
+			if e.name == "" {
+				e.name = phone
+			}
+		}
+		e.role, e.active, e.changedBy = roleAdmin, true, changedByConfig
+		if err := r.save(e, "назначен супер-администратором из настроек"); err != nil {
+			log.Printf("Не удалось назначить супер-администратора %s из настроек: %v", phone, err)
+		}
+	}
+}
+
+// describe возвращает описание инженера для списка /engineers
+func (r *engineersRegistry) describe(e engineer) string {
+
+	state := "действует"
+	if !e.active {
+		state = "отключен"
+	}
+
+	changedBy := "из настроек"
+	if e.changedBy != changedByConfig {
+		changedBy = e.changedBy
+		if admin, ok := r.Get(e.changedBy); ok {
+			changedBy = fmt.Sprintf("%s (%s)", admin.name, admin.phone)
+		}
+	}
+	scope := objectScope{items: e.scope}
+	return fmt.Sprintf("%s, %s\nРоль: %s, %s\nОбъекты: %s\nИзменен: %s, %s", e.name, e.phone, roleName(e.role), state, scope, e.changedAt.Format("02/01/2006 15:04"), changedBy)
+}
+
+// engineersCommand выводит список инженеров по команде /engineers
+func (a *app) engineersCommand(chatID int64, operation *operation, _, _ string) tgbotapi.MessageConfig {
+
+	engineers := a.engineers.List()
+	if len(engineers) == 0 {
+		return tgbotapi.NewMessage(chatID, "Список инженеров пуст.")
+	}
+
+	items := make([]string, 0, len(engineers))
+	for _, e := range engineers {
+		items = append(items, a.engineers.describe(e))
+	}
+	return commandListMessage(chatID, operation, "Инженеры:", items)
+}
+
+// addEngineerCommand добавляет инженера или снова включает отключенного по команде /add_engineer +7XXXXXXXXXX Фамилия Имя
+func (a *app) addEngineerCommand(chatID int64, _ *operation, phone, args string) tgbotapi.MessageConfig {
+
+	engineerPhone, name, _ := strings.Cut(strings.TrimSpace(args), " ")
+	engineerPhone, err := checkFormatPhone(engineerPhone)
+	if err != nil || !phoneFormat.MatchString(engineerPhone) {
+		return tgbotapi.NewMessage(chatID, "Неверный формат команды.\nВведите: /add_engineer +7xxxxxxxxxx Фамилия Имя")
+	}
+	name = strings.TrimSpace(name)
+
+	e, exists := a.engineers.Get(engineerPhone)
+	var details string
+	switch {
+	case !exists && name == "":
+		return tgbotapi.NewMessage(chatID, "Укажите имя инженера.\nВведите: /add_engineer +7xxxxxxxxxx Фамилия Имя")
+	case !exists:
+		e = engineer{phone: engineerPhone, name: name, role: roleSenior, active: true}
+		details = "добавлен, роль " + roleName(roleSenior)
+	case e.active && (name == "" || name == e.name):
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("Инженер %s (%s) уже есть в списке.", e.name, e.phone))
+	default:
+		if !e.active {
+			details = "снова включен"
+		}
+		if name != "" && name != e.name {
+			details = strings.TrimPrefix(details+", имя "+e.name+" → "+name, ", ")
+			e.name = name
+		}
+		e.active = true
+	}
+	e.changedBy = phone
+
+	if err = a.engineers.save(e, details); err != nil {
+		log.Printf("Не удалось сохранить инженера %s: %v", e.phone, err)
+		return tgbotapi.NewMessage(chatID, "Не удалось сохранить изменения, попробуйте позже.")
+	}
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("Инженер %s (%s) %s.", e.name, e.phone, details))
+}
+
+// disableEngineerCommand отключает инженера по команде /disable_engineer +7XXXXXXXXXX
+func (a *app) disableEngineerCommand(chatID int64, _ *operation, phone, args string) tgbotapi.MessageConfig {
+
+	engineerPhone, err := checkFormatPhone(strings.TrimSpace(args))
+	if err != nil || !phoneFormat.MatchString(engineerPhone) {
+		return tgbotapi.NewMessage(chatID, "Неверный формат команды.\nВведите: /disable_engineer +7xxxxxxxxxx")
+	}
+
+	e, ok := a.engineers.Get(engineerPhone)
+	switch {
+	case !ok:
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("Инженер %s не найден.", engineerPhone))
+	case !e.active:
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("Инженер %s (%s) уже отключен.", e.name, e.phone))
+	case e.phone == phone:
+		return tgbotapi.NewMessage(chatID, "Нельзя отключить самого себя.")
+	case slices.Contains(a.settings().SuperAdmins, e.phone):
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("%s (%s) назначен супер-администратором в настройках бота, отключить его можно только там.", e.name, e.phone))
+	}
+
+	e.active, e.changedBy = false, phone
+	if err = a.engineers.save(e, "отключен"); err != nil {
+		log.Printf("Не удалось отключить инженера %s: %v", e.phone, err)
+		return tgbotapi.NewMessage(chatID, "Не удалось сохранить изменения, попробуйте позже.")
+	}
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("Инженер %s (%s) отключен.", e.name, e.phone))
+}
+
+// setRoleCommand назначает инженеру роль по команде /set_role +7XXXXXXXXXX роль
+func (a *app) setRoleCommand(chatID int64, _ *operation, phone, args string) tgbotapi.MessageConfig {
+
+	roles := engineerRoles(a.settings().Roles)
+	usage := "Введите: /set_role +7xxxxxxxxxx роль\nРоли: " + strings.Join(roles, ", ")
+
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		return tgbotapi.NewMessage(chatID, "Неверный формат команды.\n"+usage)
+	}
+	engineerPhone, err := checkFormatPhone(fields[0])
+	if err != nil || !phoneFormat.MatchString(engineerPhone) {
+		return tgbotapi.NewMessage(chatID, "Неверный формат команды.\n"+usage)
+	}
+	role := fields[1]
+	if !slices.Contains(roles, role) {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("Роль %s не может быть назначена инженеру.\n%s", role, usage))
+	}
+
+	e, ok := a.engineers.Get(engineerPhone)
+	switch {
+	case !ok:
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("Инженер %s не найден.", engineerPhone))
+	case e.role == role:
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("Инженер %s (%s) уже имеет роль %s.", e.name, e.phone, roleName(role)))
+	case e.phone == phone:
+		return tgbotapi.NewMessage(chatID, "Нельзя изменить роль самому себе.")
+	case slices.Contains(a.settings().SuperAdmins, e.phone):
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("%s (%s) назначен супер-администратором в настройках бота, изменить его роль можно только там.", e.name, e.phone))
+	}
+
+	details := fmt.Sprintf("роль %s → %s", roleName(e.role), roleName(role))
+	e.role, e.changedBy = role, phone
+	if err = a.engineers.save(e, details); err != nil {
+		log.Printf("Не удалось изменить роль инженера %s: %v", e.phone, err)
+		return tgbotapi.NewMessage(chatID, "Не удалось сохранить изменения, попробуйте позже.")
+	}
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("Инженер %s (%s): %s.", e.name, e.phone, details))
+}
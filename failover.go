@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EkzikP/sdk_andromeda_go_v2"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const defaultHealthInterval = 30 //Интервал проверки доступности основного и резервных адресов сервера по умолчанию, сек.
+
+type (
+	// standbyConfig резервный адрес сервера ПО "Центр охраны"
+	standbyConfig struct {
+		Host   string `json:"host"`    //Адрес резервного сервера
+		ApiKey string `json:"api_key"` //API ключ резервного сервера, по умолчанию как у основного
+	}
+
+	// hostClient клиент одного адреса сервера ПО "Центр охраны"
+	hostClient struct {
+		confSDK andromeda.Config
+		client  andromedaClient
+		healthy bool //Адрес отвечал на последний запрос или проверку
+	}
+
+	// failoverClient отправляет запросы на активный адрес сервера: основной или, пока он недоступен, резервный.
+	// Безопасен для использования из нескольких горутин
+	failoverClient struct {
+		name   string //Название сервера для журнала
+		mu     sync.Mutex
+		hosts  []*hostClient //Основной адрес, затем резервные в порядке предпочтения
+		active int
+	}
+)
+
+var _ andromedaClient = (*failoverClient)(nil)
+
+// newFailoverClient создает клиент сервера с основным и резервными адресами
+func newFailoverClient(name string, hosts []andromeda.Config, configuration config) *failoverClient {
+
+	c := &failoverClient{name: name}
+	for _, confSDK := range hosts {
+		c.hosts = append(c.hosts, &hostClient{
+			confSDK: confSDK,
+			client:  newResilientClient(newTimeoutClient(andromeda.NewClient(), configuration.RequestTimeouts), configuration.Resilience),
+			healthy: true,
+		})
+	}
+	return c
+}
+
+// hostName возвращает описание адреса для журнала и команды /status
+func (c *failoverClient) hostName(i int) string {
+	if i == 0 {
+		return "основной " + c.hosts[i].confSDK.Host
+	}
+	return "резервный " + c.hosts[i].confSDK.Host
+}
+
+// current возвращает номер и клиент активного адреса
+func (c *failoverClient) current() (int, *hostClient) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.active, c.hosts[c.active]
+}
+
+// activate делает адрес i активным. Вызывается под блокировкой
+func (c *failoverClient) activate(i int, reason string) {
+	if c.active == i {
+		return
+	}
+	log.Printf("Сервер %q: запросы переключены с адреса %s на %s (%s)", c.name, c.hostName(c.active), c.hostName(i), reason)
+	c.active = i
+}
+
+// succeeded отмечает, что адрес i ответил на запрос
+func (c *failoverClient) succeeded(i int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hosts[i].healthy = true
+}
+
+// failed отмечает, что адрес i не ответил, и переключает запросы на первый доступный адрес.
+// Возвращает клиент нового активного адреса, если переключение выполнено
+func (c *failoverClient) failed(i int) (*hostClient, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hosts[i].healthy = false
+	if c.active != i {
+		//Запросы уже переключены другим обработчиком
+		return c.hosts[c.active], true
+	}
+	for j, h := range c.hosts {
+		if j != i && h.healthy {
+			c.activate(j, "адрес не отвечает")
+			return h, true
+		}
+	}
+	return nil, false
+}
+
+// probe проверяет доступность всех адресов запросом несуществующего объекта: ответ "объект не найден"
+// означает, что сервер работает. Когда основной адрес снова доступен, запросы возвращаются на него
+func (c *failoverClient) probe(ctx context.Context) {
+
+	healthy := make([]bool, len(c.hosts))
+	for i, h := range c.hosts {
+		input := andromeda.GetSitesInput{Id: "0", Config: h.confSDK}
+		_, err := h.client.GetSites(ctx, input)
+		healthy[i] = err == nil || !isUnavailable(err)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, h := range c.hosts {
+		if h.healthy && !healthy[i] {
+			log.Printf("Сервер %q: адрес %s недоступен", c.name, c.hostName(i))
+		} else if !h.healthy && healthy[i] {
+			log.Printf("Сервер %q: адрес %s снова доступен", c.name, c.hostName(i))
+		}
+		h.healthy = healthy[i]
+	}
+
+	for i, h := range c.hosts {
+		if h.healthy {
+			if i == 0 {
+				c.activate(i, "основной адрес снова доступен")
+			} else if !c.hosts[c.active].healthy {
+				c.activate(i, "активный адрес не отвечает на проверку")
+			}
+			return
+		}
+	}
+}
+
+// watch периодически проверяет доступность адресов, пока не отменен ctx
+func (c *failoverClient) watch(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.probe(ctx)
+		}
+	}
+}
+
+// status возвращает описание состояния адресов сервера для команды /status
+func (c *failoverClient) status() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var lines []string
+	for i, h := range c.hosts {
+		state := "доступен"
+		if !h.healthy {
+			state = "недоступен"
+		}
+		mark := "  "
+		if i == c.active {
+			mark = "► "
+		}
+		lines = append(lines, fmt.Sprintf("%s%s: %s", mark, c.hostName(i), state))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// withFailover выполняет запрос на активном адресе. Если адрес не ответил, запросы переключаются на резервный,
+// а запрос на чтение (idempotent) повторяется на нем. Запрос на изменение не повторяется: сервер мог успеть его обработать
+func withFailover[T any](ctx context.Context, c *failoverClient, idempotent bool, request func(h *hostClient) (T, error)) (T, error) {
+
+	i, h := c.current()
+	response, err := request(h)
+	if err == nil || !isUnavailable(err) {
+		c.succeeded(i)
+		return response, err
+	}
+	if ctx.Err() != nil || len(c.hosts) == 1 {
+		return response, err
+	}
+
+	next, ok := c.failed(i)
+	if !ok || !idempotent || next == h {
+		return response, err
+	}
+	return request(next)
+}
+
+func (c *failoverClient) GetSites(ctx context.Context, input andromeda.GetSitesInput) (andromeda.GetSitesResponse, error) {
+	return withFailover(ctx, c, true, func(h *hostClient) (andromeda.GetSitesResponse, error) {
+		input.Config = h.confSDK
+		return h.client.GetSites(ctx, input)
+	})
+}
+
+func (c *failoverClient) GetCustomers(ctx context.Context, input andromeda.GetCustomersInput) ([]andromeda.GetCustomerResponse, error) {
+	return withFailover(ctx, c, true, func(h *hostClient) ([]andromeda.GetCustomerResponse, error) {
+		input.Config = h.confSDK
+		return h.client.GetCustomers(ctx, input)
+	})
+}
+
+func (c *failoverClient) GetCustomer(ctx context.Context, input andromeda.GetCustomerInput) (andromeda.GetCustomerResponse, error) {
+	return withFailover(ctx, c, true, func(h *hostClient) (andromeda.GetCustomerResponse, error) {
+		input.Config = h.confSDK
+		return h.client.GetCustomer(ctx, input)
+	})
+}
+
+func (c *failoverClient) PostCheckPanic(ctx context.Context, input andromeda.PostCheckPanicInput) (andromeda.PostCheckPanicResponse, error) {
+	return withFailover(ctx, c, false, func(h *hostClient) (andromeda.PostCheckPanicResponse, error) {
+		input.Config = h.confSDK
+		return h.client.PostCheckPanic(ctx, input)
+	})
+}
+
+func (c *failoverClient) GetCheckPanic(ctx context.Context, input andromeda.GetCheckPanicInput) (andromeda.GetCheckPanicResponse, error) {
+	return withFailover(ctx, c, true, func(h *hostClient) (andromeda.GetCheckPanicResponse, error) {
+		input.Config = h.confSDK
+		return h.client.GetCheckPanic(ctx, input)
+	})
+}
+
+func (c *failoverClient) GetUsersMyAlarm(ctx context.Context, input andromeda.GetUsersMyAlarmInput) ([]andromeda.UserMyAlarmResponse, error) {
+	return withFailover(ctx, c, true, func(h *hostClient) ([]andromeda.UserMyAlarmResponse, error) {
+		input.Config = h.confSDK
+		return h.client.GetUsersMyAlarm(ctx, input)
+	})
+}
+
+func (c *failoverClient) GetUserObjectMyAlarm(ctx context.Context, input andromeda.GetUserObjectMyAlarmInput) ([]andromeda.GetUserObjectMyAlarmResponse, error) {
+	return withFailover(ctx, c, true, func(h *hostClient) ([]andromeda.GetUserObjectMyAlarmResponse, error) {
+		input.Config = h.confSDK
+		return h.client.GetUserObjectMyAlarm(ctx, input)
+	})
+}
+
+func (c *failoverClient) PutChangeUserMyAlarm(ctx context.Context, input andromeda.PutChangeUserMyAlarmInput) (andromeda.PutChangeUserMyAlarmResponse, error) {
+	return withFailover(ctx, c, false, func(h *hostClient) (andromeda.PutChangeUserMyAlarmResponse, error) {
+		input.Config = h.confSDK
+		return h.client.PutChangeUserMyAlarm(ctx, input)
+	})
+}
+
+func (c *failoverClient) PutChangeKTSUserMyAlarm(ctx context.Context, input andromeda.PutChangeKTSUserMyAlarmInput) error {
+	_, err := withFailover(ctx, c, false, func(h *hostClient) (struct{}, error) {
+		input.Config = h.confSDK
+		return struct{}{}, h.client.PutChangeKTSUserMyAlarm(ctx, input)
+	})
+	return err
+}
+
+func (c *failoverClient) GetParts(ctx context.Context, input andromeda.GetPartsInput) ([]andromeda.GetPartsResponse, error) {
+	return withFailover(ctx, c, true, func(h *hostClient) ([]andromeda.GetPartsResponse, error) {
+		input.Config = h.confSDK
+		return h.client.GetParts(ctx, input)
+	})
+}
+
+func (c *failoverClient) GetZones(ctx context.Context, input andromeda.GetZonesInput) ([]andromeda.GetZonesResponse, error) {
+	return withFailover(ctx, c, true, func(h *hostClient) ([]andromeda.GetZonesResponse, error) {
+		input.Config = h.confSDK
+		return h.client.GetZones(ctx, input)
+	})
+}
+
+// watchBackends запускает проверку доступности серверов, у которых есть резервные адреса
+func (a *app) watchBackends(ctx context.Context) {
+	interval := time.Duration(a.settings().Resilience.HealthInterval) * time.Second
+	for _, b := range a.backends {
+		if len(b.client.hosts) > 1 {
+			go b.client.watch(ctx, interval)
+		}
+	}
+}
+
+// statusMessage формирует ответ на команду /status: активные адреса серверов ПО "Центр охраны" и их доступность
+func (a *app) statusMessage(chatID int64) tgbotapi.MessageConfig {
+
+	var text strings.Builder
+	text.WriteString("Серверы Центра охраны:")
+	for _, b := range a.backends {
+		fmt.Fprintf(&text, "\n\n%s\n%s", b.name, b.client.status())
+	}
+	return tgbotapi.NewMessage(chatID, text.String())
+}
@@ -0,0 +1,124 @@
+package fakeandromeda
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/EkzikP/sdk_andromeda_go_v2"
+)
+
+//go:embed fixtures.json
+var defaultFixtures []byte
+
+type (
+	// Fixtures содержит данные имитатора. Ответственные лица, разделы, зоны и пользователи MyAlarm
+	// хранятся по идентификатору объекта (поле Id карточки объекта)
+	Fixtures struct {
+		Sites        []andromeda.GetSitesResponse               `json:"sites"`
+		Customers    map[string][]andromeda.GetCustomerResponse `json:"customers"`
+		Parts        map[string][]andromeda.GetPartsResponse    `json:"parts"`
+		Zones        map[string][]andromeda.GetZonesResponse    `json:"zones"`
+		UsersMyAlarm map[string][]andromeda.UserMyAlarmResponse `json:"usersMyAlarm"`
+		CheckPanic   CheckPanic                                 `json:"checkPanic"`
+	}
+
+	// CheckPanic задает поведение проверки КТС: через Delay после запуска проверка завершается с результатом Result
+	CheckPanic struct {
+		Delay  Duration `json:"delay"`  //Время до завершения проверки, например "10s"
+		Result string   `json:"result"` //Результат проверки: "success" или "time out"
+	}
+
+	// Duration интервал времени, записываемый в JSON строкой в формате time.ParseDuration
+	Duration time.Duration
+)
+
+// DefaultFixtures возвращает встроенный набор данных: объекты 1234 и 5678 (по объекту 5678 тревога)
+func DefaultFixtures() Fixtures {
+	fixtures := Fixtures{}
+	if err := json.Unmarshal(defaultFixtures, &fixtures); err != nil {
+		panic(err)
+	}
+	return fixtures
+}
+
+// LoadFixtures читает набор данных из JSON файла
+func LoadFixtures(path string) (Fixtures, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Fixtures{}, err
+	}
+	fixtures := Fixtures{}
+	err = json.Unmarshal(data, &fixtures)
+	return fixtures, err
+}
+
+// CopySite добавляет в набор копию объекта accountNumber из набора from под номером newAccountNumber
+// вместе с ответственными лицами, разделами, зонами и пользователями MyAlarm. Так один объект можно
+// разместить на нескольких имитаторах, как на разных серверах ПО "Центр охраны"
+func (f *Fixtures) CopySite(from Fixtures, accountNumber, newAccountNumber int) error {
+
+	i := slices.IndexFunc(from.Sites, func(site andromeda.GetSitesResponse) bool { return site.AccountNumber == accountNumber })
+	if i < 0 {
+		return fmt.Errorf("объект %d не найден", accountNumber)
+	}
+
+	site := from.Sites[i]
+	id := site.Id
+	site.Id = fmt.Sprintf("00000000-0000-4000-8000-%012d", newAccountNumber)
+	site.AccountNumber = newAccountNumber
+	f.Sites = append(f.Sites, site)
+
+	if f.Customers == nil {
+		f.Customers = make(map[string][]andromeda.GetCustomerResponse)
+	}
+	if f.Parts == nil {
+		f.Parts = make(map[string][]andromeda.GetPartsResponse)
+	}
+	if f.Zones == nil {
+		f.Zones = make(map[string][]andromeda.GetZonesResponse)
+	}
+	if f.UsersMyAlarm == nil {
+		f.UsersMyAlarm = make(map[string][]andromeda.UserMyAlarmResponse)
+	}
+	//У ответственных лиц копии свои идентификаторы, иначе изменение доступа к MyAlarm
+	//по идентификатору ответственного лица может попасть не на тот объект
+	customerId := func(id string) string {
+		return fmt.Sprintf("c%07d", newAccountNumber) + id[min(8, len(id)):]
+	}
+
+	customers := slices.Clone(from.Customers[id])
+	for i := range customers {
+		customers[i].Id = customerId(customers[i].Id)
+	}
+	users := slices.Clone(from.UsersMyAlarm[id])
+	for i := range users {
+		users[i].CustomerID = customerId(users[i].CustomerID)
+	}
+
+	f.Customers[site.Id] = customers
+	f.Parts[site.Id] = slices.Clone(from.Parts[id])
+	f.Zones[site.Id] = slices.Clone(from.Zones[id])
+	f.UsersMyAlarm[site.Id] = users
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
@@ -0,0 +1,491 @@
+// Package fakeandromeda реализует имитатор REST API ПО "Центр охраны" для интеграционной проверки бота.
+// Данные объектов, ответственных лиц, разделов, зон и пользователей MyAlarm загружаются из JSON файла,
+// проверка КТС переходит из состояния "in progress" в заданный результат по таймеру
+package fakeandromeda
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EkzikP/sdk_andromeda_go_v2"
+)
+
+// Результаты проверки КТС
+const (
+	PanicInProgress = "in progress"
+	PanicSuccess    = "success"
+	PanicTimeOut    = "time out"
+)
+
+// Ответы на запуск проверки КТС
+const (
+	panicStarted        = "success"
+	panicAlreadyRunning = "already runnig"
+	panicHasAlarm       = "has alarm"
+)
+
+// panicCheck проверка КТС, запущенная по объекту
+type panicCheck struct {
+	siteId  string
+	started time.Time
+	delay   time.Duration //Время, через которое проверка завершится с результатом result
+	result  string
+	pressed bool //Тревога КТС получена, проверка завершена успешно
+}
+
+// Request запрос, полученный имитатором
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+	Body   string
+}
+
+// Server имитатор API ПО "Центр охраны". Безопасен для использования из нескольких горутин
+type Server struct {
+	mu       sync.Mutex
+	fixtures Fixtures
+	apiKey   string
+	now      func() time.Time
+	checks   map[string]*panicCheck
+	failures map[string]int           //Код ответа по пути запроса для имитации ошибок сервера
+	delays   map[string]time.Duration //Задержка ответа по пути запроса для имитации медленного сервера
+	drops    map[string]int           //Количество запросов по пути, на которые соединение разрывается без ответа
+	down     bool                     //Соединение разрывается на все запросы
+	requests []Request
+	seq      int
+
+	httpServer *httptest.Server
+}
+
+// New создает имитатор с заданными данными. Если apiKey не пустой, запросы с другим ключом отклоняются с кодом 401
+func New(fixtures Fixtures, apiKey string) *Server {
+	if fixtures.Customers == nil {
+		fixtures.Customers = make(map[string][]andromeda.GetCustomerResponse)
+	}
+	if fixtures.Parts == nil {
+		fixtures.Parts = make(map[string][]andromeda.GetPartsResponse)
+	}
+	if fixtures.Zones == nil {
+		fixtures.Zones = make(map[string][]andromeda.GetZonesResponse)
+	}
+	if fixtures.UsersMyAlarm == nil {
+		fixtures.UsersMyAlarm = make(map[string][]andromeda.UserMyAlarmResponse)
+	}
+	if fixtures.CheckPanic.Result == "" {
+		fixtures.CheckPanic.Result = PanicSuccess
+	}
+	return &Server{
+		fixtures: fixtures,
+		apiKey:   apiKey,
+		now:      time.Now,
+		checks:   make(map[string]*panicCheck),
+		failures: make(map[string]int),
+		delays:   make(map[string]time.Duration),
+		drops:    make(map[string]int),
+	}
+}
+
+// Start запускает имитатор на случайном локальном порту. Адрес для config.Host возвращает URL
+func Start(fixtures Fixtures, apiKey string) *Server {
+	s := New(fixtures, apiKey)
+	s.httpServer = httptest.NewServer(s)
+	return s
+}
+
+// URL возвращает адрес имитатора, запущенного функцией Start
+func (s *Server) URL() string {
+	if s.httpServer == nil {
+		return ""
+	}
+	return s.httpServer.URL
+}
+
+// Close останавливает имитатор, запущенный функцией Start
+func (s *Server) Close() {
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+// SetClock задает источник текущего времени, чтобы управлять таймером проверки КТС
+func (s *Server) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// SetCheckPanic задает время и результат завершения следующих проверок КТС
+func (s *Server) SetCheckPanic(delay time.Duration, result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fixtures.CheckPanic.Delay = Duration(delay)
+	s.fixtures.CheckPanic.Result = result
+}
+
+// PressPanic имитирует нажатие кнопки КТС на объекте: выполняемая проверка завершается успешно
+func (s *Server) PressPanic(accountNumber int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	site, ok := s.findSite(strconv.Itoa(accountNumber))
+	if !ok {
+		return
+	}
+	for _, check := range s.checks {
+		if check.siteId == site.Id && s.panicStatus(check) == PanicInProgress {
+			check.pressed = true
+		}
+	}
+}
+
+// SetAlarm устанавливает или снимает тревогу по объекту. При тревоге проверка КТС запрещена
+func (s *Server) SetAlarm(accountNumber int, alarm bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.fixtures.Sites {
+		if s.fixtures.Sites[i].AccountNumber == accountNumber {
+			s.fixtures.Sites[i].IsStateAlarm = alarm
+		}
+	}
+}
+
+// Fail задает код ответа для запросов к пути (например "/Sites"). Код 0 отменяет ошибку
+func (s *Server) Fail(path string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status == 0 {
+		delete(s.failures, path)
+		return
+	}
+	s.failures[path] = status
+}
+
+// Delay задает задержку ответа для запросов к пути. Нулевая задержка отменяет ее
+func (s *Server) Delay(path string, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if delay == 0 {
+		delete(s.delays, path)
+		return
+	}
+	s.delays[path] = delay
+}
+
+// Drop задает количество следующих запросов к пути, на которые соединение разрывается без ответа,
+// для имитации сетевых сбоев. Количество 0 отменяет разрывы
+func (s *Server) Drop(path string, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if count <= 0 {
+		delete(s.drops, path)
+		return
+	}
+	s.drops[path] = count
+}
+
+// SetDown имитирует недоступность сервера: соединение разрывается на все запросы
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// Requests возвращает полученные запросы в порядке поступления
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// UsersMyAlarm возвращает текущий список пользователей MyAlarm объекта
+func (s *Server) UsersMyAlarm(accountNumber int) []andromeda.UserMyAlarmResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	site, ok := s.findSite(strconv.Itoa(accountNumber))
+	if !ok {
+		return nil
+	}
+	return append([]andromeda.UserMyAlarmResponse(nil), s.fixtures.UsersMyAlarm[site.Id]...)
+}
+
+// ServeHTTP обрабатывает запросы к API
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Не удалось прочитать запрос")
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Body: string(body)})
+	status := s.failures[r.URL.Path]
+	delay := s.delays[r.URL.Path]
+	drop := s.down || s.drops[r.URL.Path] > 0
+	if !s.down && drop {
+		s.drops[r.URL.Path]--
+	}
+	s.mu.Unlock()
+
+	if drop {
+		if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+			_ = conn.Close()
+			return
+		}
+		//Соединение не поддерживает перехват (HTTP/2), запрос завершается аварийно
+		panic(http.ErrAbortHandler)
+	}
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if s.apiKey != "" && r.Header.Get("apiKey") != s.apiKey {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if status != 0 {
+		writeError(w, status, "Имитация ошибки сервера")
+		return
+	}
+
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/Sites" && r.Method == http.MethodGet:
+		s.getSites(w, query.Get("id"))
+	case r.URL.Path == "/Customers" && r.Method == http.MethodGet && query.Has("siteId"):
+		writeJSON(w, nonNil(s.fixtures.Customers[query.Get("siteId")]))
+	case r.URL.Path == "/Customers" && r.Method == http.MethodGet:
+		s.getCustomer(w, query.Get("id"))
+	case r.URL.Path == "/CheckPanic" && r.Method == http.MethodPost:
+		s.postCheckPanic(w, query.Get("siteId"))
+	case r.URL.Path == "/CheckPanic" && r.Method == http.MethodGet:
+		s.getCheckPanic(w, query.Get("checkPanicId"))
+	case r.URL.Path == "/MyAlarm" && r.Method == http.MethodGet:
+		writeJSON(w, nonNil(s.fixtures.UsersMyAlarm[query.Get("siteId")]))
+	case r.URL.Path == "/MyAlarm" && r.Method == http.MethodPut && query.Has("role"):
+		s.putChangeUserMyAlarm(w, query.Get("custId"), query.Get("role"))
+	case r.URL.Path == "/MyAlarm" && r.Method == http.MethodPut && query.Has("isPanic"):
+		s.putChangeKTSUserMyAlarm(w, query.Get("custId"), query.Get("isPanic"))
+	case r.URL.Path == "/MyAlarm/UserObjects" && r.Method == http.MethodGet:
+		s.getUserObjectMyAlarm(w, body)
+	case r.URL.Path == "/Parts" && r.Method == http.MethodGet:
+		writeJSON(w, nonNil(s.fixtures.Parts[query.Get("siteId")]))
+	case r.URL.Path == "/Zones" && r.Method == http.MethodGet:
+		writeJSON(w, nonNil(s.fixtures.Zones[query.Get("siteId")]))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// findSite ищет объект по пультовому номеру или идентификатору
+func (s *Server) findSite(id string) (andromeda.GetSitesResponse, bool) {
+	for _, site := range s.fixtures.Sites {
+		if site.Id == id || strconv.Itoa(site.AccountNumber) == id {
+			return site, true
+		}
+	}
+	return andromeda.GetSitesResponse{}, false
+}
+
+func (s *Server) getSites(w http.ResponseWriter, id string) {
+	site, ok := s.findSite(id)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Объект не найден")
+		return
+	}
+	writeJSON(w, site)
+}
+
+func (s *Server) getCustomer(w http.ResponseWriter, id string) {
+	for _, customers := range s.fixtures.Customers {
+		for _, customer := range customers {
+			if customer.Id == id {
+				writeJSON(w, customer)
+				return
+			}
+		}
+	}
+	writeError(w, http.StatusBadRequest, "Ответственное лицо не найдено")
+}
+
+func (s *Server) postCheckPanic(w http.ResponseWriter, siteId string) {
+
+	site, ok := s.findSite(siteId)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Объект не найден")
+		return
+	}
+
+	if site.IsStateAlarm {
+		writeJSON(w, andromeda.PostCheckPanicResponse{Status: 1, Description: panicHasAlarm})
+		return
+	}
+
+	for _, check := range s.checks {
+		if check.siteId == site.Id && s.panicStatus(check) == PanicInProgress {
+			writeJSON(w, andromeda.PostCheckPanicResponse{Status: 2, Description: panicAlreadyRunning})
+			return
+		}
+	}
+
+	s.seq++
+	id := fmt.Sprintf("00000000-0000-4000-9000-%012d", s.seq)
+	s.checks[id] = &panicCheck{
+		siteId:  site.Id,
+		started: s.now(),
+		delay:   time.Duration(s.fixtures.CheckPanic.Delay),
+		result:  s.fixtures.CheckPanic.Result,
+	}
+	writeJSON(w, andromeda.PostCheckPanicResponse{Status: 0, Description: panicStarted, CheckPanicId: id})
+}
+
+func (s *Server) getCheckPanic(w http.ResponseWriter, id string) {
+	check, ok := s.checks[id]
+	if !ok {
+		writeJSON(w, andromeda.GetCheckPanicResponse{Status: 1, Description: "not found"})
+		return
+	}
+	writeJSON(w, andromeda.GetCheckPanicResponse{Description: s.panicStatus(check)})
+}
+
+// panicStatus возвращает состояние проверки КТС на текущий момент
+func (s *Server) panicStatus(check *panicCheck) string {
+	switch {
+	case check.pressed:
+		return PanicSuccess
+	case s.now().Sub(check.started) < check.delay:
+		return PanicInProgress
+	default:
+		return check.result
+	}
+}
+
+func (s *Server) putChangeUserMyAlarm(w http.ResponseWriter, custId, role string) {
+
+	if role != "unlink" && role != "user" && role != "admin" {
+		writeError(w, http.StatusBadRequest, "Недопустимая роль")
+		return
+	}
+
+	for siteId, customers := range s.fixtures.Customers {
+		for _, customer := range customers {
+			if customer.Id != custId {
+				continue
+			}
+
+			users := s.fixtures.UsersMyAlarm[siteId]
+			for i, user := range users {
+				if user.CustomerID == custId {
+					if role != "unlink" {
+						writeError(w, http.StatusBadRequest, "User already has role, "+user.Role)
+						return
+					}
+					s.fixtures.UsersMyAlarm[siteId] = append(users[:i], users[i+1:]...)
+					writeJSON(w, andromeda.PutChangeUserMyAlarmResponse{})
+					return
+				}
+			}
+
+			if role == "unlink" {
+				writeError(w, http.StatusBadRequest, "Пользователь не подключен к MyAlarm")
+				return
+			}
+			s.fixtures.UsersMyAlarm[siteId] = append(users, andromeda.UserMyAlarmResponse{
+				CustomerID:   custId,
+				MobilePhone:  customer.ObjCustPhone1,
+				MyAlarmPhone: customer.ObjCustPhone1,
+				Role:         role,
+			})
+			writeJSON(w, andromeda.PutChangeUserMyAlarmResponse{})
+			return
+		}
+	}
+	writeError(w, http.StatusBadRequest, "Ответственное лицо не найдено")
+}
+
+func (s *Server) putChangeKTSUserMyAlarm(w http.ResponseWriter, custId, isPanic string) {
+
+	value, err := strconv.ParseBool(isPanic)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Недопустимое значение isPanic")
+		return
+	}
+
+	for _, users := range s.fixtures.UsersMyAlarm {
+		for i := range users {
+			if users[i].CustomerID == custId {
+				users[i].IsPanic = value
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+	}
+	writeError(w, http.StatusBadRequest, "Пользователь не подключен к MyAlarm")
+}
+
+func (s *Server) getUserObjectMyAlarm(w http.ResponseWriter, body []byte) {
+
+	input := andromeda.GetUserObjectMyAlarmInput{}
+	if err := json.Unmarshal(body, &input); err != nil {
+		writeError(w, http.StatusBadRequest, "Неверный формат запроса")
+		return
+	}
+
+	objects := []andromeda.GetUserObjectMyAlarmResponse{}
+	for siteId, users := range s.fixtures.UsersMyAlarm {
+		for _, user := range users {
+			if user.MyAlarmPhone == input.Phone {
+				objects = append(objects, andromeda.GetUserObjectMyAlarmResponse{
+					ObjectGUID: siteId,
+					CustomerID: user.CustomerID,
+					Role:       user.Role,
+					IsPanic:    user.IsPanic,
+				})
+			}
+		}
+	}
+	writeJSON(w, objects)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Не удалось отправить ответ: %v", err)
+	}
+}
+
+// writeError отправляет ошибку в формате API. Тело с сообщением передается только для кода 400
+func writeError(w http.ResponseWriter, status int, message string) {
+	if status != http.StatusBadRequest {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"Message": message, "SpResultCode": 1})
+}
+
+func nonNil[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
@@ -0,0 +1,674 @@
+// Package faketelegram реализует имитатор Telegram Bot API для сквозной проверки диалогов бота.
+// Имитатор отдает боту сообщения и нажатия кнопок пользователей через getUpdates, запоминает отправленные
+// и измененные ботом сообщения, клавиатуры и закрепления и позволяет проверять их из сценариев
+package faketelegram
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	botID          = 1000 //Идентификатор бота
+	botUserName    = "fake_security_center_bot"
+	maxPollTimeout = 5 * time.Second //Максимальное время ожидания обновлений в getUpdates
+)
+
+type (
+	// Message сообщение в чате с ботом
+	Message struct {
+		ID             int
+		ChatID         int64
+		FromBot        bool
+		Text           string
+		ReplyTo        int                               //Идентификатор сообщения, на которое дан ответ
+		InlineKeyboard [][]tgbotapi.InlineKeyboardButton //Инлайн клавиатура сообщения
+		ReplyKeyboard  [][]tgbotapi.KeyboardButton       //Клавиатура, выведенная пользователю вместе с сообщением
+		Pinned         bool
+		Edited         bool
+		DocumentName   string //Имя файла, отправленного ботом методом sendDocument. Текст сообщения - подпись файла
+		Document       []byte
+	}
+
+	// Call запрос бота к API
+	Call struct {
+		Method  string
+		ChatID  int64
+		Params  url.Values
+		Message Message //Отправленное или измененное сообщение
+		Error   string  //Ошибка, которую вернул имитатор
+	}
+
+	// chat переписка бота с пользователем
+	chat struct {
+		messages map[int]*Message
+		lastID   int
+		calls    []Call //Запросы бота, еще не полученные сценарием
+	}
+
+	// Server имитатор Telegram Bot API. Безопасен для использования из нескольких горутин
+	Server struct {
+		mu         sync.Mutex
+		token      string
+		chats      map[int64]*chat
+		updates    []tgbotapi.Update
+		nextUpdate int
+		callbacks  map[string]bool //Нажатия кнопок: true, если бот ответил на нажатие
+		calls      []Call          //Все запросы бота, кроме getUpdates
+		webhook    url.Values      //Параметры последнего вызова setWebhook
+		delivering bool            //Обновления доставляются на вебхук
+		rejected   int             //Количество обновлений, которые вебхук бота не принял
+		changed    chan struct{}   //Закрывается и создается заново при каждом изменении
+		done       chan struct{}   //Закрывается при остановке имитатора
+		httpServer *httptest.Server
+	}
+)
+
+// New создает имитатор, принимающий запросы бота с токеном token
+func New(token string) *Server {
+	return &Server{
+		token:      token,
+		chats:      make(map[int64]*chat),
+		nextUpdate: 1,
+		callbacks:  make(map[string]bool),
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start запускает имитатор на случайном локальном порту
+func Start(token string) *Server {
+	s := New(token)
+	s.httpServer = httptest.NewServer(s)
+	return s
+}
+
+// URL возвращает адрес имитатора, запущенного функцией Start
+func (s *Server) URL() string {
+	if s.httpServer == nil {
+		return ""
+	}
+	return s.httpServer.URL
+}
+
+// Endpoint возвращает адрес API для config.TelegramAPIEndpoint в формате tgbotapi.APIEndpoint
+func (s *Server) Endpoint() string {
+	return s.URL() + "/bot%s/%s"
+}
+
+// Close останавливает имитатор, запущенный функцией Start
+func (s *Server) Close() {
+	close(s.done)
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+// SendText отправляет боту текстовое сообщение пользователя. Текст, начинающийся с "/", передается как команда
+func (s *Server) SendText(chatID int64, text string) Message {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message := s.addMessage(chatID, false, text)
+	tgMessage := s.tgMessage(message)
+	if strings.HasPrefix(text, "/") {
+		command, _, _ := strings.Cut(text, " ")
+		tgMessage.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}}
+	}
+	s.addUpdate(tgbotapi.Update{Message: tgMessage})
+	return *message
+}
+
+// SendContact отправляет боту контакт. userID — владелец контакта, для своего контакта совпадает с chatID
+func (s *Server) SendContact(chatID, userID int64, phone string) Message {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message := s.addMessage(chatID, false, "")
+	tgMessage := s.tgMessage(message)
+	tgMessage.Contact = &tgbotapi.Contact{PhoneNumber: phone, FirstName: "Тест", UserID: userID}
+	s.addUpdate(tgbotapi.Update{Message: tgMessage})
+	return *message
+}
+
+// PressButton нажимает кнопку с текстом text в последнем сообщении бота с инлайн клавиатурой
+func (s *Server) PressButton(chatID int64, text string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.chatByID(chatID)
+	for id := c.lastID; id > 0; id-- {
+		message, ok := c.messages[id]
+		if ok && message.FromBot && len(message.InlineKeyboard) > 0 {
+			return s.press(message, text)
+		}
+	}
+	return fmt.Errorf("в чате %d нет сообщений с кнопками", chatID)
+}
+
+// PressButtonIn нажимает кнопку с текстом text в указанном сообщении бота.
+// Сообщение передается снимком, поэтому можно нажать кнопку, которую бот уже удалил
+func (s *Server) PressButtonIn(message Message, text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.press(&message, text)
+}
+
+// Next возвращает следующий запрос бота, относящийся к чату, или ошибку, если запроса не было в течение timeout
+func (s *Server) Next(chatID int64, timeout time.Duration) (Call, error) {
+
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		c := s.chatByID(chatID)
+		if len(c.calls) > 0 {
+			call := c.calls[0]
+			c.calls = c.calls[1:]
+			s.mu.Unlock()
+			return call, nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return Call{}, fmt.Errorf("бот не выполнил запросов в чате %d за %s", chatID, timeout)
+		}
+	}
+}
+
+// Message возвращает текущее состояние сообщения чата
+func (s *Server) Message(chatID int64, id int) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	message, ok := s.chatByID(chatID).messages[id]
+	if !ok {
+		return Message{}, false
+	}
+	return *message, true
+}
+
+// Pinned возвращает закрепленные сообщения чата
+func (s *Server) Pinned(chatID int64) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.chatByID(chatID)
+	var pinned []Message
+	for id := 1; id <= c.lastID; id++ {
+		if message, ok := c.messages[id]; ok && message.Pinned {
+			pinned = append(pinned, *message)
+		}
+	}
+	return pinned
+}
+
+// Unanswered возвращает количество нажатий кнопок, на которые бот не ответил answerCallbackQuery
+func (s *Server) Unanswered() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, answered := range s.callbacks {
+		if !answered {
+			count++
+		}
+	}
+	return count
+}
+
+// Calls возвращает все запросы бота, кроме getUpdates, в порядке поступления
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// Webhook возвращает параметры последнего вызова setWebhook или nil, если вебхук не установлен
+func (s *Server) Webhook() url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.webhook
+}
+
+// Rejected возвращает количество попыток доставки обновлений, которые вебхук бота отклонил
+func (s *Server) Rejected() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rejected
+}
+
+// ServeHTTP обрабатывает запросы бота к API
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	token, method, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/bot"), "/")
+	if !ok || token != s.token {
+		writeResponse(w, http.StatusUnauthorized, nil, "Unauthorized")
+		return
+	}
+
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil && err != http.ErrNotMultipart {
+		writeResponse(w, http.StatusBadRequest, nil, "Bad Request: "+err.Error())
+		return
+	}
+	params := r.Form
+	files := make(map[string][]byte)
+	if r.MultipartForm != nil {
+		for name, headers := range r.MultipartForm.File {
+			params.Set(name, headers[0].Filename)
+			if files[name], err = readFile(headers[0]); err != nil {
+				writeResponse(w, http.StatusBadRequest, nil, "Bad Request: "+err.Error())
+				return
+			}
+		}
+	}
+
+	if method == "getUpdates" {
+		s.getUpdates(w, r, params)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, call, errText := s.handle(method, params, files)
+	if call != nil {
+		call.Error = errText
+		s.addCall(*call)
+	}
+	if errText != "" {
+		writeResponse(w, http.StatusBadRequest, nil, errText)
+		return
+	}
+	writeResponse(w, http.StatusOK, result, "")
+}
+
+// handle выполняет метод API и возвращает результат, запись о запросе и текст ошибки
+func (s *Server) handle(method string, params url.Values, files map[string][]byte) (any, *Call, string) {
+
+	chatID, _ := strconv.ParseInt(params.Get("chat_id"), 10, 64)
+	messageID, _ := strconv.Atoi(params.Get("message_id"))
+	call := &Call{Method: method, ChatID: chatID, Params: params}
+
+	switch method {
+	case "getMe":
+		return tgbotapi.User{ID: botID, IsBot: true, FirstName: "Центр охраны", UserName: botUserName}, nil, ""
+
+	case "sendMessage":
+		message := s.addMessage(chatID, true, params.Get("text"))
+		message.ReplyTo, _ = strconv.Atoi(params.Get("reply_to_message_id"))
+		err := setKeyboard(message, params.Get("reply_markup"))
+		if err != nil {
+			return nil, call, "Bad Request: " + err.Error()
+		}
+		call.Message = *message
+		return s.tgMessage(message), call, ""
+
+	case "sendDocument":
+		if _, ok := files["document"]; !ok {
+			return nil, call, "Bad Request: there is no document in the request"
+		}
+		message := s.addMessage(chatID, true, params.Get("caption"))
+		message.DocumentName, message.Document = params.Get("document"), files["document"]
+		call.Message = *message
+		return s.tgMessage(message), call, ""
+
+	case "editMessageText", "editMessageReplyMarkup":
+		message, ok := s.chatByID(chatID).messages[messageID]
+		if !ok || !message.FromBot {
+			return nil, call, "Bad Request: message to edit not found"
+		}
+
+		edited := *message
+		edited.InlineKeyboard = nil
+		if method == "editMessageText" {
+			edited.Text = params.Get("text")
+		}
+		if err := setKeyboard(&edited, params.Get("reply_markup")); err != nil {
+			return nil, call, "Bad Request: " + err.Error()
+		}
+		if edited.Text == message.Text && keyboardEqual(edited.InlineKeyboard, message.InlineKeyboard) {
+			call.Message = *message
+			return nil, call, "Bad Request: message is not modified: specified new message content and reply markup are exactly the same as a current content and reply markup of the message"
+		}
+		edited.Edited = true
+		*message = edited
+		call.Message = edited
+		return s.tgMessage(message), call, ""
+
+	case "deleteMessage":
+		message, ok := s.chatByID(chatID).messages[messageID]
+		if !ok {
+			return nil, call, "Bad Request: message to delete not found"
+		}
+		call.Message = *message
+		delete(s.chatByID(chatID).messages, messageID)
+		return true, call, ""
+
+	case "pinChatMessage":
+		message, ok := s.chatByID(chatID).messages[messageID]
+		if !ok {
+			return nil, call, "Bad Request: message to pin not found"
+		}
+		message.Pinned = true
+		call.Message = *message
+		return true, call, ""
+
+	case "unpinAllChatMessages":
+		for _, message := range s.chatByID(chatID).messages {
+			message.Pinned = false
+		}
+		return true, call, ""
+
+	case "answerCallbackQuery":
+		id := params.Get("callback_query_id")
+		if _, ok := s.callbacks[id]; !ok {
+			return nil, call, "Bad Request: query is too old and response timeout expired or query ID is invalid"
+		}
+		s.callbacks[id] = true
+		return true, call, ""
+
+	case "setWebhook":
+		s.webhook = params
+		if !s.delivering {
+			s.delivering = true
+			go s.deliver()
+		}
+		return true, call, ""
+
+	case "deleteWebhook":
+		s.webhook = nil
+		return true, call, ""
+
+	case "getWebhookInfo":
+		info := tgbotapi.WebhookInfo{}
+		if s.webhook != nil {
+			info.URL = s.webhook.Get("url")
+		}
+		return info, nil, ""
+	}
+
+	//Остальные методы принимаются без проверки
+	return true, call, ""
+}
+
+// getUpdates отдает боту накопленные обновления, при их отсутствии ожидая новые
+func (s *Server) getUpdates(w http.ResponseWriter, r *http.Request, params url.Values) {
+
+	s.mu.Lock()
+	webhook := s.webhook
+	s.mu.Unlock()
+	if webhook != nil {
+		writeResponse(w, http.StatusConflict, nil, "Conflict: can't use getUpdates method while webhook is active; use deleteWebhook to delete the webhook first")
+		return
+	}
+
+	offset, _ := strconv.Atoi(params.Get("offset"))
+	timeout, _ := strconv.Atoi(params.Get("timeout"))
+	wait := min(time.Duration(timeout)*time.Second, maxPollTimeout)
+	deadline := time.After(wait)
+
+	for {
+		s.mu.Lock()
+		//Обновления с номером меньше offset подтверждены ботом
+		for len(s.updates) > 0 && s.updates[0].UpdateID < offset {
+			s.updates = s.updates[1:]
+		}
+		updates := append([]tgbotapi.Update{}, s.updates...)
+		changed := s.changed
+		s.mu.Unlock()
+
+		if len(updates) > 0 {
+			writeResponse(w, http.StatusOK, updates, "")
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			writeResponse(w, http.StatusOK, []tgbotapi.Update{}, "")
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// deliver доставляет обновления на вебхук бота по одному, пока вебхук установлен.
+// Обновление, которое вебхук не принял, доставляется повторно
+func (s *Server) deliver() {
+
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+
+	for {
+		s.mu.Lock()
+		if s.webhook == nil {
+			s.delivering = false
+			s.mu.Unlock()
+			return
+		}
+		if len(s.updates) == 0 {
+			changed := s.changed
+			s.mu.Unlock()
+			select {
+			case <-changed:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		update := s.updates[0]
+		hookURL := s.webhook.Get("url")
+		secretToken := s.webhook.Get("secret_token")
+		s.mu.Unlock()
+
+		accepted := postUpdate(client, hookURL, secretToken, update)
+
+		s.mu.Lock()
+		if accepted && len(s.updates) > 0 && s.updates[0].UpdateID == update.UpdateID {
+			s.updates = s.updates[1:]
+		}
+		if !accepted {
+			s.rejected++
+		}
+		s.mu.Unlock()
+
+		if !accepted {
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// postUpdate отправляет обновление на вебхук и возвращает признак того, что вебхук его принял
+func postUpdate(client *http.Client, hookURL, secretToken string, update tgbotapi.Update) bool {
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		return false
+	}
+
+	request, err := http.NewRequest(http.MethodPost, hookURL, bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if secretToken != "" {
+		request.Header.Set("X-Telegram-Bot-Api-Secret-Token", secretToken)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return false
+	}
+	_ = response.Body.Close()
+	return response.StatusCode == http.StatusOK
+}
+
+// press передает боту нажатие кнопки с текстом text в сообщении message
+func (s *Server) press(message *Message, text string) error {
+
+	for _, row := range message.InlineKeyboard {
+		for _, button := range row {
+			if button.Text != text || button.CallbackData == nil {
+				continue
+			}
+
+			id := strconv.Itoa(s.nextUpdate)
+			s.callbacks[id] = false
+			s.addUpdate(tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+				ID:      id,
+				From:    &tgbotapi.User{ID: message.ChatID, FirstName: "Тест"},
+				Message: s.tgMessage(message),
+				Data:    *button.CallbackData,
+			}})
+			return nil
+		}
+	}
+	return fmt.Errorf("в сообщении %d нет кнопки %q", message.ID, text)
+}
+
+func (s *Server) chatByID(chatID int64) *chat {
+	c, ok := s.chats[chatID]
+	if !ok {
+		c = &chat{messages: make(map[int]*Message)}
+		s.chats[chatID] = c
+	}
+	return c
+}
+
+func (s *Server) addMessage(chatID int64, fromBot bool, text string) *Message {
+	c := s.chatByID(chatID)
+	c.lastID++
+	message := &Message{ID: c.lastID, ChatID: chatID, FromBot: fromBot, Text: text}
+	c.messages[message.ID] = message
+	return message
+}
+
+func (s *Server) addUpdate(update tgbotapi.Update) {
+	update.UpdateID = s.nextUpdate
+	s.nextUpdate++
+	s.updates = append(s.updates, update)
+	s.notify()
+}
+
+func (s *Server) addCall(call Call) {
+	s.calls = append(s.calls, call)
+	if call.ChatID != 0 {
+		c := s.chatByID(call.ChatID)
+		c.calls = append(c.calls, call)
+	}
+	s.notify()
+}
+
+// notify будит всех, кто ожидает изменений
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// tgMessage преобразует сообщение в формат Bot API
+func (s *Server) tgMessage(message *Message) *tgbotapi.Message {
+
+	from := &tgbotapi.User{ID: message.ChatID, FirstName: "Тест"}
+	if message.FromBot {
+		from = &tgbotapi.User{ID: botID, IsBot: true, FirstName: "Центр охраны", UserName: botUserName}
+	}
+
+	tgMessage := &tgbotapi.Message{
+		MessageID: message.ID,
+		From:      from,
+		Date:      int(time.Now().Unix()),
+		Chat:      &tgbotapi.Chat{ID: message.ChatID, Type: "private", FirstName: "Тест"},
+		Text:      message.Text,
+	}
+	if len(message.InlineKeyboard) > 0 {
+		tgMessage.ReplyMarkup = &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: message.InlineKeyboard}
+	}
+	return tgMessage
+}
+
+// readFile читает файл, отправленный ботом
+func readFile(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	return io.ReadAll(file)
+}
+
+// setKeyboard разбирает клавиатуру из параметра reply_markup
+func setKeyboard(message *Message, markup string) error {
+
+	if markup == "" {
+		return nil
+	}
+
+	keyboard := struct {
+		InlineKeyboard [][]tgbotapi.InlineKeyboardButton `json:"inline_keyboard"`
+		Keyboard       [][]tgbotapi.KeyboardButton       `json:"keyboard"`
+	}{}
+	if err := json.Unmarshal([]byte(markup), &keyboard); err != nil {
+		return err
+	}
+
+	for _, row := range keyboard.InlineKeyboard {
+		for _, button := range row {
+			if button.CallbackData != nil && len(*button.CallbackData) > 64 {
+				return fmt.Errorf("BUTTON_DATA_INVALID")
+			}
+		}
+	}
+
+	message.InlineKeyboard = keyboard.InlineKeyboard
+	message.ReplyKeyboard = keyboard.Keyboard
+	return nil
+}
+
+func keyboardEqual(a, b [][]tgbotapi.InlineKeyboardButton) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	dataA, _ := json.Marshal(a)
+	dataB, _ := json.Marshal(b)
+	return string(dataA) == string(dataB)
+}
+
+// writeResponse отправляет ответ в формате Bot API
+func writeResponse(w http.ResponseWriter, status int, result any, description string) {
+
+	response := map[string]any{"ok": status == http.StatusOK}
+	if status == http.StatusOK {
+		response["result"] = result
+	} else {
+		response["error_code"] = status
+		response["description"] = description
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+)
+
+// dialogState состояние диалога с пользователем
+type dialogState string
+
+const (
+	stateAwaitingPhone     dialogState = "awaitingPhone"     //Ожидается номер телефона пользователя
+	stateAwaitingObject    dialogState = "awaitingObject"    //Ожидается пультовый номер объекта
+	stateMainMenu          dialogState = "mainMenu"          //Главное меню объекта
+	stateMyAlarmMenu       dialogState = "myAlarmMenu"       //Подменю MyAlarm
+	stateShowingResult     dialogState = "showingResult"     //Показан результат запроса, доступны кнопки "Назад" и "Завершить"
+	stateAwaitingKTSPress  dialogState = "awaitingKTSPress"  //Проверка КТС начата, ожидается нажатие КТС на объекте
+	stateAwaitingUserPhone dialogState = "awaitingUserPhone" //Ожидается телефон пользователя MyAlarm для поиска его объектов
+	stateSelectingUser     dialogState = "selectingUser"     //Выбор пользователя MyAlarm
+	stateSelectingRole     dialogState = "selectingRole"     //Выбор роли пользователя MyAlarm
+	stateSelectingKTS      dialogState = "selectingKTS"      //Выбор разрешения виртуальной КТС
+)
+
+type (
+	// stateHandler обрабатывает сообщение или нажатие кнопки в определенном состоянии диалога
+	stateHandler func(a *app, ctx context.Context, update *tgbotapi.Update, cb callbackData, operation *operation) tgbotapi.MessageConfig
+
+	// stateDefinition описывает состояние диалога: обработчик, допустимые кнопки и допустимые переходы
+	stateDefinition struct {
+		handler   stateHandler
+		callbacks []string      //Действия кнопок, допустимые в состоянии
+		next      []dialogState //Состояния, в которые допустим переход
+	}
+)
+
+// dialog описывает конечный автомат диалога с пользователем
+var dialog map[dialogState]stateDefinition
+
+// retryableRequests запросы, которые можно повторить кнопкой "Повторить", если сервер ПО "Центр охраны" не ответил.
+// Изменения пользователей MyAlarm не повторяются: выбор пользователя и роли к этому моменту уже сброшен
+var retryableRequests = []string{"ChecksKTS", "MyAlarm", "GetParts", "GetZones", "GetUsersMyAlarm", "GetUserObjectMyAlarm"}
+
+func init() {
+	dialog = map[dialogState]stateDefinition{
+		stateAwaitingPhone: {
+			handler: (*app).handleAwaitingPhone,
+			next:    []dialogState{stateAwaitingPhone, stateAwaitingObject},
+		},
+		stateAwaitingObject: {
+			handler:   (*app).handleAwaitingObject,
+			callbacks: []string{"Retry"},
+			next:      []dialogState{stateAwaitingPhone, stateAwaitingObject, stateMainMenu},
+		},
+		stateMainMenu: {
+			handler:   (*app).handleMainMenu,
+			callbacks: []string{"GetInfoObject", "GetCustomers", "ChecksKTS", "MyAlarm", "GetParts", "GetZones", "Finish"},
+			next:      []dialogState{stateMainMenu, stateMyAlarmMenu, stateShowingResult, stateAwaitingKTSPress},
+		},
+		stateMyAlarmMenu: {
+			handler:   (*app).handleMyAlarmMenu,
+			callbacks: []string{"GetUsersMyAlarm", "GetUserObjectMyAlarm", "PutDelUserMyAlarm", "PutAddUserMyAlarm", "PutChangeVirtualKTS", "Back", "Finish"},
+			next:      []dialogState{stateMainMenu, stateMyAlarmMenu, stateShowingResult, stateAwaitingUserPhone, stateSelectingUser},
+		},
+		stateShowingResult: {
+			handler:   (*app).handleShowingResult,
+			callbacks: []string{"Page", "Retry", "Back", "Finish"},
+			next:      []dialogState{stateMainMenu, stateMyAlarmMenu},
+		},
+		stateAwaitingKTSPress: {
+			handler:   (*app).handleAwaitingKTSPress,
+			callbacks: []string{"ResultCheckKTS", "Back", "Finish"},
+			next:      []dialogState{stateMainMenu, stateShowingResult, stateAwaitingKTSPress},
+		},
+		stateAwaitingUserPhone: {
+			handler:   (*app).handleAwaitingUserPhone,
+			callbacks: []string{"Back", "Finish"},
+			next:      []dialogState{stateMyAlarmMenu, stateShowingResult, stateAwaitingUserPhone},
+		},
+		stateSelectingUser: {
+			handler:   (*app).handleSelectingUser,
+			callbacks: []string{"SelectUser", "Back", "Finish"},
+			next:      []dialogState{stateMyAlarmMenu, stateShowingResult, stateSelectingRole, stateSelectingKTS},
+		},
+		stateSelectingRole: {
+			handler:   (*app).handleSelectingRole,
+			callbacks: []string{"SelectRole", "Back", "Finish"},
+			next:      []dialogState{stateMyAlarmMenu, stateShowingResult},
+		},
+		stateSelectingKTS: {
+			handler:   (*app).handleSelectingKTS,
+			callbacks: []string{"SelectKTS", "Back", "Finish"},
+			next:      []dialogState{stateMyAlarmMenu, stateShowingResult},
+		},
+	}
+}
+
+// setState переводит диалог в новое состояние. Недопустимый переход не выполняется
+func (o *operation) setState(next dialogState) {
+	if !slices.Contains(dialog[o.state].next, next) {
+		log.Printf("Недопустимый переход диалога из состояния %q в %q", o.state, next)
+		return
+	}
+	o.state = next
+}
+
+// acceptsCallback проверяет, допустима ли нажатая кнопка и выбранное ей значение в текущем состоянии диалога
+func (o *operation) acceptsCallback(cb callbackData) bool {
+
+	if !slices.Contains(dialog[o.state].callbacks, cb.action) {
+		return false
+	}
+
+	switch cb.action {
+	case "SelectUser":
+		return isSelectableUser(o, cb.target)
+	case "SelectRole":
+		return cb.target == "admin" || cb.target == "user"
+	case "SelectKTS":
+		return cb.target == "true" || cb.target == "false"
+	case "Page":
+		return isValidPage(o, cb.target)
+	case "Retry":
+		if o.state == stateAwaitingObject {
+			numberObject, _ := splitObjectNumber(cb.target)
+			_, ok := checkNumberObject(numberObject)
+			return ok
+		}
+		return slices.Contains(retryableRequests, o.currentRequest)
+	}
+	return true
+}
+
+// isSelectableUser проверяет, что пользователь был в списке, предложенном для выбора
+func isSelectableUser(operation *operation, customerId string) bool {
+
+	if operation.currentRequest == "PutAddUserMyAlarm" {
+		for _, customer := range operation.customers {
+			if customer.Id == customerId && customer.UserNumber != 0 && customer.ObjCustPhone1 != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, userMyAlarm := range operation.usersMyAlarm {
+		if userMyAlarm.CustomerID == customerId {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceCommand служебная команда инженеров. Она не прерывает работу с объектом и не убирает клавиатуру меню,
+// поэтому ответ отправляется отдельным сообщением
+type serviceCommand struct {
+	admin bool //Команда доступна только супер-администратору
+	run   func(a *app, chatID int64, operation *operation, phone, args string) tgbotapi.MessageConfig
+}
+
+var serviceCommands = map[string]serviceCommand{
+	"status": {run: func(a *app, chatID int64, _ *operation, _, _ string) tgbotapi.MessageConfig {
+		return a.statusMessage(chatID)
+	}},
+	"engineers":        {admin: true, run: (*app).engineersCommand},
+	"add_engineer":     {admin: true, run: (*app).addEngineerCommand},
+	"disable_engineer": {admin: true, run: (*app).disableEngineerCommand},
+	"set_role":         {admin: true, run: (*app).setRoleCommand},
+	"set_scope":        {admin: true, run: (*app).setScopeCommand},
+	"grant":            {run: (*app).grantCommand},
+	"revoke":           {run: (*app).revokeCommand},
+	"grants":           {run: (*app).grantsCommand},
+	"audit":            {run: (*app).auditCommand},
+}
+
+// handleCommand обрабатывает команды бота. Служебные команды выполняются без прерывания работы с объектом,
+// остальные завершают ее, как кнопка "Завершить работу с объектом", и начинают работу заново
+func (a *app) handleCommand(update *tgbotapi.Update, operation *operation) tgbotapi.MessageConfig {
+
+	chatID := update.Message.Chat.ID
+
+	if command, ok := serviceCommands[update.Message.Command()]; ok {
+		phone := a.tgUser.Phone(chatID)
+
+		var msg tgbotapi.MessageConfig
+		listMessageId := operation.commandMessageId
+		switch {
+		case command.admin && a.engineers.isAdmin(phone), !command.admin && a.engineers.isActive(phone):
+			msg = command.run(a, chatID, operation, phone, update.Message.CommandArguments())
+		case a.engineers.isActive(phone):
+			log.Printf("Отклонена команда /%s чата %d: %s не супер-администратор", update.Message.Command(), chatID, phone)
+			msg = tgbotapi.NewMessage(chatID, "Команда доступна только супер-администратору.")
+		}
+
+		//Остальным пользователям служебные команды не видны
+		if msg.Text != "" {
+			//Страницы листаются только в последнем выведенном списке
+			if listMessageId != 0 && operation.commandMessageId == 0 {
+				removeKeyboard(a.bot, chatID, listMessageId)
+			}
+			sent, err := a.bot.Send(msg)
+			if err != nil {
+				log.Printf("Не удалось отправить ответ на команду /%s в чат %d: %v", update.Message.Command(), chatID, err)
+			} else if _, inline := inlineKeyboard(msg); inline {
+				operation.commandMessageId = sent.MessageID
+			}
+			return tgbotapi.MessageConfig{}
+		}
+	}
+
+	//Команда отправителя без подтвержденного телефона не прерывает работу с объектом
+	if err := a.checkPhone(update, operation); err != nil {
+		if operation.numberObject == "" {
+			operation.setState(stateAwaitingPhone)
+		}
+		msg := phoneRejected(chatID, err)
+		msg.ReplyToMessageID = update.Message.MessageID
+		return msg
+	}
+
+	if operation.numberObject != "" {
+		text := fmt.Sprintf("Завершена работа с объектом %s", operation.numberObject)
+		*operation = *finishOperation(a.bot, chatID, operation, text)
+	} else {
+		*operation = *nextOperation(operation)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, "Введите пультовый номер объекта!")
+	msg.ReplyToMessageID = update.Message.MessageID
+	return msg
+}
+
+// handleState передает сообщение или нажатие кнопки обработчику текущего состояния диалога.
+// Кнопки чужой сессии, другого объекта или недопустимые в текущем состоянии отклоняются
+func (a *app) handleState(ctx context.Context, update *tgbotapi.Update, operation *operation) tgbotapi.MessageConfig {
+
+	var cb callbackData
+	if update.CallbackQuery != nil {
+		chatID := update.CallbackQuery.Message.Chat.ID
+
+		var err error
+		cb, err = decodeCallback(update.CallbackQuery.Data, operation)
+		if err != nil {
+			log.Printf("Отклонена кнопка чата %d: %v", chatID, err)
+			return rejectedCallback(chatID, operation, err)
+		}
+
+		//Страницы ответа на служебную команду листаются в любом состоянии диалога
+		if cb.action == "CommandPage" {
+			return a.turnCommandPage(update.CallbackQuery.Message, cb, operation)
+		}
+
+		if !operation.acceptsCallback(cb) {
+			return rejectedCallback(chatID, operation, errCallbackExpired)
+		}
+	}
+
+	//Права проверяются и при нажатии кнопок меню, выведенного до изменения роли
+	chatID := updateChatID(*update)
+	a.updatePermissions(chatID, operation)
+	if action := operation.requestedAction(cb); action != "" && !operation.permitted(action) {
+		return a.deniedAction(chatID, action, operation)
+	}
+
+	return dialog[operation.state].handler(a, ctx, update, cb, operation)
+}
+
+// rejectedCallback сообщает пользователю, что нажатая кнопка не может быть обработана, и подсказывает, что делать дальше
+func rejectedCallback(chatID int64, operation *operation, reason error) tgbotapi.MessageConfig {
+
+	text := reason.Error() + "."
+	switch operation.state {
+	case stateAwaitingPhone:
+		return requestPhone(chatID)
+	case stateAwaitingObject:
+		text += "\nВведите пультовый номер объекта!"
+	default:
+		text += "\nВоспользуйтесь кнопками последнего сообщения."
+	}
+	return tgbotapi.NewMessage(chatID, text)
+}
+
+// handleNavigation обрабатывает кнопки "Назад" и "Завершить работу с объектом"
+func (a *app) handleNavigation(chatID int64, data string, operation *operation) (tgbotapi.MessageConfig, bool) {
+
+	switch data {
+	case "Finish":
+		text := fmt.Sprintf("Завершена работа с объектом %s", operation.numberObject)
+		*operation = *finishOperation(a.bot, chatID, operation, text)
+		return tgbotapi.NewMessage(chatID, "Введите пультовый номер объекта!"), true
+	case "Back":
+		if operation.state == stateMyAlarmMenu {
+			return createMainMenu(chatID, operation), true
+		}
+		return createMenu(chatID, operation), true
+	}
+	return tgbotapi.MessageConfig{}, false
+}
+
+// handleAwaitingPhone ожидает от пользователя номер телефона
+func (a *app) handleAwaitingPhone(ctx context.Context, update *tgbotapi.Update, cb callbackData, operation *operation) tgbotapi.MessageConfig {
+
+	if err := a.checkPhone(update, operation); err != nil {
+		msg := phoneRejected(update.Message.Chat.ID, err)
+		msg.ReplyToMessageID = update.Message.MessageID
+		return msg
+	}
+
+	operation.setState(stateAwaitingObject)
+
+	//Контакт уже проверен и сохранен, номер объекта пользователь еще не ввел
+	if update.Message.Contact != nil {
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Введите пультовый номер объекта!")
+		msg.ReplyToMessageID = update.Message.MessageID
+		return msg
+	}
+	return a.handleAwaitingObject(ctx, update, cb, operation)
+}
+
+// handleAwaitingObject проверяет номер объекта и права пользователя для работы с этим объектом
+func (a *app) handleAwaitingObject(ctx context.Context, update *tgbotapi.Update, cb callbackData, operation *operation) tgbotapi.MessageConfig {
+
+	//Повтор поиска объекта, если сервер ПО "Центр охраны" не ответил
+	if update.CallbackQuery != nil {
+		return a.openObject(ctx, update.CallbackQuery.Message.Chat.ID, cb.target, 0, operation)
+	}
+
+	var msg tgbotapi.MessageConfig
+	chatID := update.Message.Chat.ID
+
+	if err := a.checkPhone(update, operation); err != nil {
+		operation.setState(stateAwaitingPhone)
+		msg = phoneRejected(chatID, err)
+		msg.ReplyToMessageID = update.Message.MessageID
+	} else if update.Message.Contact != nil {
+		msg = tgbotapi.NewMessage(chatID, "Введите пультовый номер объекта!")
+		msg.ReplyToMessageID = update.Message.MessageID
+	} else {
+		msg = a.openObject(ctx, chatID, update.Message.Text, update.Message.MessageID, operation)
+	}
+	return msg
+}
+
+// openObject начинает работу с объектом, если он найден и у пользователя есть на него права.
+// Текст может содержать название сервера ПО "Центр охраны": "1234@Север"
+func (a *app) openObject(ctx context.Context, chatID int64, input string, replyTo int, operation *operation) tgbotapi.MessageConfig {
+
+	var msg tgbotapi.MessageConfig
+	numberObject, serverName := splitObjectNumber(input)
+
+	if message, ok := checkNumberObject(numberObject); !ok {
+		text := fmt.Sprintf("%s\nВведите пультовый номер объекта!", message)
+		msg = tgbotapi.NewMessage(chatID, text)
+	} else if srv, object, err := a.findObjectOnServers(ctx, numberObject, serverName); err != nil {
+		msg = objectRequestFailed(chatID, a.objectInput(numberObject, serverName), operation, err)
+	} else if allowed, err := a.checkUserRights(object, operation, chatID, srv, &ctx); err != nil {
+		var denied *scopeError
+		if errors.As(err, &denied) {
+			a.audit(chatID, auditEntry{object: numberObject, server: srv.name, action: "OpenObject", result: auditDenied, details: "объект не закреплен за инженером, объекты: " + denied.scope.String()})
+		}
+		msg = objectRequestFailed(chatID, a.objectInput(numberObject, serverName), operation, err)
+	} else if !allowed {
+		text := fmt.Sprintf("У вас нет прав на этот объект!\nВведите пультовый номер объекта!")
+		msg = tgbotapi.NewMessage(chatID, text)
+	} else {
+		operation.server = srv.name
+		a.updatePermissions(chatID, operation)
+		a.audit(chatID, auditEntry{role: operation.userRole, object: numberObject, server: srv.name, action: "OpenObject", result: auditOK})
+		text := "Работа с объектом " + numberObject
+		if len(a.backends) > 1 {
+			text += fmt.Sprintf(" (сервер %s)", srv.name)
+		}
+		msg = tgbotapi.NewMessage(chatID, text)
+		msg.ReplyToMessageID = replyTo
+		outMsg, _ := a.bot.Send(msg)
+		pinMessage := tgbotapi.PinChatMessageConfig{
+			ChatID:              chatID,
+			MessageID:           outMsg.MessageID,
+			DisableNotification: false,
+		}
+		_, _ = a.bot.Request(pinMessage)
+		return createMainMenu(chatID, operation)
+	}
+	msg.ReplyToMessageID = replyTo
+	return msg
+}
+
+// objectRequestFailed формирует ответ на неудачный поиск объекта. Если сервер ПО "Центр охраны" не отвечает
+// или не смог выполнить запрос, поиск можно повторить кнопкой "Повторить"
+func objectRequestFailed(chatID int64, input string, operation *operation, err error) tgbotapi.MessageConfig {
+
+	if !isRetryable(err) {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("%s\nВведите пультовый номер объекта!", err))
+	}
+
+	log.Printf("Поиск объекта %s не выполнен: %v", input, err)
+	msg := tgbotapi.NewMessage(chatID, unavailableText(err)+"\nНажмите \"Повторить\" или введите пультовый номер объекта позже.")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(callbackButton(operation, "Повторить", "Retry", input)))
+	return msg
+}
+
+// handleMainMenu обрабатывает пункты главного меню объекта
+func (a *app) handleMainMenu(ctx context.Context, update *tgbotapi.Update, cb callbackData, operation *operation) tgbotapi.MessageConfig {
+
+	if update.Message != nil {
+		return createMenu(update.Message.Chat.ID, operation)
+	}
+
+	chatID := update.CallbackQuery.Message.Chat.ID
+	srv := a.backendOf(operation)
+	data := cb.action
+
+	if msg, ok := a.handleNavigation(chatID, data, operation); ok {
+		return msg
+	}
+
+	var msg tgbotapi.MessageConfig
+	switch data {
+	case "GetInfoObject":
+		operation.currentRequest = data
+		operation.setState(stateShowingResult)
+		msg = getInfoObject(*operation, chatID)
+		a.auditView(chatID, operation, data, nil)
+	case "GetCustomers":
+		operation.currentRequest = data
+		operation.setState(stateShowingResult)
+		msg = getCustomers(operation, chatID)
+		a.auditView(chatID, operation, data, nil)
+	case "ChecksKTS":
+		operation.currentRequest = data
+		msg = a.checksKTSRequest(operation, chatID, srv.confSDK, srv.client, ctx)
+	case "MyAlarm":
+		operation.currentRequest = data
+		allowed, err := haveMyAlarmRights(ctx, srv.client, srv.confSDK, operation, a.tgUser.Phone(chatID))
+		if err != nil {
+			operation.setState(stateShowingResult)
+			msg = requestFailed(chatID, operation, err, "Не удалось получить данные")
+			break
+		}
+		if allowed {
+			//Пользователи MyAlarm объекта получены: ответственное лицо может оказаться администратором MyAlarm
+			a.updatePermissions(chatID, operation)
+			return createMyAlarmMenu(chatID, operation)
+		}
+		operation.setState(stateShowingResult)
+		msg = tgbotapi.NewMessage(chatID, "У вас нет прав на работу с системой MyAlarm")
+		msg.ReplyMarkup = addButtons(operation, false, false)
+	case "GetParts":
+		operation.currentRequest = data
+		operation.setState(stateShowingResult)
+		msg = a.GetParts(operation, chatID, ctx, srv.client, srv.confSDK)
+	case "GetZones":
+		operation.currentRequest = data
+		operation.setState(stateShowingResult)
+		msg = a.GetZones(operation, chatID, ctx, srv.client, srv.confSDK)
+	}
+	msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
+	return msg
+}
+
+// handleMyAlarmMenu обрабатывает пункты подменю MyAlarm
+func (a *app) handleMyAlarmMenu(ctx context.Context, update *tgbotapi.Update, cb callbackData, operation *operation) tgbotapi.MessageConfig {
+
+	if update.Message != nil {
+		return createMenu(update.Message.Chat.ID, operation)
+	}
+
+	chatID := update.CallbackQuery.Message.Chat.ID
+	srv := a.backendOf(operation)
+	data := cb.action
+
+	if msg, ok := a.handleNavigation(chatID, data, operation); ok {
+		return msg
+	}
+
+	var msg tgbotapi.MessageConfig
+	operation.currentRequest = data
+	switch data {
+	case "GetUsersMyAlarm":
+		operation.setState(stateShowingResult)
+		msg = a.getUsersMyAlarm(ctx, srv.client, srv.confSDK, operation, chatID)
+	case "GetUserObjectMyAlarm":
+		msg = a.getUserObjectMyAlarm(chatID, operation, update, ctx, srv.client, srv.confSDK)
+	case "PutDelUserMyAlarm", "PutAddUserMyAlarm":
+		msg = a.putChangeUserMyAlarm(operation, chatID, ctx, srv.client, srv.confSDK)
+	case "PutChangeVirtualKTS":
+		msg = a.putChangeVirtualKTS(operation, chatID, ctx, srv.client, srv.confSDK)
+	}
+	msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
+	return msg
+}
+
+// handleShowingResult обрабатывает кнопки под результатом запроса
+func (a *app) handleShowingResult(ctx context.Context, update *tgbotapi.Update, cb callbackData, operation *operation) tgbotapi.MessageConfig {
+
+	if update.Message != nil {
+		return createMenu(update.Message.Chat.ID, operation)
+	}
+
+	chatID := update.CallbackQuery.Message.Chat.ID
+
+	if cb.action == "Page" {
+		operation.page, _ = strconv.Atoi(cb.target)
+		return pageMessage(chatID, operation)
+	}
+
+	if cb.action == "Retry" {
+		return a.retryRequest(ctx, update, operation)
+	}
+
+	msg, _ := a.handleNavigation(chatID, cb.action, operation)
+	return msg
+}
+
+// retryRequest повторяет запрос, не выполненный из-за недоступности сервера ПО "Центр охраны",
+// как если бы пользователь снова выбрал его в меню
+func (a *app) retryRequest(ctx context.Context, update *tgbotapi.Update, operation *operation) tgbotapi.MessageConfig {
+
+	menuState := stateMainMenu
+	if operation.currentMenu == "MyAlarmMenu" {
+		menuState = stateMyAlarmMenu
+	}
+	operation.setState(menuState)
+	return dialog[menuState].handler(a, ctx, update, callbackData{action: operation.currentRequest}, operation)
+}
+
+// handleAwaitingKTSPress обрабатывает запрос результата начатой проверки КТС
+func (a *app) handleAwaitingKTSPress(ctx context.Context, update *tgbotapi.Update, cb callbackData, operation *operation) tgbotapi.MessageConfig {
+
+	if update.Message != nil {
+		return createMenu(update.Message.Chat.ID, operation)
+	}
+
+	chatID := update.CallbackQuery.Message.Chat.ID
+	srv := a.backendOf(operation)
+	data := cb.action
+
+	if msg, ok := a.handleNavigation(chatID, data, operation); ok {
+		return msg
+	}
+
+	operation.currentRequest = data
+	msg := a.checksKTSRequest(operation, chatID, srv.confSDK, srv.client, ctx)
+	msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
+	return msg
+}
+
+// handleAwaitingUserPhone получает объекты пользователя MyAlarm по введенному инженером телефону
+func (a *app) handleAwaitingUserPhone(ctx context.Context, update *tgbotapi.Update, cb callbackData, operation *operation) tgbotapi.MessageConfig {
+
+	if update.Message != nil {
+		chatID := update.Message.Chat.ID
+		srv := a.backendOf(operation)
+		msg := a.getUserObjectMyAlarm(chatID, operation, update, ctx, srv.client, srv.confSDK)
+		msg.ReplyToMessageID = update.Message.MessageID
+		return msg
+	}
+
+	msg, _ := a.handleNavigation(update.CallbackQuery.Message.Chat.ID, cb.action, operation)
+	return msg
+}
+
+// handleSelectingUser обрабатывает выбор пользователя MyAlarm
+func (a *app) handleSelectingUser(ctx context.Context, update *tgbotapi.Update, cb callbackData, operation *operation) tgbotapi.MessageConfig {
+
+	if update.Message != nil {
+		return createMenu(update.Message.Chat.ID, operation)
+	}
+
+	chatID := update.CallbackQuery.Message.Chat.ID
+	srv := a.backendOf(operation)
+	data := cb.action
+
+	if msg, ok := a.handleNavigation(chatID, data, operation); ok {
+		return msg
+	}
+
+	var msg tgbotapi.MessageConfig
+	operation.changedUserId = cb.target
+	if operation.currentRequest == "PutChangeVirtualKTS" {
+		msg = a.putChangeVirtualKTS(operation, chatID, ctx, srv.client, srv.confSDK)
+	} else {
+		msg = a.putChangeUserMyAlarm(operation, chatID, ctx, srv.client, srv.confSDK)
+	}
+	msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
+	return msg
+}
+
+// handleSelectingRole обрабатывает выбор роли пользователя MyAlarm
+func (a *app) handleSelectingRole(ctx context.Context, update *tgbotapi.Update, cb callbackData, operation *operation) tgbotapi.MessageConfig {
+
+	if update.Message != nil {
+		return createMenu(update.Message.Chat.ID, operation)
+	}
+
+	chatID := update.CallbackQuery.Message.Chat.ID
+	srv := a.backendOf(operation)
+	data := cb.action
+
+	if msg, ok := a.handleNavigation(chatID, data, operation); ok {
+		return msg
+	}
+
+	operation.role = cb.target
+	msg := a.putChangeUserMyAlarm(operation, chatID, ctx, srv.client, srv.confSDK)
+	msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
+	return msg
+}
+
+// handleSelectingKTS обрабатывает выбор разрешения виртуальной КТС
+func (a *app) handleSelectingKTS(ctx context.Context, update *tgbotapi.Update, cb callbackData, operation *operation) tgbotapi.MessageConfig {
+
+	if update.Message != nil {
+		return createMenu(update.Message.Chat.ID, operation)
+	}
+
+	chatID := update.CallbackQuery.Message.Chat.ID
+	srv := a.backendOf(operation)
+	data := cb.action
+
+	if msg, ok := a.handleNavigation(chatID, data, operation); ok {
+		return msg
+	}
+
+	operation.role = cb.target
+	msg := a.putChangeVirtualKTS(operation, chatID, ctx, srv.client, srv.confSDK)
+	msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
+	return msg
+}
@@ -5,6 +5,7 @@ go 1.23.4
 require (
 	github.com/EkzikP/sdk_andromeda_go_v2 v0.0.0-20250311074547-bc1c5cab01f9
 	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
+	gopkg.in/yaml.v3 v3.0.1
 	modernc.org/sqlite v1.36.0
 )
 
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultGrantNotice = 60                 //Предупреждение об окончании временного доступа по умолчанию, мин.
+	maxGrantDuration   = 7 * 24 * time.Hour //Наибольший срок временного доступа
+	actionGrant        = "Grant"            //Выдача временного доступа командами /grant, /revoke и /grants
+	actionRevoke       = "Revoke"           //Отзыв временного доступа, действие журнала аудита
+)
+
+type (
+	// grant временный доступ пользователя к объекту
+	grant struct {
+		id        int64
+		phone     string
+		object    string //Пультовый номер объекта
+		server    string //Название сервера ПО "Центр охраны", на котором находится объект
+		grantedBy string //Телефон инженера, выдавшего доступ
+		createdAt time.Time
+		expiresAt time.Time
+		revokedBy string //Телефон инженера, отозвавшего доступ
+		notified  bool   //Пользователь предупрежден об окончании доступа
+	}
+
+	GrantsStore struct {
+		db *sql.DB
+	}
+
+	// grantTimers хранит таймеры предупреждений и сообщений об окончании временных доступов по идентификатору
+	// доступа. Безопасен для использования из нескольких горутин. Нулевое значение готово к использованию
+	grantTimers struct {
+		mu      sync.Mutex
+		items   map[int64]*grantTimer
+		running sync.WaitGroup //Выполняемые действия таймеров
+		stopped bool           //Таймеры остановлены при остановке бота, новые не запускаются
+	}
+
+	// grantTimer таймеры одного временного доступа
+	grantTimer struct {
+		notice *time.Timer //Предупреждение об окончании доступа, nil, если пользователь уже предупрежден
+		expiry *time.Timer //Сообщение об окончании доступа
+	}
+)
+
+func NewGrantsStore(db *sql.DB) GrantsStore {
+	return GrantsStore{db: db}
+}
+
+// grantColumns поля временного доступа в порядке scanGrant
+const grantColumns = "id, phone, object, server, grantedBy, createdAt, expiresAt, revokedBy, notified"
+
+// scanGrant читает временный доступ из строки результата запроса
+func scanGrant(row interface{ Scan(...any) error }) (grant, error) {
+	var g grant
+	var createdAt, expiresAt int64
+	err := row.Scan(&g.id, &g.phone, &g.object, &g.server, &g.grantedBy, &createdAt, &expiresAt, &g.revokedBy, &g.notified)
+	g.createdAt, g.expiresAt = time.Unix(createdAt, 0), time.Unix(expiresAt, 0)
+	return g, err
+}
+
+// Add сохраняет временный доступ и возвращает его с идентификатором
+func (s GrantsStore) Add(g grant) (grant, error) {
+	result, err := s.db.Exec("INSERT INTO grants (phone, object, server, grantedBy, createdAt, expiresAt) VALUES (:phone, :object, :server, :grantedBy, :createdAt, :expiresAt)",
+		sql.Named("phone", g.phone),
+		sql.Named("object", g.object),
+		sql.Named("server", g.server),
+		sql.Named("grantedBy", g.grantedBy),
+		sql.Named("createdAt", g.createdAt.Unix()),
+		sql.Named("expiresAt", g.expiresAt.Unix()))
+	if err != nil {
+		return grant{}, err
+	}
+	g.id, err = result.LastInsertId()
+	return g, err
+}
+
+// Get возвращает временный доступ по идентификатору
+func (s GrantsStore) Get(id int64) (grant, error) {
+	return scanGrant(s.db.QueryRow("SELECT "+grantColumns+" FROM grants WHERE id = :id", sql.Named("id", id)))
+}
+
+// Active возвращает действующий временный доступ пользователя к объекту сервера server с самым поздним окончанием
+func (s GrantsStore) Active(phone, object, server string) (grant, bool, error) {
+	row := s.db.QueryRow("SELECT "+grantColumns+" FROM grants WHERE phone = :phone AND object = :object AND server = :server AND expiresAt > :now "+
+		"ORDER BY expiresAt DESC LIMIT 1",
+		sql.Named("phone", phone),
+		sql.Named("object", object),
+		sql.Named("server", server),
+		sql.Named("now", time.Now().Unix()))
+	g, err := scanGrant(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return grant{}, false, nil
+	}
+	return g, err == nil, err
+}
+
+// AllActive возвращает все действующие временные доступы по времени окончания
+func (s GrantsStore) AllActive() ([]grant, error) {
+
+	rows, err := s.db.Query("SELECT "+grantColumns+" FROM grants WHERE expiresAt > :now ORDER BY expiresAt", sql.Named("now", time.Now().Unix()))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var grants []grant
+	for rows.Next() {
+		g, err := scanGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// Revoke отзывает действующие временные доступы пользователя к объекту сервера server и возвращает их количество
+func (s GrantsStore) Revoke(phone, object, server, revokedBy string) (int64, error) {
+	result, err := s.db.Exec("UPDATE grants SET expiresAt = :now, revokedBy = :revokedBy WHERE phone = :phone AND object = :object AND server = :server AND expiresAt > :now",
+		sql.Named("phone", phone),
+		sql.Named("object", object),
+		sql.Named("server", server),
+		sql.Named("revokedBy", revokedBy),
+		sql.Named("now", time.Now().Unix()))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SetNotified отмечает, что пользователь предупрежден об окончании временного доступа
+func (s GrantsStore) SetNotified(id int64) error {
+	_, err := s.db.Exec("UPDATE grants SET notified = 1 WHERE id = :id", sql.Named("id", id))
+	return err
+}
+
+// hasGrant проверяет, что у пользователя есть действующий временный доступ к объекту сервера server
+func (a *app) hasGrant(phone, server, numberObject string) bool {
+	_, ok, err := a.grants.Active(phone, numberObject, server)
+	if err != nil {
+		log.Printf("Не удалось проверить временный доступ %s к объекту %s сервера %q: %v", phone, numberObject, server, err)
+	}
+	return ok
+}
+
+// grantObject возвращает описание объекта временного доступа для сообщений: номер и, если серверов несколько, сервер
+func (a *app) grantObject(g grant) string {
+	return a.objectTitle(g.object, g.server)
+}
+
+// scheduleGrants планирует предупреждения об окончании действующих временных доступов после запуска бота
+// и при изменении grant_notice. Ранее запланированные таймеры доступов заменяются
+func (a *app) scheduleGrants() {
+
+	grants, err := a.grants.AllActive()
+	if err != nil {
+		log.Printf("Не удалось получить временные доступы: %v", err)
+		return
+	}
+	for _, g := range grants {
+		a.scheduleGrant(g)
+	}
+}
+
+// scheduleGrant планирует предупреждение пользователя за grant_notice минут до окончания временного доступа
+// и сообщение об окончании доступа
+func (a *app) scheduleGrant(g grant) {
+
+	var notice time.Duration
+	if !g.notified {
+		notice = max(time.Until(g.expiresAt.Add(-time.Duration(a.settings().GrantNotice)*time.Minute)), 0)
+	}
+	a.grantTimers.schedule(g, notice, a.grantExpiring, a.grantExpired)
+}
+
+// schedule заменяет таймеры временного доступа g: expiring выполняется через notice (если пользователь
+// еще не предупрежден), expired — в момент окончания доступа
+func (t *grantTimers) schedule(g grant, notice time.Duration, expiring, expired func(grant)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return
+	}
+	if t.items == nil {
+		t.items = make(map[int64]*grantTimer)
+	}
+	if timer, ok := t.items[g.id]; ok {
+		timer.stop()
+	}
+
+	timer := &grantTimer{}
+	if !g.notified {
+		timer.notice = time.AfterFunc(notice, func() { t.run(func() { expiring(g) }) })
+	}
+	timer.expiry = time.AfterFunc(time.Until(g.expiresAt), func() {
+		t.run(func() { expired(g) })
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.items[g.id] == timer {
+			delete(t.items, g.id)
+		}
+	})
+	t.items[g.id] = timer
+}
+
+// run выполняет действие таймера, если таймеры не остановлены. Остановка дожидается выполняемых действий
+func (t *grantTimers) run(action func()) {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return
+	}
+	t.running.Add(1)
+	t.mu.Unlock()
+
+	defer t.running.Done()
+	action()
+}
+
+// stop останавливает все таймеры и дожидается завершения уже выполняемых действий,
+// чтобы они не обращались к закрытой БД
+func (t *grantTimers) stop() {
+	t.mu.Lock()
+	t.stopped = true
+	for _, timer := range t.items {
+		timer.stop()
+	}
+	t.items = nil
+	t.mu.Unlock()
+
+	t.running.Wait()
+}
+
+// stop останавливает таймеры временного доступа
+func (t *grantTimer) stop() {
+	if t.notice != nil {
+		t.notice.Stop()
+	}
+	t.expiry.Stop()
+}
+
+// grantExpiring предупреждает пользователя о скором окончании временного доступа,
+// если доступ не отозван и не продлен новым доступом
+func (a *app) grantExpiring(g grant) {
+
+	current, ok, err := a.grants.Active(g.phone, g.object, g.server)
+	if err != nil || !ok || current.id != g.id {
+		return
+	}
+
+	a.notifyUser(g.phone, fmt.Sprintf("Временный доступ к объекту %s закончится %s.", a.grantObject(g), g.expiresAt.Format("02/01/2006 в 15:04")))
+	if err = a.grants.SetNotified(g.id); err != nil {
+		log.Printf("Не удалось отметить предупреждение об окончании временного доступа %s к объекту %s: %v", g.phone, g.object, err)
+	}
+}
+
+// grantExpired сообщает пользователю об окончании временного доступа, если доступ не отозван раньше
+// и не продлен новым доступом. Работа с объектом завершается при следующем действии пользователя
+func (a *app) grantExpired(g grant) {
+
+	if a.hasGrant(g.phone, g.server, g.object) {
+		return
+	}
+	if g, err := a.grants.Get(g.id); err != nil || g.revokedBy != "" {
+		return
+	}
+
+	log.Printf("Закончился временный доступ %s к объекту %s сервера %q", g.phone, g.object, g.server)
+	a.notifyUser(g.phone, fmt.Sprintf("Временный доступ к объекту %s закончился.", a.grantObject(g)))
+}
+
+// notifyUser отправляет сообщение во все чаты пользователя с телефоном phone и возвращает количество чатов
+func (a *app) notifyUser(phone, text string) int {
+
+	chatIDs, err := a.store.ChatIDs(phone)
+	if err != nil {
+		log.Printf("Не удалось получить чаты пользователя %s: %v", phone, err)
+		return 0
+	}
+	for _, chatID := range chatIDs {
+		if _, err = a.bot.Send(tgbotapi.NewMessage(chatID, text)); err != nil {
+			log.Printf("Не удалось отправить сообщение в чат %d: %v", chatID, err)
+		}
+	}
+	return len(chatIDs)
+}
+
+// parseGrantDuration разбирает срок временного доступа: "24h", "90m", "2d"
+func parseGrantDuration(text string) (time.Duration, error) {
+
+	if days, ok := strings.CutSuffix(text, "d"); ok {
+		number, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(number) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(text)
+}
+
+// canGrant проверяет, что инженер может выдавать временный доступ к объекту number сервера server.
+// Возвращает текст отказа
+func (a *app) canGrant(phone, server string, number int) (string, bool) {
+
+	e, ok := a.engineers.Get(phone)
+	if !ok || !e.active || !slices.Contains(a.settings().Roles[e.role], actionGrant) {
+		return fmt.Sprintf("Выдача временного доступа недоступна для роли «%s».", roleName(e.role)), false
+	}
+	if scope := a.engineerScope(e); !scope.covers(server, number) {
+		return fmt.Sprintf("Объект %d не закреплен за вами. Ваши объекты: %s", number, scope), false
+	}
+	return "", true
+}
+
+// grantArgs разбирает телефон пользователя, номер объекта и название сервера команд /grant и /revoke: +7XXXXXXXXXX 1234@Север
+func grantArgs(fields []string) (string, int, string, bool) {
+
+	if len(fields) < 2 {
+		return "", 0, "", false
+	}
+	phone, err := checkFormatPhone(fields[0])
+	if err != nil || !phoneFormat.MatchString(phone) {
+		return "", 0, "", false
+	}
+	numberObject, server := splitObjectNumber(fields[1])
+	if _, ok := checkNumberObject(numberObject); !ok {
+		return "", 0, "", false
+	}
+	number, _ := strconv.Atoi(numberObject)
+	return phone, number, server, true
+}
+
+// grantCommand выдает временный доступ к объекту по команде /grant +7XXXXXXXXXX 1234 24h.
+// Сервер объекта указывается после номера: /grant +7XXXXXXXXXX 1234@Север 24h
+func (a *app) grantCommand(chatID int64, _ *operation, phone, args string) tgbotapi.MessageConfig {
+
+	usage := "Введите: /grant +7xxxxxxxxxx номер_объекта срок\nСрок: 30m, 8h, 2d, не более 7 суток"
+	if len(a.backends) > 1 {
+		usage += "\nСервер объекта: /grant +7xxxxxxxxxx номер_объекта@сервер срок"
+	}
+
+	fields := strings.Fields(args)
+	userPhone, number, serverName, ok := grantArgs(fields)
+	if !ok || len(fields) != 3 {
+		return tgbotapi.NewMessage(chatID, "Неверный формат команды.\n"+usage)
+	}
+	duration, err := parseGrantDuration(fields[2])
+	if err != nil || duration <= 0 || duration > maxGrantDuration {
+		return tgbotapi.NewMessage(chatID, "Неверный срок доступа.\n"+usage)
+	}
+	srv, text := a.objectServer(number, serverName)
+	if srv == nil {
+		return tgbotapi.NewMessage(chatID, text)
+	}
+	if text, ok := a.canGrant(phone, srv.name, number); !ok {
+		return tgbotapi.NewMessage(chatID, text)
+	}
+	if a.engineers.isActive(userPhone) {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("%s - инженер, временный доступ ему не нужен.", userPhone))
+	}
+
+	now := time.Now()
+	g, err := a.grants.Add(grant{phone: userPhone, object: strconv.Itoa(number), server: srv.name, grantedBy: phone, createdAt: now, expiresAt: now.Add(duration)})
+	if err != nil {
+		log.Printf("Не удалось выдать временный доступ %s к объекту %d сервера %q: %v", userPhone, number, srv.name, err)
+		return tgbotapi.NewMessage(chatID, "Не удалось сохранить изменения, попробуйте позже.")
+	}
+
+	until := g.expiresAt.Format("02/01/2006 15:04")
+	a.audit(chatID, auditEntry{object: g.object, server: g.server, action: actionGrant, target: userPhone, result: auditOK, details: "до " + until})
+
+	text = fmt.Sprintf("Пользователю %s выдан временный доступ к объекту %s до %s.", userPhone, a.grantObject(g), until)
+	if a.notifyUser(userPhone, fmt.Sprintf("Вам выдан временный доступ к объекту %s до %s.\nДля работы с объектом введите его пультовый номер.", a.grantObject(g), until)) == 0 {
+		text += "\nПользователь еще не работал с ботом: для входа ему нужно отправить боту /start и свой номер телефона."
+	}
+	a.scheduleGrant(g)
+	return tgbotapi.NewMessage(chatID, text)
+}
+
+// revokeCommand отзывает временный доступ к объекту по команде /revoke +7XXXXXXXXXX 1234
+func (a *app) revokeCommand(chatID int64, _ *operation, phone, args string) tgbotapi.MessageConfig {
+
+	fields := strings.Fields(args)
+	userPhone, number, serverName, ok := grantArgs(fields)
+	if !ok || len(fields) != 2 {
+		return tgbotapi.NewMessage(chatID, "Неверный формат команды.\nВведите: /revoke +7xxxxxxxxxx номер_объекта")
+	}
+	srv, text := a.objectServer(number, serverName)
+	if srv == nil {
+		return tgbotapi.NewMessage(chatID, text)
+	}
+	if text, ok := a.canGrant(phone, srv.name, number); !ok {
+		return tgbotapi.NewMessage(chatID, text)
+	}
+
+	g := grant{phone: userPhone, object: strconv.Itoa(number), server: srv.name}
+	revoked, err := a.grants.Revoke(g.phone, g.object, g.server, phone)
+	switch {
+	case err != nil:
+		log.Printf("Не удалось отозвать временный доступ %s к объекту %s сервера %q: %v", g.phone, g.object, g.server, err)
+		return tgbotapi.NewMessage(chatID, "Не удалось сохранить изменения, попробуйте позже.")
+	case revoked == 0:
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("У пользователя %s нет временного доступа к объекту %s.", g.phone, a.grantObject(g)))
+	}
+
+	a.audit(chatID, auditEntry{object: g.object, server: g.server, action: actionRevoke, target: g.phone, result: auditOK})
+	a.notifyUser(g.phone, fmt.Sprintf("Временный доступ к объекту %s отозван.", a.grantObject(g)))
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("Временный доступ %s к объекту %s отозван.", g.phone, a.grantObject(g)))
+}
+
+// grantsCommand выводит действующие временные доступы к объектам, закрепленным за инженером, по команде /grants
+func (a *app) grantsCommand(chatID int64, operation *operation, phone, _ string) tgbotapi.MessageConfig {
+
+	grants, err := a.grants.AllActive()
+	if err != nil {
+		log.Printf("Не удалось получить временные доступы: %v", err)
+		return tgbotapi.NewMessage(chatID, "Не удалось получить данные, попробуйте позже.")
+	}
+
+	var items []string
+	for _, g := range grants {
+		number, _ := strconv.Atoi(g.object)
+		if _, ok := a.canGrant(phone, g.server, number); !ok {
+			continue
+		}
+		grantedBy := g.grantedBy
+		if e, ok := a.engineers.Get(g.grantedBy); ok {
+			grantedBy = e.name
+		}
+		items = append(items, fmt.Sprintf("%s, объект %s\nДо %s, выдал %s", g.phone, a.grantObject(g), g.expiresAt.Format("02/01/2006 15:04"), grantedBy))
+	}
+
+	if len(items) == 0 {
+		return tgbotapi.NewMessage(chatID, "Действующих временных доступов нет.")
+	}
+	return commandListMessage(chatID, operation, "Временные доступы:", items)
+}
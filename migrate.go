@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// migrationFiles миграции схемы БД. Файл миграции называется "<версия>_<название>.sql", например "0003_audit.sql".
+// Примененную миграцию нельзя изменять: изменения схемы добавляются новой миграцией
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration миграция схемы БД
+type migration struct {
+	version int
+	name    string
+	query   string
+}
+
+// String возвращает имя миграции для журнала: "0002_sessions"
+func (m migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.version, m.name)
+}
+
+// loadMigrations читает миграции, встроенные в бота, в порядке версий
+func loadMigrations() ([]migration, error) {
+
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	//fs.Glob возвращает файлы по алфавиту, то есть по возрастанию версий
+	migrations := make([]migration, 0, len(files))
+	for _, file := range files {
+		version, name, ok := strings.Cut(strings.TrimSuffix(path.Base(file), ".sql"), "_")
+		number, err := strconv.Atoi(version)
+		if !ok || err != nil {
+			return nil, errors.Errorf("неверное имя файла миграции %s", file)
+		}
+		if number != len(migrations)+1 {
+			return nil, errors.Errorf("миграция %s: ожидалась версия %d", file, len(migrations)+1)
+		}
+
+		query, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: number, name: name, query: string(query)})
+	}
+	return migrations, nil
+}
+
+// migrateDB приводит схему БД к последней версии и возвращает версию схемы до миграции и примененные миграции.
+// Миграции применяются в одной транзакции: при ошибке схема остается прежней.
+// При dryRun миграции выполняются, но транзакция отменяется, так проверяется, что они применимы к БД
+func migrateDB(db *sql.DB, dryRun bool) (int, []migration, error) {
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version   INTEGER PRIMARY KEY,
+		name      TEXT    NOT NULL,
+		appliedAt INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var version int
+	if err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, nil, err
+	}
+	if version > len(migrations) {
+		return version, nil, errors.Errorf("версия схемы БД %d новее версии %d, известной боту: обновите бота", version, len(migrations))
+	}
+
+	pending := migrations[version:]
+	for _, m := range pending {
+		if _, err = tx.Exec(m.query); err != nil {
+			return version, nil, errors.Wrapf(err, "миграция %s не применена", m)
+		}
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name, appliedAt) VALUES (:version, :name, :appliedAt)",
+			sql.Named("version", m.version),
+			sql.Named("name", m.name),
+			sql.Named("appliedAt", time.Now().Unix()))
+		if err != nil {
+			return version, nil, err
+		}
+	}
+
+	if dryRun {
+		return version, pending, nil
+	}
+	return version, pending, tx.Commit()
+}
+
+// sqliteDSN возвращает строку подключения к БД. Обработчики чатов пишут в БД одновременно:
+// без ожидания запись в занятую БД завершается ошибкой SQLITE_BUSY
+func sqliteDSN(dbPath string) string {
+	return fmt.Sprintf("%s?_pragma=busy_timeout(%d)", dbPath, dbBusyTimeout)
+}
+
+// openDB открывает БД и приводит ее схему к последней версии
+func openDB(dbPath string) (*sql.DB, error) {
+
+	db, err := sql.Open("sqlite", sqliteDSN(dbPath))
+	if err != nil {
+		return nil, err
+	}
+
+	version, applied, err := migrateDB(db, false)
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrapf(err, "не удалось обновить схему БД %s", dbPath)
+	}
+	if len(applied) > 0 {
+		log.Printf("Схема БД %s обновлена с версии %d до версии %d: %s", dbPath, version, applied[len(applied)-1].version, migrationNames(applied))
+	}
+	return db, nil
+}
+
+// migrationNames возвращает имена миграций через запятую
+func migrationNames(migrations []migration) string {
+	names := make([]string, 0, len(migrations))
+	for _, m := range migrations {
+		names = append(names, m.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// runMigrate выполняет команду migrate: обновляет схему БД без запуска бота.
+// Путь к БД берется из параметра -db или из настроек бота
+func runMigrate(configPath string, args []string) error {
+
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "показать миграции, которые будут применены, и проверить их без изменения БД")
+	dbPath := flags.String("db", "", "файл БД, по умолчанию db_path из настроек")
+	_ = flags.Parse(args)
+
+	if *dbPath == "" {
+		configuration, err := readConfig(configPath)
+		if err != nil {
+			return err
+		}
+		*dbPath = configuration.DBPath
+	}
+
+	db, err := sql.Open("sqlite", sqliteDSN(*dbPath))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+
+	version, pending, err := migrateDB(db, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("БД %s: версия схемы %d\n", *dbPath, version)
+	switch {
+	case len(pending) == 0:
+		fmt.Println("Схема БД актуальна, новых миграций нет")
+	case *dryRun:
+		fmt.Println("Будут применены миграции (проверены, БД не изменена):")
+		for _, m := range pending {
+			fmt.Printf("\n-- %s\n%s", m, m.query)
+		}
+	default:
+		fmt.Printf("Применены миграции: %s\nВерсия схемы: %d\n", migrationNames(pending), pending[len(pending)-1].version)
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+-- Пользователи бота: телефон, подтвержденный контактом Telegram.
+-- IF NOT EXISTS: в БД, созданных до появления миграций, таблица уже есть
+CREATE TABLE IF NOT EXISTS users (
+	chatId INTEGER PRIMARY KEY,
+	phone  TEXT    NOT NULL
+);
@@ -0,0 +1,6 @@
+-- Сессии чатов, сохраняемые между перезапусками бота
+CREATE TABLE IF NOT EXISTS sessions (
+	chatId    INTEGER PRIMARY KEY,
+	data      TEXT    NOT NULL,
+	updatedAt INTEGER NOT NULL
+);
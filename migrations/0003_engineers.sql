@@ -0,0 +1,21 @@
+-- Инженеры ПО "Центр охраны". Список заполняется из phone_engineer и super_admins настроек бота,
+-- затем ведется супер-администраторами командами бота
+CREATE TABLE engineers (
+	phone     TEXT    PRIMARY KEY,
+	name      TEXT    NOT NULL,
+	role      TEXT    NOT NULL,
+	active    INTEGER NOT NULL DEFAULT 1,
+	changedBy TEXT    NOT NULL,
+	changedAt INTEGER NOT NULL
+);
+
+-- История изменений списка инженеров: кто, когда и что изменил
+CREATE TABLE engineer_changes (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	phone     TEXT    NOT NULL,
+	details   TEXT    NOT NULL,
+	changedBy TEXT    NOT NULL,
+	changedAt INTEGER NOT NULL
+);
+
+CREATE INDEX engineer_changes_phone ON engineer_changes (phone);
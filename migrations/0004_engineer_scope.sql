@@ -0,0 +1,3 @@
+-- Объекты, закрепленные за инженером: диапазоны пультовых номеров, номера и группы объектов через запятую.
+-- Пустая строка - все объекты
+ALTER TABLE engineers ADD COLUMN scope TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,17 @@
+-- Журнал аудита: действия пользователей с объектами и отказы в доступе.
+-- Объекты разных серверов ПО "Центр охраны" могут иметь одинаковые номера, поэтому записи хранят сервер объекта
+CREATE TABLE audit (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	chatId    INTEGER NOT NULL,
+	phone     TEXT    NOT NULL,
+	role      TEXT    NOT NULL,
+	object    TEXT    NOT NULL,
+	server    TEXT    NOT NULL DEFAULT '',
+	action    TEXT    NOT NULL,
+	target    TEXT    NOT NULL,
+	result    TEXT    NOT NULL,
+	details   TEXT    NOT NULL,
+	createdAt INTEGER NOT NULL
+);
+
+CREATE INDEX audit_object ON audit (object, server, createdAt);
@@ -0,0 +1,16 @@
+-- Временный доступ пользователя к объекту, выданный инженером командой /grant.
+-- Объекты разных серверов ПО "Центр охраны" могут иметь одинаковые номера, поэтому доступ выдается к объекту сервера.
+-- Доступ действует до expiresAt, отзыв доступа переносит expiresAt на время отзыва
+CREATE TABLE grants (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	phone     TEXT    NOT NULL,
+	object    TEXT    NOT NULL,
+	server    TEXT    NOT NULL DEFAULT '',
+	grantedBy TEXT    NOT NULL,
+	createdAt INTEGER NOT NULL,
+	expiresAt INTEGER NOT NULL,
+	revokedBy TEXT    NOT NULL DEFAULT '',
+	notified  INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX grants_phone_object ON grants (phone, object, server, expiresAt);
@@ -0,0 +1,10 @@
+-- Журнал аудита только пополняется: записи нельзя изменить или удалить
+CREATE TRIGGER audit_no_update BEFORE UPDATE ON audit
+BEGIN
+	SELECT RAISE(ABORT, 'журнал аудита нельзя изменять');
+END;
+
+CREATE TRIGGER audit_no_delete BEFORE DELETE ON audit
+BEGIN
+	SELECT RAISE(ABORT, 'записи журнала аудита нельзя удалять');
+END;
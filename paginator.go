@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	pageMaxLength = 3500   //Максимальная длина страницы списка, символов. Ограничение Telegram 4096 символов
+	pageSeparator = "\n\n" //Разделитель записей списка на странице
+)
+
+// paginate разбивает записи списка на страницы, не превышающие pageMaxLength символов.
+// Запись длиннее страницы разбивается на несколько страниц
+func paginate(items []string) []string {
+
+	var pages []string
+	var page strings.Builder
+	pageLength := 0
+
+	for _, item := range items {
+		itemLength := len([]rune(item))
+
+		if pageLength > 0 && pageLength+len(pageSeparator)+itemLength > pageMaxLength {
+			pages = append(pages, page.String())
+			page.Reset()
+			pageLength = 0
+		}
+
+		for itemLength > pageMaxLength {
+			runes := []rune(item)
+			pages = append(pages, string(runes[:pageMaxLength]))
+			item = string(runes[pageMaxLength:])
+			itemLength -= pageMaxLength
+		}
+
+		if pageLength > 0 {
+			page.WriteString(pageSeparator)
+			pageLength += len(pageSeparator)
+		}
+		page.WriteString(item)
+		pageLength += itemLength
+	}
+
+	if pageLength > 0 {
+		pages = append(pages, page.String())
+	}
+	return pages
+}
+
+// listMessage сохраняет страницы списка в сессии и возвращает сообщение с первой страницей
+func listMessage(chatID int64, operation *operation, items []string) tgbotapi.MessageConfig {
+	operation.pages = paginate(items)
+	operation.page = 0
+	return pageMessage(chatID, operation)
+}
+
+// pageMessage формирует сообщение с текущей страницей списка, кнопками перехода между страницами
+// и кнопками "Назад" и "Завершить работу с объектом"
+func pageMessage(chatID int64, operation *operation) tgbotapi.MessageConfig {
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup()
+
+	if len(operation.pages) == 0 {
+		msg := tgbotapi.NewMessage(chatID, "Список пуст")
+		msg.ReplyMarkup = addButtons(operation, false, false)
+		return msg
+	}
+
+	text := operation.pages[operation.page]
+	if len(operation.pages) > 1 {
+		text = fmt.Sprintf("Страница %d из %d\n\n%s", operation.page+1, len(operation.pages), text)
+
+		var row []tgbotapi.InlineKeyboardButton
+		if operation.page > 0 {
+			row = append(row, callbackButton(operation, "◀", "Page", strconv.Itoa(operation.page-1)))
+		}
+		if operation.page < len(operation.pages)-1 {
+			row = append(row, callbackButton(operation, "▶", "Page", strconv.Itoa(operation.page+1)))
+		}
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, row)
+	}
+
+	keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, addButtons(operation, false, false).InlineKeyboard...)
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = &keyboard
+	return msg
+}
+
+// isValidPage проверяет, что страница есть в сохраненном списке
+func isValidPage(operation *operation, page string) bool {
+	num, err := strconv.Atoi(page)
+	return err == nil && num >= 0 && num < len(operation.pages)
+}
+
+// commandListMessage сохраняет страницы ответа на служебную команду в сессии и возвращает сообщение с первой страницей.
+// Страницы хранятся отдельно от списков объекта, чтобы служебная команда не прерывала работу с объектом.
+// Заголовок ответа выводится на каждой странице
+func commandListMessage(chatID int64, operation *operation, title string, items []string) tgbotapi.MessageConfig {
+	operation.commandPages = paginate(items)
+	for i, page := range operation.commandPages {
+		operation.commandPages[i] = title + "\n\n" + page
+	}
+	operation.commandPage = 0
+	operation.commandMessageId = 0
+	return commandPageMessage(chatID, operation)
+}
+
+// commandPageMessage формирует сообщение с текущей страницей ответа на служебную команду и кнопками перехода между страницами
+func commandPageMessage(chatID int64, operation *operation) tgbotapi.MessageConfig {
+
+	text := operation.commandPages[operation.commandPage]
+	if len(operation.commandPages) == 1 {
+		return tgbotapi.NewMessage(chatID, text)
+	}
+
+	var row []tgbotapi.InlineKeyboardButton
+	if operation.commandPage > 0 {
+		row = append(row, callbackButton(operation, "◀", "CommandPage", strconv.Itoa(operation.commandPage-1)))
+	}
+	if operation.commandPage < len(operation.commandPages)-1 {
+		row = append(row, callbackButton(operation, "▶", "CommandPage", strconv.Itoa(operation.commandPage+1)))
+	}
+
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Страница %d из %d\n\n%s", operation.commandPage+1, len(operation.commandPages), text))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(row)
+	return msg
+}
+
+// turnCommandPage показывает в сообщении со страницами ответа на служебную команду выбранную страницу.
+// Листать можно только последний выведенный ответ
+func (a *app) turnCommandPage(message *tgbotapi.Message, cb callbackData, operation *operation) tgbotapi.MessageConfig {
+
+	page, err := strconv.Atoi(cb.target)
+	if message.MessageID != operation.commandMessageId || err != nil || page < 0 || page >= len(operation.commandPages) {
+		removeKeyboard(a.bot, message.Chat.ID, message.MessageID)
+		return rejectedCallback(message.Chat.ID, operation, errCallbackExpired)
+	}
+
+	operation.commandPage = page
+	msg := commandPageMessage(message.Chat.ID, operation)
+	keyboard, _ := inlineKeyboard(msg)
+
+	edit := tgbotapi.NewEditMessageText(message.Chat.ID, message.MessageID, msg.Text)
+	edit.ReplyMarkup = keyboard
+	if _, err := a.bot.Request(edit); err != nil && !isNotModified(err) {
+		log.Printf("Не удалось изменить сообщение %d чата %d: %v", message.MessageID, message.Chat.ID, err)
+	}
+	return tgbotapi.MessageConfig{}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+
+	long := strings.Repeat("ж", pageMaxLength)
+	half := strings.Repeat("a", pageMaxLength/2)
+
+	tests := []struct {
+		name  string
+		items []string
+		want  []string
+	}{
+		{name: "пустой список", items: nil, want: nil},
+		{name: "одна страница", items: []string{"a", "b"}, want: []string{"a" + pageSeparator + "b"}},
+		{name: "запись не помещается на страницу", items: []string{half, half, "b"}, want: []string{half, half + pageSeparator + "b"}},
+		{name: "запись длиннее страницы", items: []string{long + "жж", "b"}, want: []string{long, "жж" + pageSeparator + "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := paginate(tt.items)
+			if len(got) != len(tt.want) {
+				t.Fatalf("страниц %d, ожидалось %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("страница %d: %q, ожидалось %q", i+1, got[i], tt.want[i])
+				}
+				if n := len([]rune(got[i])); n > pageMaxLength {
+					t.Errorf("страница %d длиной %d символов превышает %d", i+1, n, pageMaxLength)
+				}
+			}
+		})
+	}
+}
+
+func TestCommandListMessage(t *testing.T) {
+
+	setCallbackKey(config{CallbackSecret: "test"})
+	operation := newOperation()
+	items := []string{strings.Repeat("a", pageMaxLength), "b"}
+
+	msg := commandListMessage(1, operation, "Инженеры:", items)
+	if !strings.HasPrefix(msg.Text, "Страница 1 из 2\n\nИнженеры:\n\n") {
+		t.Errorf("первая страница: %.40q", msg.Text)
+	}
+	if _, inline := inlineKeyboard(msg); !inline {
+		t.Error("нет кнопок перехода между страницами")
+	}
+
+	operation.commandPage = 1
+	msg = commandPageMessage(1, operation)
+	if msg.Text != "Страница 2 из 2\n\nИнженеры:\n\nb" {
+		t.Errorf("вторая страница: %q", msg.Text)
+	}
+
+	msg = commandListMessage(1, operation, "Инженеры:", []string{"b"})
+	if msg.Text != "Инженеры:\n\nb" || msg.ReplyMarkup != nil {
+		t.Errorf("единственная страница: %q, клавиатура %v", msg.Text, msg.ReplyMarkup)
+	}
+}
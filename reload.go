@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+const defaultReloadInterval = 10 //Интервал проверки изменения файла настроек по умолчанию, сек.
+
+// liveSettings настройки, которые применяются без перезапуска бота. Остальные настройки
+// (токен бота, серверы ПО "Центр охраны", способ получения обновлений и т.д.) меняются только перезапуском
+var liveSettings = map[string]bool{
+	"phone_engineer":           true,
+	"super_admins":             true,
+	"session_timeout_engineer": true,
+	"session_timeout_customer": true,
+	"shutdown_timeout":         true,
+	"notify_restart":           true,
+	"update_timeout":           true,
+	"roles":                    true,
+	"object_groups":            true,
+	"grant_notice":             true,
+}
+
+// configWatcher отслеживает изменение файла настроек по времени изменения и размеру
+type configWatcher struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// newConfigWatcher запоминает текущее состояние файла настроек
+func newConfigWatcher(path string) *configWatcher {
+	w := &configWatcher{path: path}
+	w.changed()
+	return w
+}
+
+// changed проверяет, изменился ли файл настроек с прошлой проверки
+func (w *configWatcher) changed() bool {
+
+	info, err := os.Stat(w.path)
+	if err != nil {
+		//Файл может временно отсутствовать, пока редактор его перезаписывает
+		return false
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return false
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+	return true
+}
+
+// settings возвращает текущие настройки. Возвращенные настройки не изменяются:
+// при перечитывании файла настроек они заменяются целиком
+func (a *app) settings() *config {
+	return a.configuration.Load()
+}
+
+// reloadConfig перечитывает файл настроек и применяет изменения, возможные без перезапуска бота.
+// Если в файле есть ошибки, продолжают действовать прежние настройки
+func (a *app) reloadConfig(path string) {
+
+	next, err := readConfig(path)
+	if err != nil {
+		log.Printf("Настройки не перечитаны, действуют прежние: %v", err)
+		return
+	}
+
+	previous := a.settings()
+	updated, changes, rejected := mergeLiveSettings(*previous, next)
+	for _, name := range rejected {
+		log.Printf("Настройка %s не может быть изменена без перезапуска бота, действует прежнее значение", name)
+	}
+	if len(changes) == 0 {
+		log.Printf("Настройки, применяемые без перезапуска, не изменились")
+		return
+	}
+
+	a.configuration.Store(&updated)
+	log.Printf("Настройки перечитаны:\n  %s", strings.Join(changes, "\n  "))
+
+	a.engineers.seed(updated)
+	if updated.GrantNotice != previous.GrantNotice {
+		//Предупреждения об окончании временных доступов переносятся на новое время
+		a.scheduleGrants()
+	}
+}
+
+// mergeLiveSettings переносит в текущие настройки current измененные в next настройки, которые применяются
+// без перезапуска. Возвращает новые настройки, описание изменений и названия измененных настроек,
+// которые требуют перезапуска
+func mergeLiveSettings(current, next config) (config, []string, []string) {
+
+	var changes, rejected []string
+
+	updated := current
+	currentValue, nextValue := reflect.ValueOf(current), reflect.ValueOf(next)
+	updatedValue := reflect.ValueOf(&updated).Elem()
+
+	for i := range currentValue.NumField() {
+		name, _, _ := strings.Cut(currentValue.Type().Field(i).Tag.Get("json"), ",")
+		was, now := currentValue.Field(i).Interface(), nextValue.Field(i).Interface()
+		if reflect.DeepEqual(was, now) {
+			continue
+		}
+		if !liveSettings[name] {
+			rejected = append(rejected, name)
+			continue
+		}
+
+		updatedValue.Field(i).Set(nextValue.Field(i))
+		if name == "phone_engineer" {
+			changes = append(changes, engineersDiff(current.PhoneEngineer, next.PhoneEngineer)...)
+		} else {
+			changes = append(changes, fmt.Sprintf("%s: %v → %v", name, was, now))
+		}
+	}
+	return updated, changes, rejected
+}
+
+// engineersDiff описывает изменения списка инженеров
+func engineersDiff(was, now map[string]string) []string {
+
+	var changes []string
+	for _, phone := range slices.Sorted(maps.Keys(now)) {
+		name, ok := was[phone]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("phone_engineer: добавлен инженер %s (%s)", phone, now[phone]))
+		case name != now[phone]:
+			changes = append(changes, fmt.Sprintf("phone_engineer: инженер %s переименован: %s → %s", phone, name, now[phone]))
+		}
+	}
+	for _, phone := range slices.Sorted(maps.Keys(was)) {
+		if _, ok := now[phone]; !ok {
+			changes = append(changes, fmt.Sprintf("phone_engineer: удален инженер %s (%s), в списке инженеров он остается до отключения командой /disable_engineer", phone, was[phone]))
+		}
+	}
+	return changes
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMergeLiveSettings(t *testing.T) {
+
+	current := config{
+		TelegramBotToken:       "token",
+		PhoneEngineer:          map[string]string{"+79990000000": "Инженер", "+79990000001": "Старший"},
+		SessionTimeoutEngineer: 120,
+		UpdateMode:             updateModePolling,
+	}
+
+	next := current
+	next.TelegramBotToken = "other"
+	next.UpdateMode = updateModeWebhook
+	next.SessionTimeoutEngineer = 60
+	next.PhoneEngineer = map[string]string{"+79990000000": "Инженер", "+79990000001": "Главный", "+79990000002": "Новый"}
+
+	updated, changes, rejected := mergeLiveSettings(current, next)
+
+	if updated.TelegramBotToken != "token" || updated.UpdateMode != updateModePolling {
+		t.Errorf("применены настройки, требующие перезапуска: %q, %q", updated.TelegramBotToken, updated.UpdateMode)
+	}
+	if updated.SessionTimeoutEngineer != 60 || len(updated.PhoneEngineer) != 3 {
+		t.Errorf("не применены настройки без перезапуска: session_timeout_engineer %d, инженеров %d", updated.SessionTimeoutEngineer, len(updated.PhoneEngineer))
+	}
+	if want := []string{"telegram_bot_token", "update_mode"}; !slices.Equal(rejected, want) {
+		t.Errorf("отклонены %q, ожидалось %q", rejected, want)
+	}
+
+	want := []string{
+		"phone_engineer: инженер +79990000001 переименован: Старший → Главный",
+		"phone_engineer: добавлен инженер +79990000002 (Новый)",
+		"session_timeout_engineer: 120 → 60",
+	}
+	for _, change := range want {
+		if !slices.Contains(changes, change) {
+			t.Errorf("нет изменения %q в %q", change, changes)
+		}
+	}
+	if len(changes) != len(want) {
+		t.Errorf("изменения %q, ожидалось %q", changes, want)
+	}
+
+	if _, changes, rejected := mergeLiveSettings(current, current); len(changes) > 0 || len(rejected) > 0 {
+		t.Errorf("настройки не изменены, получены изменения %q и %q", changes, rejected)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// reply отправляет ответ пользователю. Ответ на нажатие кнопки актуального меню заменяет текст и клавиатуру этого меню,
+// в остальных случаях отправляется новое сообщение, а клавиатура предыдущего меню удаляется
+func (a *app) reply(update tgbotapi.Update, operation *operation, msg tgbotapi.MessageConfig) {
+
+	if msg.Text == "" {
+		return
+	}
+
+	keyboard, inline := inlineKeyboard(msg)
+
+	if update.CallbackQuery != nil {
+		chatID := update.CallbackQuery.Message.Chat.ID
+		messageID := update.CallbackQuery.Message.MessageID
+
+		if messageID == operation.menuMessageId && (inline || msg.ReplyMarkup == nil) {
+			edit := tgbotapi.NewEditMessageText(chatID, messageID, msg.Text)
+			if inline {
+				edit.ReplyMarkup = keyboard
+			}
+			_, err := a.bot.Request(edit)
+			if err == nil || isNotModified(err) {
+				if !inline {
+					operation.menuMessageId = 0
+				}
+				return
+			}
+			log.Printf("Не удалось изменить сообщение %d чата %d: %v", messageID, chatID, err)
+		} else if messageID != operation.menuMessageId {
+			//Кнопка нажата в устаревшем сообщении
+			removeKeyboard(a.bot, chatID, messageID)
+		}
+	}
+
+	if operation.menuMessageId != 0 {
+		removeKeyboard(a.bot, msg.ChatID, operation.menuMessageId)
+		operation.menuMessageId = 0
+	}
+
+	sent, err := a.bot.Send(msg)
+	if err != nil {
+		log.Printf("Не удалось отправить сообщение в чат %d: %v", msg.ChatID, err)
+		return
+	}
+	if inline {
+		operation.menuMessageId = sent.MessageID
+	}
+}
+
+// answerCallback останавливает индикатор загрузки на нажатой кнопке
+func (a *app) answerCallback(update tgbotapi.Update) {
+	if update.CallbackQuery == nil {
+		return
+	}
+	_, err := a.bot.Request(tgbotapi.NewCallback(update.CallbackQuery.ID, ""))
+	if err != nil {
+		log.Printf("Не удалось ответить на нажатие кнопки: %v", err)
+	}
+}
+
+// busyNotice сообщает пользователю, что бот еще обрабатывает его предыдущие запросы и обновление отклонено
+func (a *app) busyNotice(chatID int64, update tgbotapi.Update) {
+
+	const text = "Бот еще обрабатывает ваши предыдущие запросы. Повторите попытку позже."
+
+	var err error
+	if update.CallbackQuery != nil {
+		_, err = a.bot.Request(tgbotapi.NewCallback(update.CallbackQuery.ID, text))
+	} else if chatID != 0 {
+		_, err = a.bot.Send(tgbotapi.NewMessage(chatID, text))
+	}
+	if err != nil {
+		log.Printf("Не удалось уведомить чат %d о необработанном обновлении: %v", chatID, err)
+	}
+}
+
+// removeKeyboard удаляет инлайн клавиатуру из сообщения
+func removeKeyboard(bot *tgbotapi.BotAPI, chatID int64, messageID int) {
+	edit := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{},
+	})
+	_, err := bot.Request(edit)
+	if err != nil && !isNotModified(err) {
+		log.Printf("Не удалось удалить клавиатуру сообщения %d чата %d: %v", messageID, chatID, err)
+	}
+}
+
+// inlineKeyboard возвращает инлайн клавиатуру сообщения, если она есть
+func inlineKeyboard(msg tgbotapi.MessageConfig) (*tgbotapi.InlineKeyboardMarkup, bool) {
+	switch keyboard := msg.ReplyMarkup.(type) {
+	case tgbotapi.InlineKeyboardMarkup:
+		return &keyboard, true
+	case *tgbotapi.InlineKeyboardMarkup:
+		return keyboard, true
+	}
+	return nil, false
+}
+
+// isNotModified проверяет, что Telegram отказался изменять сообщение, потому что оно не изменилось
+func isNotModified(err error) bool {
+	return strings.Contains(err.Error(), "message is not modified")
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/EkzikP/sdk_andromeda_go_v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRetryAttempts   = 3    //Количество попыток запроса на чтение по умолчанию, включая первую
+	defaultRetryDelay      = 200  //Начальная задержка между попытками по умолчанию, мс.
+	defaultRetryMaxDelay   = 2000 //Максимальная задержка между попытками по умолчанию, мс.
+	defaultBreakerFailures = 5    //Количество неудачных запросов подряд до прекращения запросов по умолчанию
+	defaultBreakerTimeout  = 30   //Время, в течение которого запросы не отправляются, по умолчанию, сек.
+)
+
+// errServiceUnavailable возвращается без отправки запроса, пока сервер ПО "Центр охраны" считается недоступным
+var errServiceUnavailable = errors.New("сервер ПО \"Центр охраны\" временно недоступен")
+
+// resilienceConfig настройки повторов запросов к ПО "Центр охраны" и прекращения запросов к недоступному серверу
+type resilienceConfig struct {
+	RetryAttempts   int `json:"retry_attempts"`   //Количество попыток запроса на чтение, включая первую. Запросы на изменение не повторяются
+	RetryDelay      int `json:"retry_delay"`      //Начальная задержка между попытками, мс. Удваивается с каждой попыткой, фактическая задержка случайна
+	RetryMaxDelay   int `json:"retry_max_delay"`  //Максимальная задержка между попытками, мс.
+	BreakerFailures int `json:"breaker_failures"` //Количество неудачных запросов подряд, после которого сервер считается недоступным
+	BreakerTimeout  int `json:"breaker_timeout"`  //Время, в течение которого запросы к недоступному серверу не отправляются, сек.
+	HealthInterval  int `json:"health_interval"`  //Интервал проверки доступности основного и резервных адресов серверов, сек.
+}
+
+// setDefaults заполняет незаданные настройки значениями по умолчанию
+func (c *resilienceConfig) setDefaults() {
+	if c.RetryAttempts <= 0 {
+		c.RetryAttempts = defaultRetryAttempts
+	}
+	if c.RetryDelay <= 0 {
+		c.RetryDelay = defaultRetryDelay
+	}
+	if c.RetryMaxDelay < c.RetryDelay {
+		c.RetryMaxDelay = max(defaultRetryMaxDelay, c.RetryDelay)
+	}
+	if c.BreakerFailures <= 0 {
+		c.BreakerFailures = defaultBreakerFailures
+	}
+	if c.BreakerTimeout <= 0 {
+		c.BreakerTimeout = defaultBreakerTimeout
+	}
+	if c.HealthInterval <= 0 {
+		c.HealthInterval = defaultHealthInterval
+	}
+}
+
+// breakerState состояние автомата прекращения запросов к недоступному серверу
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota //Запросы отправляются
+	breakerOpen                         //Сервер недоступен, запросы не отправляются
+	breakerHalfOpen                     //Время ожидания истекло, отправляется один пробный запрос
+)
+
+// circuitBreaker прекращает запросы к серверу после нескольких неудачных запросов подряд
+// и возобновляет их после успешного пробного запроса. Безопасен для использования из нескольких горутин
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	limit    int
+	timeout  time.Duration
+}
+
+// allow проверяет, можно ли отправить запрос
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.timeout {
+			return false
+		}
+		b.state = breakerHalfOpen
+		log.Printf("Отправляется пробный запрос к ПО \"Центр охраны\"")
+		return true
+	case breakerHalfOpen:
+		//Пока пробный запрос не завершен, остальные запросы не отправляются
+		return false
+	}
+	return true
+}
+
+// success учитывает успешный запрос
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerClosed {
+		log.Printf("Сервер ПО \"Центр охраны\" снова доступен, запросы возобновлены")
+	}
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+// failure учитывает запрос, не выполненный из-за недоступности сервера
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.limit) {
+		log.Printf("Сервер ПО \"Центр охраны\" недоступен, запросы не отправляются %s", b.timeout)
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// abort учитывает запрос, прерванный до получения ответа. Прерванный пробный запрос будет отправлен снова
+func (b *circuitBreaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+// resilientClient повторяет неудачные запросы на чтение с возрастающей случайной задержкой
+// и прекращает запросы к серверу, пока он недоступен
+type resilientClient struct {
+	client   andromedaClient
+	breaker  *circuitBreaker
+	attempts int
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+var _ andromedaClient = (*resilientClient)(nil)
+
+// newResilientClient создает клиент с повторами запросов и прекращением запросов к недоступному серверу
+func newResilientClient(client andromedaClient, configuration resilienceConfig) *resilientClient {
+	return &resilientClient{
+		client: client,
+		breaker: &circuitBreaker{
+			limit:   configuration.BreakerFailures,
+			timeout: time.Duration(configuration.BreakerTimeout) * time.Second,
+		},
+		attempts: configuration.RetryAttempts,
+		delay:    time.Duration(configuration.RetryDelay) * time.Millisecond,
+		maxDelay: time.Duration(configuration.RetryMaxDelay) * time.Millisecond,
+	}
+}
+
+// backoff возвращает случайную задержку перед повтором attempt (начиная с 1), не больше удвоенной предыдущей
+func (c *resilientClient) backoff(attempt int) time.Duration {
+	delay := min(c.delay<<(attempt-1), c.maxDelay)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// call выполняет запрос request метода method. Запрос на чтение (idempotent) повторяется,
+// если сервер не ответил, запрос на изменение выполняется один раз: сервер мог успеть его обработать
+func call[T any](ctx context.Context, c *resilientClient, method string, idempotent bool, request func(context.Context) (T, error)) (T, error) {
+
+	attempts := 1
+	if idempotent {
+		attempts = c.attempts
+	}
+
+	var response T
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if !c.breaker.allow() {
+			var empty T
+			return empty, errServiceUnavailable
+		}
+
+		response, err = request(ctx)
+		if err == nil || !isUnavailable(err) {
+			//Ответ с ошибкой, например "объект не найден", означает, что сервер доступен
+			c.breaker.success()
+			return response, err
+		}
+
+		//Обработка обновления отменена или ее время истекло, сервер здесь ни при чем
+		if ctx.Err() != nil {
+			c.breaker.abort()
+			return response, err
+		}
+		c.breaker.failure()
+
+		if attempt == attempts {
+			break
+		}
+		delay := c.backoff(attempt)
+		log.Printf("Запрос %s не выполнен (попытка %d из %d), повтор через %s: %v", method, attempt, attempts, delay.Round(time.Millisecond), err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return response, err
+		}
+	}
+	return response, err
+}
+
+func (c *resilientClient) GetSites(ctx context.Context, input andromeda.GetSitesInput) (andromeda.GetSitesResponse, error) {
+	return call(ctx, c, "GetSites", true, func(ctx context.Context) (andromeda.GetSitesResponse, error) {
+		return c.client.GetSites(ctx, input)
+	})
+}
+
+func (c *resilientClient) GetCustomers(ctx context.Context, input andromeda.GetCustomersInput) ([]andromeda.GetCustomerResponse, error) {
+	return call(ctx, c, "GetCustomers", true, func(ctx context.Context) ([]andromeda.GetCustomerResponse, error) {
+		return c.client.GetCustomers(ctx, input)
+	})
+}
+
+func (c *resilientClient) GetCustomer(ctx context.Context, input andromeda.GetCustomerInput) (andromeda.GetCustomerResponse, error) {
+	return call(ctx, c, "GetCustomer", true, func(ctx context.Context) (andromeda.GetCustomerResponse, error) {
+		return c.client.GetCustomer(ctx, input)
+	})
+}
+
+func (c *resilientClient) PostCheckPanic(ctx context.Context, input andromeda.PostCheckPanicInput) (andromeda.PostCheckPanicResponse, error) {
+	return call(ctx, c, "PostCheckPanic", false, func(ctx context.Context) (andromeda.PostCheckPanicResponse, error) {
+		return c.client.PostCheckPanic(ctx, input)
+	})
+}
+
+func (c *resilientClient) GetCheckPanic(ctx context.Context, input andromeda.GetCheckPanicInput) (andromeda.GetCheckPanicResponse, error) {
+	return call(ctx, c, "GetCheckPanic", true, func(ctx context.Context) (andromeda.GetCheckPanicResponse, error) {
+		return c.client.GetCheckPanic(ctx, input)
+	})
+}
+
+func (c *resilientClient) GetUsersMyAlarm(ctx context.Context, input andromeda.GetUsersMyAlarmInput) ([]andromeda.UserMyAlarmResponse, error) {
+	return call(ctx, c, "GetUsersMyAlarm", true, func(ctx context.Context) ([]andromeda.UserMyAlarmResponse, error) {
+		return c.client.GetUsersMyAlarm(ctx, input)
+	})
+}
+
+func (c *resilientClient) GetUserObjectMyAlarm(ctx context.Context, input andromeda.GetUserObjectMyAlarmInput) ([]andromeda.GetUserObjectMyAlarmResponse, error) {
+	return call(ctx, c, "GetUserObjectMyAlarm", true, func(ctx context.Context) ([]andromeda.GetUserObjectMyAlarmResponse, error) {
+		return c.client.GetUserObjectMyAlarm(ctx, input)
+	})
+}
+
+func (c *resilientClient) PutChangeUserMyAlarm(ctx context.Context, input andromeda.PutChangeUserMyAlarmInput) (andromeda.PutChangeUserMyAlarmResponse, error) {
+	return call(ctx, c, "PutChangeUserMyAlarm", false, func(ctx context.Context) (andromeda.PutChangeUserMyAlarmResponse, error) {
+		return c.client.PutChangeUserMyAlarm(ctx, input)
+	})
+}
+
+func (c *resilientClient) PutChangeKTSUserMyAlarm(ctx context.Context, input andromeda.PutChangeKTSUserMyAlarmInput) error {
+	_, err := call(ctx, c, "PutChangeKTSUserMyAlarm", false, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, c.client.PutChangeKTSUserMyAlarm(ctx, input)
+	})
+	return err
+}
+
+func (c *resilientClient) GetParts(ctx context.Context, input andromeda.GetPartsInput) ([]andromeda.GetPartsResponse, error) {
+	return call(ctx, c, "GetParts", true, func(ctx context.Context) ([]andromeda.GetPartsResponse, error) {
+		return c.client.GetParts(ctx, input)
+	})
+}
+
+func (c *resilientClient) GetZones(ctx context.Context, input andromeda.GetZonesInput) ([]andromeda.GetZonesResponse, error) {
+	return call(ctx, c, "GetZones", true, func(ctx context.Context) ([]andromeda.GetZonesResponse, error) {
+		return c.client.GetZones(ctx, input)
+	})
+}
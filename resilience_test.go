@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+
+	b := &circuitBreaker{limit: 2, timeout: 20 * time.Millisecond}
+
+	expect := func(step string, state breakerState, allow bool) {
+		t.Helper()
+		if b.state != state {
+			t.Fatalf("%s: состояние %d, ожидалось %d", step, b.state, state)
+		}
+		if got := b.allow(); got != allow {
+			t.Fatalf("%s: allow() = %t, ожидалось %t", step, got, allow)
+		}
+	}
+
+	expect("новый", breakerClosed, true)
+	b.failure()
+	expect("одна неудача", breakerClosed, true)
+	b.success()
+	b.failure()
+	expect("неудачи сброшены успехом", breakerClosed, true)
+	b.failure()
+	expect("неудачи подряд", breakerOpen, false)
+
+	time.Sleep(b.timeout)
+	expect("время ожидания истекло", breakerOpen, true)
+	expect("пробный запрос", breakerHalfOpen, false)
+
+	b.abort()
+	expect("пробный запрос прерван", breakerOpen, true)
+	b.failure()
+	expect("пробный запрос неудачен", breakerOpen, false)
+
+	time.Sleep(b.timeout)
+	expect("время ожидания снова истекло", breakerOpen, true)
+	b.success()
+	expect("пробный запрос успешен", breakerClosed, true)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	roleDispatcher   = "dispatcher"    //Диспетчер: только просмотр данных объекта
+	roleTechnician   = "technician"    //Выездной техник: просмотр и проверка КТС
+	roleSenior       = "senior"        //Старший инженер: все пункты меню
+	roleAdmin        = "admin"         //Супер-администратор: старший инженер, который ведет список инженеров командами бота
+	roleCustomer     = "customer"      //Ответственное лицо объекта
+	roleMyAlarmAdmin = "myalarm_admin" //Ответственное лицо объекта, администратор MyAlarm объекта
+	roleGrantee      = "grantee"       //Пользователь с временным доступом к объекту, выданным командой /grant
+)
+
+// menuActions пункты меню объекта, доступ к которым определяется ролью пользователя
+var menuActions = []string{"GetInfoObject", "GetCustomers", "ChecksKTS", "MyAlarm", "GetParts", "GetZones",
+	"GetUsersMyAlarm", "GetUserObjectMyAlarm", "PutDelUserMyAlarm", "PutAddUserMyAlarm", "PutChangeVirtualKTS"}
+
+// roleActions действия, доступ к которым определяется ролью: пункты меню объекта, выдача временного доступа
+// и просмотр журнала аудита
+var roleActions = append(slices.Clone(menuActions), actionGrant, actionAudit)
+
+// customerRoles роли пользователей, не являющихся инженерами. Они определяются данными объекта и временными
+// доступами и не назначаются инженерам
+var customerRoles = []string{roleCustomer, roleMyAlarmAdmin, roleGrantee}
+
+// defaultRoles пункты меню, доступные ролям по умолчанию. Настройка roles заменяет их и добавляет новые роли инженеров
+var defaultRoles = map[string][]string{
+	roleDispatcher:   {"GetInfoObject", "GetCustomers", "MyAlarm", "GetParts", "GetZones", "GetUsersMyAlarm", "GetUserObjectMyAlarm"},
+	roleTechnician:   {"GetInfoObject", "GetCustomers", "ChecksKTS", "GetParts", "GetZones"},
+	roleSenior:       roleActions,
+	roleAdmin:        roleActions,
+	roleCustomer:     {"GetInfoObject", "GetCustomers", "ChecksKTS", "MyAlarm", "GetParts", "GetZones", "GetUsersMyAlarm", "GetUserObjectMyAlarm"},
+	roleMyAlarmAdmin: menuActions,
+	roleGrantee:      {"GetInfoObject", "GetCustomers", "ChecksKTS", "GetParts", "GetZones"},
+}
+
+// roleNames названия ролей для пользователя. Роли, добавленные в настройках, называются как в настройках
+var roleNames = map[string]string{
+	roleDispatcher:   "диспетчер",
+	roleTechnician:   "выездной техник",
+	roleSenior:       "старший инженер",
+	roleAdmin:        "супер-администратор",
+	roleCustomer:     "ответственное лицо",
+	roleMyAlarmAdmin: "администратор MyAlarm",
+	roleGrantee:      "временный доступ",
+}
+
+// roleName возвращает название роли для пользователя
+func roleName(role string) string {
+	if name, ok := roleNames[role]; ok {
+		return name
+	}
+	return role
+}
+
+// checkRoles проверяет права ролей из настроек и возвращает описания всех найденных ошибок
+func checkRoles(roles map[string][]string) []string {
+
+	var problems []string
+	for _, role := range slices.Sorted(maps.Keys(roles)) {
+		if role == "" || strings.ContainsAny(role, " \t") {
+			problems = append(problems, fmt.Sprintf("название роли %q в roles не должно быть пустым и содержать пробелы", role))
+		}
+		for _, action := range roles[role] {
+			if !slices.Contains(roleActions, action) {
+				problems = append(problems, fmt.Sprintf("неизвестный пункт меню %q роли %q в roles, допустимы: %s", action, role, strings.Join(roleActions, ", ")))
+			}
+		}
+	}
+	return problems
+}
+
+// engineerRoles возвращает роли, которые можно назначить инженеру, по алфавиту
+func engineerRoles(roles map[string][]string) []string {
+	return slices.DeleteFunc(slices.Sorted(maps.Keys(roles)), func(role string) bool {
+		return slices.Contains(customerRoles, role)
+	})
+}
+
+// engineerRole проверяет, что роль пользователя на объекте назначена ему как инженеру, за которым закреплен объект
+func engineerRole(role string) bool {
+	return role != "" && !slices.Contains(customerRoles, role)
+}
+
+// userRole определяет роль пользователя на объекте сессии. Роль инженера берется из списка инженеров, если объект
+// закреплен за инженером. Администратор MyAlarm определяется по пользователям MyAlarm объекта, полученным
+// при входе в подменю MyAlarm. Пустая роль - у пользователя нет прав на объект.
+// Данные объекта восстановленной сессии, которые не удалось обновить, устарели и прав не дают
+func (a *app) userRole(chatID int64, operation *operation) string {
+
+	if operation.restored {
+		return ""
+	}
+
+	phone := a.tgUser.Phone(chatID)
+	e, isEngineer := a.engineers.Get(phone)
+	if isEngineer && e.active && a.engineerScope(e).covers(a.backendOf(operation).name, operation.object.AccountNumber) {
+		return e.role
+	}
+
+	for _, user := range operation.usersMyAlarm {
+		if user.MyAlarmPhone == phone && user.Role == "admin" {
+			return roleMyAlarmAdmin
+		}
+	}
+	if isCustomer(phone, operation.customers) {
+		return roleCustomer
+	}
+	if a.hasGrant(phone, a.backendOf(operation).name, operation.numberObject) {
+		return roleGrantee
+	}
+	return ""
+}
+
+// updatePermissions обновляет пункты меню, доступные пользователю. Права определяются при каждом обращении
+// пользователя, поэтому изменение роли или прав роли применяется без завершения работы с объектом
+func (a *app) updatePermissions(chatID int64, operation *operation) {
+
+	role := a.userRole(chatID, operation)
+	permissions, ok := a.settings().Roles[role]
+	if !ok && role != "" {
+		log.Printf("Роль %q пользователя %s не задана в настройках roles, пункты меню объекта недоступны", role, a.tgUser.Phone(chatID))
+	}
+	operation.userRole = role
+	operation.permissions = permissions
+}
+
+// permitted проверяет, что пункт меню action доступен пользователю
+func (o *operation) permitted(action string) bool {
+	return slices.Contains(o.permissions, action)
+}
+
+// requestedAction возвращает пункт меню, к которому относится нажатая кнопка или введенный текст.
+// Кнопки выбора пользователя, роли, КТС, результата проверки КТС и повтора запроса продолжают начатый пункт меню
+func (o *operation) requestedAction(cb callbackData) string {
+
+	switch {
+	case slices.Contains(menuActions, cb.action):
+		return cb.action
+	case cb.action == "" && o.state != stateAwaitingUserPhone:
+		return ""
+	case cb.action == "Back", cb.action == "Finish", cb.action == "Page":
+		return ""
+	case o.state == stateAwaitingObject:
+		return ""
+	case cb.action == "ResultCheckKTS", o.currentRequest == "ResultCheckKTS":
+		return "ChecksKTS"
+	}
+	return o.currentRequest
+}
+
+// deniedAction сообщает пользователю, что пункт меню недоступен его роли, и выводит меню с доступными пунктами.
+// Если у пользователя больше нет прав на объект, работа с объектом завершается
+func (a *app) deniedAction(chatID int64, action string, operation *operation) tgbotapi.MessageConfig {
+
+	//Объект перестал быть закрепленным за инженером или пользователь больше не ответственное лицо объекта
+	if operation.userRole == "" {
+		a.audit(chatID, auditEntry{object: operation.numberObject, server: a.backendOf(operation).name, action: action, result: auditDenied, details: "нет прав на объект"})
+		text := fmt.Sprintf("Завершена работа с объектом %s: у вас больше нет прав на этот объект", operation.numberObject)
+		*operation = *finishOperation(a.bot, chatID, operation, text)
+		return tgbotapi.NewMessage(chatID, "Введите пультовый номер объекта!")
+	}
+
+	a.audit(chatID, auditEntry{role: operation.userRole, object: operation.numberObject, server: a.backendOf(operation).name, action: action, result: auditDenied,
+		details: "пункт меню недоступен роли"})
+
+	msg := createMenu(chatID, operation)
+	msg.Text = fmt.Sprintf("Действие недоступно для роли «%s».\n%s", roleName(operation.userRole), msg.Text)
+	return msg
+}
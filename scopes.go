@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+)
+
+// scopeAll значение команды /set_scope, которое снимает ограничение объектов инженера
+var scopeAll = []string{"все", "all"}
+
+type (
+	// objectScope объекты, закрепленные за инженером: диапазоны пультовых номеров "100-199", номера "1234"
+	// и названия групп объектов из настройки object_groups. Пустой список - все объекты.
+	// Элемент с названием сервера "100-199@Север" относится только к объектам этого сервера, без названия - к объектам всех серверов
+	objectScope struct {
+		items  []string
+		groups map[string][]accountRange
+	}
+
+	// scopeError отказ инженеру в работе с объектом, не закрепленным за ним
+	scopeError struct {
+		numberObject string
+		scope        objectScope
+	}
+)
+
+func (e *scopeError) Error() string {
+	return fmt.Sprintf("Объект %s не закреплен за вами. Ваши объекты: %s", e.numberObject, e.scope)
+}
+
+// parseAccounts разбирает диапазон пультовых номеров "100-199" или номер "1234"
+func parseAccounts(item string) (accountRange, bool) {
+
+	from, to, isRange := strings.Cut(item, "-")
+	if !isRange {
+		to = from
+	}
+	fromNumber, errFrom := strconv.Atoi(from)
+	toNumber, errTo := strconv.Atoi(to)
+	if errFrom != nil || errTo != nil {
+		return accountRange{}, false
+	}
+	return accountRange{From: fromNumber, To: toNumber}, true
+}
+
+// validRange проверяет, что диапазон номеров объектов не пуст и не выходит за пределы 1-9999
+func validRange(accounts accountRange) bool {
+	return accounts.From >= 1 && accounts.To <= 9999 && accounts.From <= accounts.To
+}
+
+// checkObjectGroups проверяет группы объектов из настроек и возвращает описания всех найденных ошибок
+func checkObjectGroups(groups map[string][]accountRange) []string {
+
+	var problems []string
+	for _, name := range slices.Sorted(maps.Keys(groups)) {
+		if _, ok := parseAccounts(name); ok || name == "" || strings.ContainsFunc(name, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) ||
+			strings.Contains(name, serverSeparator) || slices.Contains(scopeAll, strings.ToLower(name)) {
+			problems = append(problems, fmt.Sprintf("название группы объектов %q в object_groups не должно быть номером, быть пустым и содержать пробелы, запятые и %q", name, serverSeparator))
+		}
+		if len(groups[name]) == 0 {
+			problems = append(problems, fmt.Sprintf("не заданы номера объектов группы %q", name))
+		}
+		for _, accounts := range groups[name] {
+			if !validRange(accounts) {
+				problems = append(problems, fmt.Sprintf("неверный диапазон номеров объектов %d-%d группы %q", accounts.From, accounts.To, name))
+			}
+		}
+	}
+	return problems
+}
+
+// all проверяет, что за инженером закреплены все объекты
+func (s objectScope) all() bool {
+	return len(s.items) == 0
+}
+
+// covers проверяет, что объект с номером number на сервере server закреплен за инженером.
+// Группа, удаленная из настроек, не дает доступа ни к одному объекту
+func (s objectScope) covers(server string, number int) bool {
+
+	if s.all() {
+		return true
+	}
+	for _, item := range s.items {
+		item, itemServer, qualified := strings.Cut(item, serverSeparator)
+		if qualified && !strings.EqualFold(itemServer, server) {
+			continue
+		}
+		if accounts, ok := parseAccounts(item); ok {
+			if accounts.contains(number) {
+				return true
+			}
+			continue
+		}
+		if slices.ContainsFunc(s.groups[item], func(r accountRange) bool { return r.contains(number) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// String возвращает описание объектов для пользователя: "100-199, Север" или "все"
+func (s objectScope) String() string {
+	if s.all() {
+		return "все"
+	}
+	return strings.Join(s.items, ", ")
+}
+
+// engineerScope возвращает объекты, закрепленные за инженером, с группами объектов из текущих настроек
+func (a *app) engineerScope(e engineer) objectScope {
+	return objectScope{items: e.scope, groups: a.settings().ObjectGroups}
+}
+
+// parseScope разбирает список объектов команды /set_scope: диапазоны, номера и группы через запятую или пробел.
+// Название сервера после элемента "100-199@Север" приводится к названию из настроек servers
+func parseScope(args string, groups map[string][]accountRange, servers []string) ([]string, error) {
+
+	items := strings.FieldsFunc(args, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	if len(items) == 1 && slices.Contains(scopeAll, strings.ToLower(items[0])) {
+		return nil, nil
+	}
+
+	var scope []string
+	for _, item := range items {
+		accountsItem, server, qualified := strings.Cut(item, serverSeparator)
+		if accounts, ok := parseAccounts(accountsItem); ok {
+			if !validRange(accounts) {
+				return nil, errors.Errorf("Неверный диапазон номеров объектов %s.", accountsItem)
+			}
+		} else if _, ok := groups[accountsItem]; !ok {
+			return nil, errors.Errorf("Группа объектов %s не найдена. Группы: %s", accountsItem, strings.Join(slices.Sorted(maps.Keys(groups)), ", "))
+		}
+		if qualified {
+			i := slices.IndexFunc(servers, func(name string) bool { return strings.EqualFold(name, server) })
+			if i < 0 {
+				return nil, errors.Errorf("Сервер %s не найден. Серверы: %s", server, strings.Join(servers, ", "))
+			}
+			item = accountsItem + serverSeparator + servers[i]
+		}
+		if !slices.Contains(scope, item) {
+			scope = append(scope, item)
+		}
+	}
+	return scope, nil
+}
+
+// setScopeCommand закрепляет объекты за инженером по команде /set_scope +7XXXXXXXXXX 100-199, 1234@Юг, Север.
+// Команда /set_scope +7XXXXXXXXXX все снимает ограничение
+func (a *app) setScopeCommand(chatID int64, _ *operation, phone, args string) tgbotapi.MessageConfig {
+
+	usage := "Введите: /set_scope +7xxxxxxxxxx 100-199, 1234, группа объектов\nили /set_scope +7xxxxxxxxxx все\n" +
+		"Объекты одного сервера: /set_scope +7xxxxxxxxxx 100-199@сервер"
+
+	engineerPhone, items, _ := strings.Cut(strings.TrimSpace(args), " ")
+	engineerPhone, err := checkFormatPhone(engineerPhone)
+	if err != nil || !phoneFormat.MatchString(engineerPhone) || strings.TrimSpace(items) == "" {
+		return tgbotapi.NewMessage(chatID, "Неверный формат команды.\n"+usage)
+	}
+
+	servers := make([]string, 0, len(a.backends))
+	for _, b := range a.backends {
+		servers = append(servers, b.name)
+	}
+	scope, err := parseScope(items, a.settings().ObjectGroups, servers)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, err.Error()+"\n"+usage)
+	}
+
+	e, ok := a.engineers.Get(engineerPhone)
+	if !ok {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("Инженер %s не найден.", engineerPhone))
+	}
+
+	was := a.engineerScope(e)
+	if slices.Equal(was.items, scope) {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("За инженером %s (%s) уже закреплены объекты: %s.", e.name, e.phone, was))
+	}
+	e.scope, e.changedBy = scope, phone
+	details := fmt.Sprintf("объекты %s → %s", was, a.engineerScope(e))
+
+	if err = a.engineers.save(e, details); err != nil {
+		log.Printf("Не удалось закрепить объекты за инженером %s: %v", e.phone, err)
+		return tgbotapi.NewMessage(chatID, "Не удалось сохранить изменения, попробуйте позже.")
+	}
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("Инженер %s (%s): %s.", e.name, e.phone, details))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseScope(t *testing.T) {
+
+	groups := map[string][]accountRange{"Север": {{From: 5000, To: 5999}}}
+	servers := []string{"Центр", "Юг"}
+
+	tests := []struct {
+		args    string
+		want    []string
+		wantErr bool
+	}{
+		{args: "все", want: nil},
+		{args: "ALL", want: nil},
+		{args: "100-199, 1234 Север", want: []string{"100-199", "1234", "Север"}},
+		{args: "1234,1234", want: []string{"1234"}},
+		{args: "4444@юг, 100-199@Центр", want: []string{"4444@Юг", "100-199@Центр"}},
+		{args: "Север@Юг", want: []string{"Север@Юг"}},
+		{args: "199-100", wantErr: true},
+		{args: "0-10", wantErr: true},
+		{args: "Юг", wantErr: true},
+		{args: "4444@Запад", wantErr: true},
+		{args: "все 1234", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			got, err := parseScope(tt.args, groups, servers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ошибка %v, ожидалась ошибка: %t", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("%q, ожидалось %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScopeCovers(t *testing.T) {
+
+	groups := map[string][]accountRange{"Север": {{From: 5000, To: 5999}}}
+
+	tests := []struct {
+		name   string
+		items  []string
+		server string
+		number int
+		want   bool
+	}{
+		{name: "все объекты", items: nil, server: "Юг", number: 1, want: true},
+		{name: "диапазон", items: []string{"100-199"}, server: "Юг", number: 150, want: true},
+		{name: "вне диапазона", items: []string{"100-199"}, server: "Юг", number: 200, want: false},
+		{name: "группа", items: []string{"Север"}, server: "Юг", number: 5001, want: true},
+		{name: "удаленная группа", items: []string{"Восток"}, server: "Юг", number: 5001, want: false},
+		{name: "объект своего сервера", items: []string{"4444@Юг"}, server: "юг", number: 4444, want: true},
+		{name: "объект другого сервера", items: []string{"4444@Юг"}, server: "Центр", number: 4444, want: false},
+		{name: "группа другого сервера", items: []string{"Север@Юг"}, server: "Центр", number: 5001, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scope := objectScope{items: tt.items, groups: groups}
+			if got := scope.covers(tt.server, tt.number); got != tt.want {
+				t.Errorf("covers(%q, %d) = %t, ожидалось %t", tt.server, tt.number, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/EkzikP/sdk_andromeda_go_v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultServerName = "Центр охраны" //Название сервера, заданного полями host и api_key
+	serverSeparator   = "@"            //Разделитель номера объекта и названия сервера при явном выборе сервера: "1234@Север"
+	//Наибольшая длина названия сервера, байт: номер объекта с названием сервера передается в данных кнопки
+	//"Повторить", а их длина ограничена Telegram
+	maxServerNameLength = 32
+)
+
+type (
+	// serverConfig настройки подключения к серверу ПО "Центр охраны"
+	serverConfig struct {
+		Name     string          `json:"name"`     //Название сервера, по нему сервер выбирается явно и запоминается в сессии
+		Host     string          `json:"host"`     //Адрес сервера ПО "Центр охраны"
+		ApiKey   string          `json:"api_key"`  //API ключ ПО "Центр охраны"
+		Accounts []accountRange  `json:"accounts"` //Диапазоны пультовых номеров объектов сервера. Если не заданы, на сервере ищутся объекты вне всех диапазонов
+		Standby  []standbyConfig `json:"standby"`  //Резервные адреса сервера, на которые переключаются запросы, пока основной недоступен
+	}
+
+	// accountRange диапазон пультовых номеров объектов, включая границы
+	accountRange struct {
+		From int `json:"from"`
+		To   int `json:"to"`
+	}
+
+	// backend сервер ПО "Центр охраны" с клиентом для запросов к нему
+	backend struct {
+		name     string
+		confSDK  andromeda.Config //Настройки основного адреса. Клиент заменяет их настройками активного адреса
+		client   *failoverClient
+		accounts []accountRange
+	}
+)
+
+// contains проверяет, что номер объекта входит в диапазон
+func (r accountRange) contains(number int) bool {
+	return number >= r.From && number <= r.To
+}
+
+// serves проверяет, что объект с номером number относится к серверу по диапазонам номеров
+func (b *backend) serves(number int) bool {
+	return slices.ContainsFunc(b.accounts, func(r accountRange) bool { return r.contains(number) })
+}
+
+// checkServers проверяет список серверов и возвращает описания всех найденных ошибок
+func checkServers(servers []serverConfig) []string {
+
+	if len(servers) == 0 {
+		return []string{"не задан ни один сервер ПО \"Центр охраны\": host или servers"}
+	}
+
+	var problems []string
+	names := make(map[string]bool)
+	for _, server := range servers {
+		switch {
+		case server.Name == "":
+			problems = append(problems, fmt.Sprintf("не задано название сервера %s", server.Host))
+		case strings.ContainsAny(server.Name, serverSeparator+callbackSeparator):
+			problems = append(problems, fmt.Sprintf("название сервера %q не должно содержать %q и %q", server.Name, serverSeparator, callbackSeparator))
+		case len(server.Name) > maxServerNameLength:
+			problems = append(problems, fmt.Sprintf("название сервера %q длиннее %d байт (%d букв кириллицы)", server.Name, maxServerNameLength, maxServerNameLength/2))
+		case names[strings.ToLower(server.Name)]:
+			problems = append(problems, fmt.Sprintf("сервер %q указан несколько раз", server.Name))
+		}
+		names[strings.ToLower(server.Name)] = true
+
+		if server.Host == "" {
+			problems = append(problems, fmt.Sprintf("не задан адрес сервера %q", server.Name))
+		} else if err := checkHost(server.Host); err != nil {
+			problems = append(problems, fmt.Sprintf("сервер %q: %v", server.Name, err))
+		}
+		if server.ApiKey == "" {
+			problems = append(problems, fmt.Sprintf("не задан API ключ сервера %q: api_key или переменная окружения API_KEY", server.Name))
+		}
+
+		for _, standby := range server.Standby {
+			if standby.Host == "" {
+				problems = append(problems, fmt.Sprintf("не задан резервный адрес сервера %q", server.Name))
+			} else if err := checkHost(standby.Host); err != nil {
+				problems = append(problems, fmt.Sprintf("резервный адрес сервера %q: %v", server.Name, err))
+			}
+		}
+
+		for _, accounts := range server.Accounts {
+			if !validRange(accounts) {
+				problems = append(problems, fmt.Sprintf("неверный диапазон номеров объектов %d-%d сервера %q", accounts.From, accounts.To, server.Name))
+			}
+		}
+	}
+	return problems
+}
+
+// newBackends создает клиенты серверов ПО "Центр охраны". У каждого адреса сервера свой учет недоступности
+func newBackends(configuration config) []*backend {
+
+	backends := make([]*backend, 0, len(configuration.Servers))
+	for _, server := range configuration.Servers {
+		hosts := []andromeda.Config{{ApiKey: server.ApiKey, Host: server.Host}}
+		for _, standby := range server.Standby {
+			apiKey := standby.ApiKey
+			if apiKey == "" {
+				apiKey = server.ApiKey
+			}
+			hosts = append(hosts, andromeda.Config{ApiKey: apiKey, Host: standby.Host})
+		}
+
+		backends = append(backends, &backend{
+			name:     server.Name,
+			confSDK:  hosts[0],
+			client:   newFailoverClient(server.Name, hosts, configuration),
+			accounts: server.Accounts,
+		})
+	}
+	return backends
+}
+
+// serverByName возвращает сервер по названию без учета регистра
+func (a *app) serverByName(name string) *backend {
+	for _, b := range a.backends {
+		if strings.EqualFold(b.name, name) {
+			return b
+		}
+	}
+	return nil
+}
+
+// objectInput возвращает номер объекта без ведущих нулей и, если сервер указан, его название из настроек:
+// в таком виде ввод пользователя передается в данных кнопки "Повторить", длина которых ограничена
+func (a *app) objectInput(numberObject, serverName string) string {
+
+	number, _ := strconv.Atoi(numberObject)
+	input := strconv.Itoa(number)
+	if b := a.serverByName(serverName); b != nil {
+		input += serverSeparator + b.name
+	}
+	return input
+}
+
+// backendOf возвращает сервер, на котором находится объект сессии
+func (a *app) backendOf(operation *operation) *backend {
+
+	if b := a.serverByName(operation.server); b != nil {
+		return b
+	}
+	if operation.server != "" {
+		log.Printf("Сервер %q объекта %s не найден в настройках, используется сервер %q", operation.server, operation.numberObject, a.backends[0].name)
+	}
+	return a.backends[0]
+}
+
+// serverNames возвращает названия серверов через запятую
+func serverNames(backends []*backend) string {
+	names := make([]string, 0, len(backends))
+	for _, b := range backends {
+		names = append(names, b.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// objectServer возвращает сервер объекта, указанного в служебной команде: выбранный явно или единственный,
+// к которому объект относится по номеру. Если объект может находиться на нескольких серверах, возвращается текст
+// с просьбой указать сервер
+func (a *app) objectServer(number int, serverName string) (*backend, string) {
+
+	if serverName != "" {
+		if srv := a.serverByName(serverName); srv != nil {
+			return srv, ""
+		}
+		return nil, fmt.Sprintf("Сервер %s не найден. Серверы: %s", serverName, serverNames(a.backends))
+	}
+	if candidates := a.candidates(number); len(candidates) > 1 {
+		return nil, fmt.Sprintf("Объект %d может находиться на серверах %s. Укажите сервер: %d%sсервер", number, serverNames(candidates), number, serverSeparator)
+	}
+	return a.candidates(number)[0], ""
+}
+
+// objectTitle возвращает номер объекта для пользователя, с названием сервера, если серверов несколько
+func (a *app) objectTitle(object, server string) string {
+	if len(a.backends) > 1 {
+		return fmt.Sprintf("%s (сервер %s)", object, server)
+	}
+	return object
+}
+
+// splitObjectNumber разделяет введенный пользователем текст на номер объекта и название сервера: "1234@Север"
+func splitObjectNumber(text string) (string, string) {
+	number, server, _ := strings.Cut(strings.TrimSpace(text), serverSeparator)
+	return strings.TrimSpace(number), strings.TrimSpace(server)
+}
+
+// candidates возвращает серверы, на которых нужно искать объект с номером number.
+// Если номер не входит ни в один диапазон, объект ищется на всех серверах
+func (a *app) candidates(number int) []*backend {
+
+	var ranged, other []*backend
+	for _, b := range a.backends {
+		switch {
+		case b.serves(number):
+			ranged = append(ranged, b)
+		case len(b.accounts) == 0:
+			other = append(other, b)
+		}
+	}
+
+	if len(ranged) > 0 {
+		return ranged
+	}
+	if len(other) > 0 {
+		return other
+	}
+	return a.backends
+}
+
+// findObjectOnServers ищет объект на сервере, выбранном пользователем, или на серверах, к которым объект относится
+// по номеру. Если объект найден на нескольких серверах, пользователю предлагается выбрать сервер явно
+func (a *app) findObjectOnServers(ctx context.Context, numberObject, serverName string) (*backend, andromeda.GetSitesResponse, error) {
+
+	var backends []*backend
+	if serverName != "" {
+		b := a.serverByName(serverName)
+		if b == nil {
+			return nil, andromeda.GetSitesResponse{}, errors.Errorf("Сервер %q не найден. Доступные серверы: %s", serverName, serverNames(a.backends))
+		}
+		backends = []*backend{b}
+	} else {
+		number, _ := strconv.Atoi(numberObject)
+		backends = a.candidates(number)
+	}
+
+	type result struct {
+		object andromeda.GetSitesResponse
+		err    error
+	}
+	results := make([]result, len(backends))
+
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].object, results[i].err = findObject(numberObject, b.confSDK, b.client, &ctx)
+		}()
+	}
+	wg.Wait()
+
+	var found []*backend
+	var object andromeda.GetSitesResponse
+	var notFound, unavailable error
+	for i, r := range results {
+		switch {
+		case r.err == nil:
+			found = append(found, backends[i])
+			object = r.object
+		case isRetryable(r.err):
+			log.Printf("Поиск объекта %s на сервере %q не выполнен: %v", numberObject, backends[i].name, r.err)
+			unavailable = r.err
+		default:
+			notFound = r.err
+		}
+	}
+
+	switch {
+	case len(found) == 1:
+		return found[0], object, nil
+	case len(found) > 1:
+		return nil, andromeda.GetSitesResponse{}, errors.Errorf("Объект %s есть на нескольких серверах: %s.\nУкажите сервер, например %s%s%s", numberObject, serverNames(found), numberObject, serverSeparator, found[0].name)
+	case unavailable != nil:
+		//Объект может находиться на недоступном сервере
+		return nil, andromeda.GetSitesResponse{}, unavailable
+	}
+	return nil, andromeda.GetSitesResponse{}, notFound
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EkzikP/sdk_andromeda_go_v2"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type (
+	// SessionsStore хранит состояние сессий пользователей (структуру operation) в БД
+	SessionsStore struct {
+		db *sql.DB
+	}
+
+	// operations хранит сессии пользователей по chatID. Безопасен для использования из нескольких горутин,
+	// при этом сессию одного чата в каждый момент времени изменяет только обработчик этого чата
+	operations struct {
+		mu    sync.Mutex
+		items map[int64]*operation
+	}
+
+	// sessionData содержит сохраняемые в БД поля структуры operation.
+	// Данные объекта и ответственных лиц не сохраняются, они запрашиваются заново при восстановлении сессии
+	sessionData struct {
+		NumberObject     string      `json:"numberObject"`
+		ObjectId         string      `json:"objectId"`
+		CurrentRequest   string      `json:"currentRequest"`
+		CurrentMenu      string      `json:"currentMenu"`
+		CheckPanicId     string      `json:"checkPanicId"`
+		ChangedUserId    string      `json:"changedUserId"`
+		Role             string      `json:"role"`
+		Server           string      `json:"server,omitempty"`
+		State            dialogState `json:"state"`
+		SessionId        string      `json:"sessionId"`
+		MenuMessageId    int         `json:"menuMessageId"`
+		Pages            []string    `json:"pages,omitempty"`
+		Page             int         `json:"page,omitempty"`
+		CommandPages     []string    `json:"commandPages,omitempty"`
+		CommandPage      int         `json:"commandPage,omitempty"`
+		CommandMessageId int         `json:"commandMessageId,omitempty"`
+		PendingPhone     string      `json:"pendingPhone,omitempty"`
+		PendingPhoneAt   int64       `json:"pendingPhoneAt,omitempty"`
+	}
+)
+
+func NewSessionsStore(db *sql.DB) SessionsStore {
+	return SessionsStore{db: db}
+}
+
+func newOperations(items map[int64]*operation) *operations {
+	return &operations{items: items}
+}
+
+// Get возвращает сессию пользователя или nil, если сессии нет
+func (o *operations) Get(chatID int64) *operation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.items[chatID]
+}
+
+// All возвращает копию списка сессий пользователей
+func (o *operations) All() map[int64]*operation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	items := make(map[int64]*operation, len(o.items))
+	for chatID, operation := range o.items {
+		items[chatID] = operation
+	}
+	return items
+}
+
+// Set сохраняет сессию пользователя
+func (o *operations) Set(chatID int64, operation *operation) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.items[chatID] = operation
+}
+
+// Save сохраняет состояние сессии пользователя
+func (s SessionsStore) Save(chatID int64, operation *operation) error {
+
+	var pendingPhoneAt int64
+	if operation.pendingPhone != "" {
+		pendingPhoneAt = operation.pendingPhoneAt.Unix()
+	}
+
+	data, err := json.Marshal(sessionData{
+		NumberObject:     operation.numberObject,
+		ObjectId:         operation.object.Id,
+		CurrentRequest:   operation.currentRequest,
+		CurrentMenu:      operation.currentMenu,
+		CheckPanicId:     operation.checkPanicId,
+		ChangedUserId:    operation.changedUserId,
+		Role:             operation.role,
+		Server:           operation.server,
+		State:            operation.state,
+		SessionId:        operation.sessionId,
+		MenuMessageId:    operation.menuMessageId,
+		Pages:            operation.pages,
+		Page:             operation.page,
+		CommandPages:     operation.commandPages,
+		CommandPage:      operation.commandPage,
+		CommandMessageId: operation.commandMessageId,
+		PendingPhone:     operation.pendingPhone,
+		PendingPhoneAt:   pendingPhoneAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("INSERT INTO sessions (chatId, data, updatedAt) VALUES (:chatId, :data, :updatedAt) "+
+		"ON CONFLICT(chatId) DO UPDATE SET data = excluded.data, updatedAt = excluded.updatedAt",
+		sql.Named("chatId", chatID),
+		sql.Named("data", string(data)),
+		sql.Named("updatedAt", operation.lastActivity.Unix()))
+	return err
+}
+
+// GetIdle возвращает чаты, в которых ведется работа с объектом и последнее действие было раньше указанного времени
+func (s SessionsStore) GetIdle(before time.Time) ([]int64, error) {
+
+	rows, err := s.db.Query("SELECT chatId FROM sessions WHERE updatedAt < :updatedAt AND json_extract(data, '$.numberObject') != ''",
+		sql.Named("updatedAt", before.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chatIDs []int64
+	for rows.Next() {
+		var chatID int64
+		if err = rows.Scan(&chatID); err != nil {
+			return nil, err
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+
+	return chatIDs, rows.Err()
+}
+
+// GetAll читает все сохраненные сессии пользователей
+func (s SessionsStore) GetAll() (map[int64]*operation, error) {
+
+	rows, err := s.db.Query("SELECT chatId, data, updatedAt FROM sessions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	operations := make(map[int64]*operation)
+	for rows.Next() {
+		var chatID int64
+		var data string
+		var updatedAt int64
+		if err = rows.Scan(&chatID, &data, &updatedAt); err != nil {
+			return nil, err
+		}
+
+		session := sessionData{}
+		if err = json.Unmarshal([]byte(data), &session); err != nil {
+			return nil, err
+		}
+
+		operation := newOperation()
+		operation.numberObject = session.NumberObject
+		operation.object.Id = session.ObjectId
+		operation.object.AccountNumber, _ = strconv.Atoi(session.NumberObject)
+		operation.currentRequest = session.CurrentRequest
+		operation.currentMenu = session.CurrentMenu
+		operation.checkPanicId = session.CheckPanicId
+		operation.changedUserId = session.ChangedUserId
+		operation.role = session.Role
+		operation.server = session.Server
+		operation.state = session.State
+		operation.menuMessageId = session.MenuMessageId
+		operation.pages = session.Pages
+		operation.page = session.Page
+		operation.commandPages = session.CommandPages
+		operation.commandPage = session.CommandPage
+		operation.commandMessageId = session.CommandMessageId
+		if session.PendingPhone != "" {
+			operation.pendingPhone = session.PendingPhone
+			operation.pendingPhoneAt = time.Unix(session.PendingPhoneAt, 0)
+		}
+		if session.SessionId != "" {
+			operation.sessionId = session.SessionId
+		}
+		if operation.state == "" {
+			//Сессия сохранена до появления состояний диалога
+			switch {
+			case session.NumberObject == "":
+				operation.state = stateAwaitingObject
+			case session.CurrentMenu == "MyAlarmMenu":
+				operation.state = stateMyAlarmMenu
+			default:
+				operation.state = stateMainMenu
+			}
+		}
+		operation.restored = session.NumberObject != ""
+		operation.lastActivity = time.Unix(updatedAt, 0)
+
+		operations[chatID] = operation
+	}
+
+	return operations, rows.Err()
+}
+
+// refreshOperation заново получает данные объекта, ответственных лиц и пользователей MyAlarm восстановленной сессии
+func refreshOperation(operation *operation, confSDK andromeda.Config, client andromedaClient, ctx context.Context) error {
+
+	object, err := findObject(operation.numberObject, confSDK, client, &ctx)
+	if err != nil {
+		return err
+	}
+
+	getCustomersRequest := andromeda.GetCustomersInput{
+		SiteId: object.Id,
+		Config: confSDK,
+	}
+
+	getCustomersResponse, err := client.GetCustomers(ctx, getCustomersRequest)
+	if err != nil {
+		return err
+	}
+
+	if operation.currentMenu == "MyAlarmMenu" {
+		usersMyAlarmRequest := andromeda.GetUsersMyAlarmInput{
+			SiteId: object.Id,
+			Config: confSDK,
+		}
+		usersMyAlarmResponse, err := client.GetUsersMyAlarm(ctx, usersMyAlarmRequest)
+		if err != nil {
+			return err
+		}
+		operation.usersMyAlarm = usersMyAlarmResponse
+	}
+
+	operation.object = object
+	operation.customers = getCustomersResponse
+	operation.restored = false
+	return nil
+}
+
+// sessionTimeout возвращает допустимое время бездействия пользователя.
+// Для ответственных лиц оно короче, чем для инженеров
+func sessionTimeout(engineer bool, configuration config) time.Duration {
+	if engineer {
+		return time.Duration(configuration.SessionTimeoutEngineer) * time.Minute
+	}
+	return time.Duration(configuration.SessionTimeoutCustomer) * time.Minute
+}
+
+// finishOperation завершает работу с объектом: удаляет клавиатуру меню, сообщает о завершении пользователю,
+// открепляет сообщение "Работа с объектом" и возвращает новую пустую сессию
+func finishOperation(bot *tgbotapi.BotAPI, chatID int64, operation *operation, text string) *operation {
+
+	if operation.menuMessageId != 0 {
+		removeKeyboard(bot, chatID, operation.menuMessageId)
+	}
+
+	_, _ = bot.Send(tgbotapi.NewMessage(chatID, text))
+
+	unpinMessage := tgbotapi.UnpinAllChatMessagesConfig{
+		ChatID: chatID,
+	}
+	_, _ = bot.Request(unpinMessage)
+
+	return nextOperation(operation)
+}
+
+// expireSessions находит в БД сессии, в которых пользователь бездействует дольше допустимого,
+// и передает их на завершение обработчикам соответствующих чатов
+func (a *app) expireSessions(chats *dispatcher) {
+
+	timeout := time.Duration(min(a.settings().SessionTimeoutEngineer, a.settings().SessionTimeoutCustomer)) * time.Minute
+
+	chatIDs, err := a.sessions.GetIdle(time.Now().Add(-timeout))
+	if err != nil {
+		log.Printf("Не удалось получить список неактивных сессий: %v", err)
+		return
+	}
+
+	for _, chatID := range chatIDs {
+		//Сессия занятого чата будет завершена при следующей проверке
+		_ = chats.Dispatch(chatID, func() { a.expireSession(chatID) })
+	}
+}
+
+// expireSession завершает работу с объектом, если пользователь бездействует дольше допустимого
+func (a *app) expireSession(chatID int64) {
+
+	currentOperation := a.currentOperation.Get(chatID)
+	if currentOperation == nil || currentOperation.numberObject == "" {
+		return
+	}
+
+	if _, ok := a.tgUser.Get(chatID); !ok {
+		_ = a.store.Get(chatID, a.tgUser)
+	}
+
+	if time.Since(currentOperation.lastActivity) < sessionTimeout(a.engineers.isActive(a.tgUser.Phone(chatID)), *a.settings()) {
+		return
+	}
+
+	text := fmt.Sprintf("Работа с объектом %s завершена из-за отсутствия активности.\nВведите пультовый номер объекта!", currentOperation.numberObject)
+	currentOperation = finishOperation(a.bot, chatID, currentOperation, text)
+	currentOperation.lastActivity = time.Now()
+	a.currentOperation.Set(chatID, currentOperation)
+
+	err := a.sessions.Save(chatID, currentOperation)
+	if err != nil {
+		log.Printf("Не удалось сохранить сессию чата %d: %v", chatID, err)
+	}
+}
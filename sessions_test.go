@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPendingPhone(t *testing.T) {
+
+	db, err := openDB(filepath.Join(t.TempDir(), "bot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	sessions := NewSessionsStore(db)
+
+	requested := time.Now().Add(-time.Minute).Truncate(time.Second)
+	operation := newOperation()
+	operation.pendingPhone, operation.pendingPhoneAt = "+79001234567", requested
+	if err = sessions.Save(1, operation); err != nil {
+		t.Fatal(err)
+	}
+
+	//Смена номера, ожидающая подтверждения, сохраняется после перезапуска и завершения работы с объектом
+	operations, err := sessions.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := nextOperation(operations[1])
+	if restored.pendingPhone != operation.pendingPhone || !restored.pendingPhoneAt.Equal(requested) {
+		t.Fatalf("восстановлена смена номера %q от %s, ожидалась %q от %s", restored.pendingPhone, restored.pendingPhoneAt, operation.pendingPhone, requested)
+	}
+
+	tests := []struct {
+		name  string
+		phone string
+		now   time.Time
+		want  bool
+	}{
+		{name: "тот же номер", phone: "+79001234567", now: requested.Add(pendingPhoneTimeout), want: true},
+		{name: "другой номер", phone: "+79007654321", now: requested.Add(time.Minute), want: false},
+		{name: "время ожидания истекло", phone: "+79001234567", now: requested.Add(pendingPhoneTimeout + time.Second), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := restored.phoneChangeConfirmed(tt.phone, tt.now); got != tt.want {
+				t.Errorf("подтверждение %v, ожидалось %v", got, tt.want)
+			}
+		})
+	}
+}
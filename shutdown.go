@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+)
+
+const defaultShutdownTimeout = 10 //Время ожидания обработки принятых обновлений при остановке бота по умолчанию, сек.
+
+// shutdown останавливает бота: перестает принимать обновления, дожидается обработки уже принятых
+// (по истечении времени ожидания отменяет запросы к ПО "Центр охраны"), сохраняет сессии и закрывает БД
+func (a *app) shutdown(source updateSource, lastUpdateID int, chats *dispatcher, cancelWork context.CancelFunc, db *sql.DB) error {
+
+	source.stop()
+	log.Printf("Остановка бота: прием обновлений прекращен")
+
+	//Обновления, уже полученные от Telegram, обрабатываются, чтобы не потерять их
+	for drained := false; !drained; {
+		select {
+		case update, ok := <-source.updates:
+			if !ok {
+				drained = true
+				break
+			}
+			lastUpdateID = max(lastUpdateID, update.UpdateID)
+			//Отклоненное обновление подтверждается вместе с остальными и больше не придет,
+			//поэтому пользователь уведомляется до подтверждения, а не в фоне
+			if err := a.dispatchUpdate(chats, update); errors.Is(err, errChatBusy) {
+				a.busyNotice(updateChatID(update), update)
+			}
+		default:
+			drained = true
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		chats.Stop()
+		close(stopped)
+	}()
+
+	timeout := time.Duration(a.settings().ShutdownTimeout) * time.Second
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		log.Printf("Обработка обновлений не завершилась за %s, запросы к ПО \"Центр охраны\" отменяются", timeout)
+		cancelWork()
+		<-stopped
+	}
+	source.confirm(lastUpdateID)
+	a.grantTimers.stop()
+
+	a.flushSessions()
+
+	if a.settings().NotifyRestart {
+		a.notifyRestart()
+	}
+
+	if err := db.Close(); err != nil {
+		return errors.Wrap(err, "не удалось закрыть БД")
+	}
+
+	log.Printf("Бот остановлен")
+	return nil
+}
+
+// flushSessions сохраняет в БД все сессии пользователей
+func (a *app) flushSessions() {
+	for chatID, operation := range a.currentOperation.All() {
+		if err := a.sessions.Save(chatID, operation); err != nil {
+			log.Printf("Не удалось сохранить сессию чата %d: %v", chatID, err)
+		}
+	}
+}
+
+// notifyRestart предупреждает инженеров, работающих с объектом, о перезапуске бота.
+// Сессии сохранены, поэтому после перезапуска работа с объектом продолжится
+func (a *app) notifyRestart() {
+	for chatID, operation := range a.currentOperation.All() {
+		if operation.numberObject == "" {
+			continue
+		}
+
+		if _, ok := a.tgUser.Get(chatID); !ok {
+			_ = a.store.Get(chatID, a.tgUser)
+		}
+		if !a.engineers.isActive(a.tgUser.Phone(chatID)) {
+			continue
+		}
+
+		text := fmt.Sprintf("Бот перезапускается. Работа с объектом %s продолжится после перезапуска, повторите последнее действие через минуту.", operation.numberObject)
+		if _, err := a.bot.Send(tgbotapi.NewMessage(chatID, text)); err != nil {
+			log.Printf("Не удалось предупредить чат %d о перезапуске: %v", chatID, err)
+		}
+	}
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"time"
 
@@ -13,28 +13,46 @@ import (
 	"log"
 	_ "modernc.org/sqlite"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
-type (
-	config struct {
-		TelegramBotToken string            `json:"telegram_bot_token"` //API токен бота
-		ApiKey           string            `json:"api_key"`            //API ключ ПО "Центр охраны"
-		Host             string            `json:"host"`               //IP адрес сервера ПО "Центр охраны"
-		PhoneEngineer    map[string]string `json:"phone_engineer"`     //Список телефонов инженеров ПО "Центр охраны"
-	}
+const (
+	dbBusyTimeout       = 5000             //Время ожидания записи в БД, занятую обработчиком другого чата, мс.
+	pendingPhoneTimeout = 10 * time.Minute //Время ожидания повторного подтверждения смены номера телефона
+)
 
+type (
 	operation struct {
-		numberObject   string
-		object         andromeda.GetSitesResponse
-		customers      []andromeda.GetCustomerResponse
-		usersMyAlarm   []andromeda.UserMyAlarmResponse
-		currentRequest string
-		currentMenu    string
-		checkPanicId   string
-		changedUserId  string
-		role           string
+		numberObject     string
+		object           andromeda.GetSitesResponse
+		customers        []andromeda.GetCustomerResponse
+		usersMyAlarm     []andromeda.UserMyAlarmResponse
+		currentRequest   string
+		currentMenu      string
+		checkPanicId     string
+		changedUserId    string
+		role             string
+		server           string      //Название сервера ПО "Центр охраны", на котором находится объект
+		state            dialogState //Текущее состояние диалога с пользователем
+		sessionId        string      //Идентификатор сессии, к которому привязаны подписи кнопок
+		menuMessageId    int         //Идентификатор сообщения с клавиатурой текущего меню
+		pages            []string    //Страницы выведенного списка
+		page             int         //Номер текущей страницы списка
+		commandPages     []string    //Страницы ответа на служебную команду
+		commandPage      int         //Номер текущей страницы ответа на служебную команду
+		commandMessageId int         //Идентификатор сообщения со страницами ответа на служебную команду
+		restored         bool        //Сессия восстановлена из БД, данные объекта требуют обновления
+		userRole         string      //Роль пользователя на объекте
+		permissions      []string    //Пункты меню объекта, доступные роли пользователя
+		lastActivity     time.Time   //Время последнего действия пользователя
+		pendingPhone     string      //Новый номер телефона пользователя, ожидающий повторного подтверждения контактом
+		pendingPhoneAt   time.Time   //Время первой отправки контакта с новым номером
 	}
 
 	menu struct {
@@ -45,39 +63,78 @@ type (
 	UsersStore struct {
 		db *sql.DB
 	}
+
+	// usersCache хранит телефоны пользователей по chatID. Безопасен для использования из нескольких горутин
+	usersCache struct {
+		mu     sync.RWMutex
+		phones map[int64]string
+	}
+
+	// app содержит общие для всех чатов зависимости бота
+	app struct {
+		ctx              context.Context //Контекст обработчиков обновлений, отменяется при остановке бота
+		bot              *tgbotapi.BotAPI
+		configuration    atomic.Pointer[config] //Текущие настройки, заменяются целиком при перечитывании файла настроек
+		backends         []*backend             //Серверы ПО "Центр охраны"
+		store            UsersStore
+		sessions         SessionsStore
+		tgUser           *usersCache
+		engineers        *engineersRegistry //Инженеры ПО "Центр охраны"
+		auditLog         AuditStore         //Журнал аудита действий пользователей
+		grants           GrantsStore        //Временные доступы к объектам
+		grantTimers      grantTimers        //Таймеры окончания временных доступов
+		currentOperation *operations
+	}
 )
 
+func newUsersCache() *usersCache {
+	return &usersCache{phones: make(map[int64]string)}
+}
+
+// Get возвращает телефон пользователя и признак его наличия в кэше
+func (c *usersCache) Get(chatID int64) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	phone, ok := c.phones[chatID]
+	return phone, ok
+}
+
+// Phone возвращает телефон пользователя или пустую строку
+func (c *usersCache) Phone(chatID int64) string {
+	phone, _ := c.Get(chatID)
+	return phone
+}
+
+// Set сохраняет телефон пользователя в кэше
+func (c *usersCache) Set(chatID int64, phone string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.phones[chatID] = phone
+}
+
 func NewUsersStore(db *sql.DB) UsersStore {
 	return UsersStore{db: db}
 }
 
-func (s UsersStore) Add(chatID int64, phone string, tgUser *map[int64]string) error {
+// Add сохраняет телефон нового пользователя. Телефон зарегистрированного пользователя меняется только
+// после подтверждения методом SetPhone
+func (s UsersStore) Add(chatID int64, phone string, tgUser *usersCache) error {
 
-	err := s.Get(chatID, tgUser)
+	_, err := s.db.Exec("INSERT INTO users (chatId, phone) VALUES (:chatId, :phone)",
+		sql.Named("chatId", chatID),
+		sql.Named("phone", phone))
 	if err != nil {
-		_, err := s.db.Exec("INSERT INTO users (chatId, phone) VALUES (:chatId, :phone)",
-			sql.Named("chatId", chatID),
-			sql.Named("phone", phone))
-		if err != nil {
-			return err
-		}
-	} else {
-		err = s.SetPhone(chatID, phone)
-		if err != nil {
-			return err
-		}
+		return err
 	}
-	(*tgUser)[chatID] = phone
+	tgUser.Set(chatID, phone)
 	return nil
 }
 
-func (s UsersStore) Get(chatID int64, tgUser *map[int64]string) error {
-	// реализуйте чтение строки по заданному number
-	// здесь из таблицы должна вернуться только одна строка
+// Get читает телефон пользователя чата из БД и сохраняет его в кэше
+func (s UsersStore) Get(chatID int64, tgUser *usersCache) error {
 
 	row := s.db.QueryRow("SELECT phone FROM users WHERE chatId = :chatId", sql.Named("chatId", chatID))
 
-	// заполните объект Parcel данными из таблицы
 	phone := ""
 
 	err := row.Scan(&phone)
@@ -85,13 +142,33 @@ func (s UsersStore) Get(chatID int64, tgUser *map[int64]string) error {
 		return err
 	}
 
-	(*tgUser)[chatID] = phone
+	tgUser.Set(chatID, phone)
 
 	return nil
 }
 
+// ChatIDs возвращает чаты пользователя с телефоном phone
+func (s UsersStore) ChatIDs(phone string) ([]int64, error) {
+
+	rows, err := s.db.Query("SELECT chatId FROM users WHERE phone = :phone", sql.Named("phone", phone))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var chatIDs []int64
+	for rows.Next() {
+		var chatID int64
+		if err = rows.Scan(&chatID); err != nil {
+			return nil, err
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	return chatIDs, rows.Err()
+}
+
+// SetPhone меняет телефон пользователя чата
 func (s UsersStore) SetPhone(chatID int64, phone string) error {
-	// реализуйте обновление статуса в таблице parcel
 	_, err := s.db.Exec("UPDATE users SET phone = :phone WHERE chatId = :chatId",
 		sql.Named("chatId", chatID),
 		sql.Named("phone", phone))
@@ -103,96 +180,110 @@ func (s UsersStore) SetPhone(chatID int64, phone string) error {
 }
 
 func newOperation() *operation {
-	return &operation{}
+	return &operation{state: stateAwaitingObject, sessionId: newSessionId()}
 }
 
-func (o *operation) changeValue(fieldName string, value interface{}) {
-
-	switch fieldName {
-	case "numberObject":
-		o.numberObject = value.(string)
-	case "object":
-		o.object = value.(andromeda.GetSitesResponse)
-	case "customers":
-		o.customers = value.([]andromeda.GetCustomerResponse)
-	case "usersMyAlarm":
-		o.usersMyAlarm = value.([]andromeda.UserMyAlarmResponse)
-	case "currentRequest":
-		o.currentRequest = value.(string)
-	case "currentMenu":
-		o.currentMenu = value.(string)
-	case "checkPanicId":
-		o.checkPanicId = value.(string)
-	case "changedUserId":
-		o.changedUserId = value.(string)
-	case "role":
-		o.role = value.(string)
-	}
-
+// nextOperation возвращает новую сессию пользователя вместо завершенной.
+// Смена номера телефона, ожидающая подтверждения, переносится в новую сессию
+func nextOperation(operation *operation) *operation {
+	next := newOperation()
+	next.pendingPhone, next.pendingPhoneAt = operation.pendingPhone, operation.pendingPhoneAt
+	return next
 }
 
-// readConfig читает файл config.json и сохраняет в структуру config
-func readConfig() config {
-
-	file, err := os.Open("config.json")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	defer func(file *os.File) {
-		errClose := file.Close()
-		if errClose != nil {
-			log.Fatal(errClose)
-		}
-	}(file)
+// phoneChangeConfirmed проверяет, что контакт с номером phone повторно подтверждает смену номера
+// и время ожидания подтверждения не истекло
+func (o *operation) phoneChangeConfirmed(phone string, now time.Time) bool {
+	return o.pendingPhone == phone && now.Sub(o.pendingPhoneAt) <= pendingPhoneTimeout
+}
 
-	configuration := config{}
-	decoderConfig := json.NewDecoder(file)
-	err = decoderConfig.Decode(&configuration)
-	if err != nil {
-		log.Panic(err)
-	}
-	return configuration
+// resetRequest сбрасывает данные текущего запроса пользователя
+func (o *operation) resetRequest() {
+	o.currentRequest = ""
+	o.checkPanicId = ""
+	o.changedUserId = ""
+	o.role = ""
+	o.pages = nil
+	o.page = 0
 }
 
-// checkPhone проверяет ввод пользователем номера телефона
-func checkPhone(update *tgbotapi.Update, tgUser *map[int64]string, store UsersStore) bool {
+var (
+	errNoPhone        = errors.New("Номер телефона не подтвержден")
+	errForeignContact = errors.New("Контакт другого пользователя не принимается.")
+)
+
+// checkPhone проверяет, что телефон пользователя подтвержден, и сохраняет телефон из отправленного контакта.
+// Принимается только контакт самого отправителя. Смена подтвержденного ранее телефона требует повторной
+// отправки контакта с новым номером в течение pendingPhoneTimeout, другие сообщения между ними смену не отменяют
+func (a *app) checkPhone(update *tgbotapi.Update, operation *operation) error {
 
 	chatID := update.Message.Chat.ID
 
-	if update.Message.Contact == nil {
-		if phone, ok := (*tgUser)[chatID]; !ok {
-			err := store.Get(chatID, tgUser)
-			if err != nil {
-				return false
-			}
-			return true
-		} else if len(phone) != 12 {
-			return false
+	phone, ok := a.tgUser.Get(chatID)
+	if !ok {
+		if err := a.store.Get(chatID, a.tgUser); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Не удалось получить телефон пользователя чата %d: %v", chatID, err)
+			return errNoPhone
 		}
-		return true
+		phone = a.tgUser.Phone(chatID)
 	}
 
-	contactPhone, err := checkFormatPhone(update.Message.Contact.PhoneNumber)
+	contact := update.Message.Contact
+	if contact == nil {
+		if len(phone) != 12 {
+			return errNoPhone
+		}
+		return nil
+	}
+
+	if update.Message.From == nil || contact.UserID != update.Message.From.ID {
+		log.Printf("Безопасность: чат %d (%s) отправил чужой контакт %s пользователя %d, контакт отклонен", chatID, phone, contact.PhoneNumber, contact.UserID)
+		a.audit(chatID, auditEntry{action: "Contact", target: contact.PhoneNumber, result: auditDenied, details: fmt.Sprintf("чужой контакт пользователя %d", contact.UserID)})
+		return errForeignContact
+	}
+
+	contactPhone, err := checkFormatPhone(contact.PhoneNumber)
 	if err != nil {
-		return false
+		return err
 	}
 
-	if phone, ok := (*tgUser)[chatID]; !ok {
-		err = store.Add(chatID, contactPhone, tgUser)
-		if err != nil {
-			return false
+	switch {
+	case phone == "":
+		if err = a.store.Add(chatID, contactPhone, a.tgUser); err != nil {
+			log.Printf("Не удалось сохранить телефон %s пользователя чата %d: %v", contactPhone, chatID, err)
+			return errNoPhone
 		}
-		return true
-	} else if phone != contactPhone {
-		err = store.Add(chatID, contactPhone, tgUser)
-		if err != nil {
-			return false
+		a.audit(chatID, auditEntry{action: "Contact", target: contactPhone, result: auditOK, details: "телефон подтвержден"})
+	case phone == contactPhone:
+		operation.pendingPhone, operation.pendingPhoneAt = "", time.Time{}
+	case !operation.phoneChangeConfirmed(contactPhone, time.Now()):
+		operation.pendingPhone, operation.pendingPhoneAt = contactPhone, time.Now()
+		log.Printf("Безопасность: чат %d (%s) отправил контакт с другим номером %s, ожидается подтверждение смены номера", chatID, phone, contactPhone)
+		a.audit(chatID, auditEntry{action: "ChangePhone", target: contactPhone, result: auditPending, details: "ожидается подтверждение"})
+		return errors.Errorf("Номер телефона %s отличается от подтвержденного ранее %s. Для смены номера подтвердите его еще раз.", contactPhone, phone)
+	default:
+		if err = a.store.SetPhone(chatID, contactPhone); err != nil {
+			log.Printf("Не удалось сменить телефон пользователя чата %d: %v", chatID, err)
+			return errNoPhone
+		}
+		a.tgUser.Set(chatID, contactPhone)
+		operation.pendingPhone, operation.pendingPhoneAt = "", time.Time{}
+		a.audit(chatID, auditEntry{phone: contactPhone, action: "ChangePhone", target: phone, result: auditOK, details: phone + " → " + contactPhone})
+		if _, err = a.bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Номер телефона изменен: %s → %s.", phone, contactPhone))); err != nil {
+			log.Printf("Не удалось сообщить о смене телефона в чат %d: %v", chatID, err)
 		}
-		return true
 	}
+	return nil
+}
 
-	return false
+// phoneRejected снова запрашивает у пользователя номер телефона. Если контакт отклонен, выводится причина
+func phoneRejected(chatID int64, reason error) tgbotapi.MessageConfig {
+
+	msg := requestPhone(chatID)
+	if !errors.Is(reason, errNoPhone) {
+		msg.Text = reason.Error() + "\n" + msg.Text
+	}
+	return msg
 }
 
 // requestPhone запрашивает у пользователя номер телефона
@@ -227,7 +318,7 @@ func checkNumberObject(text string) (string, bool) {
 }
 
 // findObject получает объект по номеру
-func findObject(numberObject string, confSDK andromeda.Config, client *andromeda.Client, ctx *context.Context) (andromeda.GetSitesResponse, error) {
+func findObject(numberObject string, confSDK andromeda.Config, client andromedaClient, ctx *context.Context) (andromeda.GetSitesResponse, error) {
 
 	getSiteRequest := andromeda.GetSitesInput{
 		Id:     numberObject,
@@ -241,22 +332,42 @@ func findObject(numberObject string, confSDK andromeda.Config, client *andromeda
 	return getSiteResponse, nil
 }
 
-// checkUserRights проверяет права пользователя
-func checkUserRights(object andromeda.GetSitesResponse, operation *operation, chatID int64, confSDK andromeda.Config, tgUser *map[int64]string, phoneEngineer map[string]string, client *andromeda.Client, ctx *context.Context) bool {
+// checkUserRights проверяет права пользователя. Ответственное лицо работает со своим объектом, пользователь
+// с временным доступом - с объектом, к которому выдан доступ, инженер - с объектами, закрепленными за ним.
+// Инженеру вне его объектов возвращается ошибка *scopeError
+func (a *app) checkUserRights(object andromeda.GetSitesResponse, operation *operation, chatID int64, srv *backend, ctx *context.Context) (bool, error) {
 
 	getCustomersRequest := andromeda.GetCustomersInput{
 		SiteId: object.Id,
-		Config: confSDK,
+		Config: srv.confSDK,
 	}
 
-	getCustomersResponse, err := client.GetCustomers(*ctx, getCustomersRequest)
+	getCustomersResponse, err := srv.client.GetCustomers(*ctx, getCustomersRequest)
 	if err != nil {
-		return false
+		return false, err
+	}
+
+	phoneUser := a.tgUser.Phone(chatID)
+	if !isCustomer(phoneUser, getCustomersResponse) && !a.hasGrant(phoneUser, srv.name, strconv.Itoa(object.AccountNumber)) {
+		e, ok := a.engineers.Get(phoneUser)
+		if !ok || !e.active {
+			return false, nil
+		}
+		if scope := a.engineerScope(e); !scope.covers(srv.name, object.AccountNumber) {
+			return false, &scopeError{numberObject: strconv.Itoa(object.AccountNumber), scope: scope}
+		}
 	}
 
-	var useRights bool
-	phoneUser := (*tgUser)[chatID]
-	for _, customer := range getCustomersResponse {
+	operation.numberObject = strconv.Itoa(object.AccountNumber)
+	operation.object = object
+	operation.customers = getCustomersResponse
+	return true, nil
+}
+
+// isCustomer проверяет, что телефон принадлежит ответственному лицу объекта
+func isCustomer(phone string, customers []andromeda.GetCustomerResponse) bool {
+
+	for _, customer := range customers {
 		var phoneCustomer string
 		switch len(customer.ObjCustPhone1) {
 		case 12:
@@ -268,35 +379,17 @@ func checkUserRights(object andromeda.GetSitesResponse, operation *operation, ch
 		default:
 			phoneCustomer = ""
 		}
-		if phoneUser == phoneCustomer {
-			useRights = true
-			break
+		if phone == phoneCustomer {
+			return true
 		}
 	}
-
-	if !useRights && !isEngineer(phoneUser, phoneEngineer) {
-		return false
-	}
-
-	operation.changeValue("numberObject", strconv.Itoa(object.AccountNumber))
-	operation.changeValue("object", object)
-	operation.changeValue("customers", getCustomersResponse)
-	operation.changeValue("currentMenu", "MainMenu")
-	return true
-}
-
-// checkPhone проверяет права инженера
-func isEngineer(phone string, phoneEngineer map[string]string) bool {
-	if _, ok := phoneEngineer[phone]; ok {
-		return true
-	}
 	return false
 }
 
 // createMainMenu создает меню
 func createMenu(chatId int64, operation *operation) tgbotapi.MessageConfig {
 
-	if operation.currentMenu == "MyAlarmMenu" {
+	if operation.currentMenu == "MyAlarmMenu" && operation.permitted("MyAlarm") {
 		msg := createMyAlarmMenu(chatId, operation)
 		return msg
 	}
@@ -305,7 +398,7 @@ func createMenu(chatId int64, operation *operation) tgbotapi.MessageConfig {
 	return msg
 }
 
-// createMainMenu создает главное меню
+// createMainMenu создает главное меню из пунктов, доступных роли пользователя
 func createMainMenu(chatID int64, operation *operation) tgbotapi.MessageConfig {
 	mainMenu := []menu{
 		{"Получить информацию по объекту", "GetInfoObject"},
@@ -317,13 +410,17 @@ func createMainMenu(chatID int64, operation *operation) tgbotapi.MessageConfig {
 		{"Завершить работу с объектом", "Finish"},
 	}
 
-	operation.changeValue("currentMenu", "MainMenu")
-	operation.changeValue("currentRequest", "")
+	operation.resetRequest()
+	operation.currentMenu = "MainMenu"
+	operation.setState(stateMainMenu)
 
 	keyboard := tgbotapi.InlineKeyboardMarkup{}
 	for _, button := range mainMenu {
+		if slices.Contains(menuActions, button.callbackData) && !operation.permitted(button.callbackData) {
+			continue
+		}
 		var row []tgbotapi.InlineKeyboardButton
-		btn := tgbotapi.NewInlineKeyboardButtonData(button.text, button.callbackData)
+		btn := callbackButton(operation, button.text, button.callbackData, "")
 		row = append(row, btn)
 		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, row)
 	}
@@ -333,7 +430,7 @@ func createMainMenu(chatID int64, operation *operation) tgbotapi.MessageConfig {
 	return msg
 }
 
-// createMyAlarmMenu создает меню MyAlarm
+// createMyAlarmMenu создает меню MyAlarm из пунктов, доступных роли пользователя
 func createMyAlarmMenu(chatID int64, operation *operation) tgbotapi.MessageConfig {
 	mainMenu := []menu{
 		{"Список пользователей MyAlarm объекта", "GetUsersMyAlarm"},
@@ -345,10 +442,17 @@ func createMyAlarmMenu(chatID int64, operation *operation) tgbotapi.MessageConfi
 		{"Завершить работу с объектом", "Finish"},
 	}
 
+	operation.resetRequest()
+	operation.currentMenu = "MyAlarmMenu"
+	operation.setState(stateMyAlarmMenu)
+
 	keyboard := tgbotapi.InlineKeyboardMarkup{}
 	for _, button := range mainMenu {
+		if slices.Contains(menuActions, button.callbackData) && !operation.permitted(button.callbackData) {
+			continue
+		}
 		var row []tgbotapi.InlineKeyboardButton
-		btn := tgbotapi.NewInlineKeyboardButtonData(button.text, button.callbackData)
+		btn := callbackButton(operation, button.text, button.callbackData, "")
 		row = append(row, btn)
 		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, row)
 	}
@@ -359,35 +463,35 @@ func createMyAlarmMenu(chatID int64, operation *operation) tgbotapi.MessageConfi
 }
 
 // addBtnBack добавляет кнопку назад к сообщениям
-func addButtons(currentRequest string, enableResult, addRole bool) tgbotapi.InlineKeyboardMarkup {
+func addButtons(operation *operation, enableResult, addRole bool) tgbotapi.InlineKeyboardMarkup {
 
 	keyboard := tgbotapi.NewInlineKeyboardMarkup()
 
-	if (currentRequest == "ChecksKTS" || currentRequest == "ResultCheckKTS") && enableResult {
-		btnKTS := tgbotapi.NewInlineKeyboardButtonData("Получить результат проверки КТС", "ResultCheckKTS")
+	if (operation.currentRequest == "ChecksKTS" || operation.currentRequest == "ResultCheckKTS") && enableResult {
+		btnKTS := callbackButton(operation, "Получить результат проверки КТС", "ResultCheckKTS", "")
 		var rowKTS []tgbotapi.InlineKeyboardButton
 		rowKTS = append(rowKTS, btnKTS)
 		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, rowKTS)
 	}
 
 	if addRole {
-		btnAdmin := tgbotapi.NewInlineKeyboardButtonData("Администратор", "admin")
+		btnAdmin := callbackButton(operation, "Администратор", "SelectRole", "admin")
 		var rowAdmin []tgbotapi.InlineKeyboardButton
 		rowAdmin = append(rowAdmin, btnAdmin)
 		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, rowAdmin)
 
-		btnUser := tgbotapi.NewInlineKeyboardButtonData("Пользователь", "user")
+		btnUser := callbackButton(operation, "Пользователь", "SelectRole", "user")
 		var rowUser []tgbotapi.InlineKeyboardButton
 		rowUser = append(rowUser, btnUser)
 		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, rowUser)
 	}
 
-	btn := tgbotapi.NewInlineKeyboardButtonData("Назад", "Back")
+	btn := callbackButton(operation, "Назад", "Back", "")
 	var row []tgbotapi.InlineKeyboardButton
 	row = append(row, btn)
 	keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, row)
 
-	btnFinish := tgbotapi.NewInlineKeyboardButtonData("Завершить работу с объектом", "Finish")
+	btnFinish := callbackButton(operation, "Завершить работу с объектом", "Finish", "")
 	var rowFinish []tgbotapi.InlineKeyboardButton
 	rowFinish = append(rowFinish, btnFinish)
 	keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, rowFinish)
@@ -395,8 +499,41 @@ func addButtons(currentRequest string, enableResult, addRole bool) tgbotapi.Inli
 	return keyboard
 }
 
+// requestFailed формирует ответ на неудачный запрос к ПО "Центр охраны". Если сервер не отвечает
+// или не смог выполнить запрос, сообщает об этом и предлагает повторить запрос, иначе выводит text
+func requestFailed(chatID int64, operation *operation, err error, text string) tgbotapi.MessageConfig {
+
+	log.Printf("Запрос %s по объекту %s сервера %q не выполнен: %v", operation.currentRequest, operation.numberObject, operation.server, err)
+
+	if isRetryable(err) {
+		return unavailableMessage(chatID, operation, err)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = addButtons(operation, false, false)
+	return msg
+}
+
+// unavailableMessage сообщает, что сервер ПО "Центр охраны" не отвечает или не смог выполнить запрос.
+// Запросы, которые безопасно повторить, можно повторить кнопкой "Повторить"
+func unavailableMessage(chatID int64, operation *operation, err error) tgbotapi.MessageConfig {
+
+	keyboard := addButtons(operation, false, false)
+	text := unavailableText(err) + "\nПовторите попытку позже."
+
+	if slices.Contains(retryableRequests, operation.currentRequest) {
+		text = unavailableText(err) + "\nНажмите \"Повторить\" или повторите попытку позже."
+		retry := tgbotapi.NewInlineKeyboardRow(callbackButton(operation, "Повторить", "Retry", ""))
+		keyboard.InlineKeyboard = append([][]tgbotapi.InlineKeyboardButton{retry}, keyboard.InlineKeyboard...)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = keyboard
+	return msg
+}
+
 // checksKTSRequest проверка КТС
-func checksKTSRequest(operation *operation, chatID int64, confSDK andromeda.Config, client *andromeda.Client, ctx context.Context) tgbotapi.MessageConfig {
+func (a *app) checksKTSRequest(operation *operation, chatID int64, confSDK andromeda.Config, client andromedaClient, ctx context.Context) tgbotapi.MessageConfig {
 
 	if operation.currentRequest == "ChecksKTS" {
 		PostCheckPanicRequest := andromeda.PostCheckPanicInput{
@@ -404,9 +541,18 @@ func checksKTSRequest(operation *operation, chatID int64, confSDK andromeda.Conf
 			Config: confSDK,
 		}
 		PostCheckPanicResponse, err := client.PostCheckPanic(ctx, PostCheckPanicRequest)
+		entry := auditEntry{role: operation.userRole, object: operation.numberObject, server: a.backendOf(operation).name, action: "ChecksKTS", result: auditOK,
+			details: "PostCheckPanic: " + PostCheckPanicResponse.Description}
+		switch {
+		case err != nil:
+			entry.result, entry.details = auditFailed, "PostCheckPanic: "+err.Error()
+		case PostCheckPanicResponse.Description != "success":
+			entry.result = auditFailed
+		}
+		a.audit(chatID, entry)
 		if err != nil {
-			msg := tgbotapi.NewMessage(chatID, "Не удалось получить данные")
-			msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+			msg := requestFailed(chatID, operation, err, "Не удалось получить данные")
+			operation.setState(stateShowingResult)
 			return msg
 		}
 
@@ -422,19 +568,22 @@ func checksKTSRequest(operation *operation, chatID int64, confSDK andromeda.Conf
 			text := fmt.Sprintf("По объекту уже выполняется проверка КТС.\nДождитесь автоматического завершения проверки (макс. 3 мин.) или " +
 				"отправьте тревогу КТС, для завершения ранее начатой проверки.\nИ повторите попытку снова.")
 			msg := tgbotapi.NewMessage(chatID, text)
-			msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+			msg.ReplyMarkup = addButtons(operation, false, false)
+			operation.setState(stateShowingResult)
 			return msg
 		} else if PostCheckPanicResponse.Description != "success" {
 			msg := tgbotapi.NewMessage(chatID, PostCheckPanic[PostCheckPanicResponse.Description])
-			msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+			msg.ReplyMarkup = addButtons(operation, false, false)
+			operation.setState(stateShowingResult)
 			return msg
 		}
 
-		operation.changeValue("checkPanicId", PostCheckPanicResponse.CheckPanicId)
+		operation.checkPanicId = PostCheckPanicResponse.CheckPanicId
 
 		text := fmt.Sprintf("%s\nВ течении 180 сек. нажмите кнпку КТС.\nИ нажмите кнопку \"Получить результат проверки КТС\"", PostCheckPanic[PostCheckPanicResponse.Description])
 		msg := tgbotapi.NewMessage(chatID, text)
-		msg.ReplyMarkup = addButtons(operation.currentRequest, true, false)
+		msg.ReplyMarkup = addButtons(operation, true, false)
+		operation.setState(stateAwaitingKTSPress)
 		return msg
 	} else if operation.currentRequest == "ResultCheckKTS" {
 
@@ -445,8 +594,14 @@ func checksKTSRequest(operation *operation, chatID int64, confSDK andromeda.Conf
 
 		GetCheckPanicResponse, err := client.GetCheckPanic(ctx, GetCheckPanicRequest)
 		if err != nil {
-			msg := tgbotapi.NewMessage(chatID, err.Error())
-			msg.ReplyMarkup = addButtons(operation.currentRequest, true, false)
+			//Повтором служит кнопка получения результата
+			text := err.Error()
+			if isRetryable(err) {
+				text = unavailableText(err) + "\nНажмите \"Получить результат проверки КТС\" еще раз или повторите попытку позже."
+			}
+			msg := tgbotapi.NewMessage(chatID, text)
+			msg.ReplyMarkup = addButtons(operation, true, false)
+			operation.setState(stateAwaitingKTSPress)
 			return msg
 		}
 
@@ -461,35 +616,46 @@ func checksKTSRequest(operation *operation, chatID int64, confSDK andromeda.Conf
 
 		msg := tgbotapi.NewMessage(chatID, CheckPanicResponse[GetCheckPanicResponse.Description])
 		if GetCheckPanicResponse.Description == "in progress" {
-			msg.ReplyMarkup = addButtons(operation.currentRequest, true, false)
+			msg.ReplyMarkup = addButtons(operation, true, false)
+			operation.setState(stateAwaitingKTSPress)
 		} else {
-			msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+			result := auditFailed
+			if strings.HasPrefix(GetCheckPanicResponse.Description, "success") {
+				result = auditOK
+			}
+			a.audit(chatID, auditEntry{role: operation.userRole, object: operation.numberObject, server: a.backendOf(operation).name, action: "ResultCheckKTS", result: result,
+				details: "GetCheckPanic: " + GetCheckPanicResponse.Description})
+			msg.ReplyMarkup = addButtons(operation, false, false)
+			operation.setState(stateShowingResult)
 		}
 		return msg
 	}
 	msg := tgbotapi.NewMessage(chatID, "Неизвестная команда")
-	msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+	msg.ReplyMarkup = addButtons(operation, false, false)
+	operation.setState(stateShowingResult)
 	return msg
 }
 
 // getUsersMyAlarm получение данных о пользователях MyAlarm
-func getUsersMyAlarm(ctx context.Context, client *andromeda.Client, confSDK andromeda.Config, operation *operation, chatID int64) tgbotapi.MessageConfig {
+func (a *app) getUsersMyAlarm(ctx context.Context, client andromedaClient, confSDK andromeda.Config, operation *operation, chatID int64) tgbotapi.MessageConfig {
 
 	usersMyAlarmRequest := andromeda.GetUsersMyAlarmInput{
 		SiteId: operation.object.Id,
 		Config: confSDK,
 	}
 	usersMyAlarmResponse, err := client.GetUsersMyAlarm(ctx, usersMyAlarmRequest)
+	a.auditView(chatID, operation, "GetUsersMyAlarm", err)
 	if err != nil {
-		msg := tgbotapi.NewMessage(chatID, "Не удалось получить данные")
-		msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
-		return msg
+		return requestFailed(chatID, operation, err, "Не удалось получить данные")
 	}
 
-	text := ""
 	if len(usersMyAlarmResponse) == 0 {
-		text = "Не найдено ни одного пользователя"
+		msg := tgbotapi.NewMessage(chatID, "Не найдено ни одного пользователя")
+		msg.ReplyMarkup = addButtons(operation, false, false)
+		return msg
 	}
+
+	var items []string
 	for _, user := range usersMyAlarmResponse {
 		var kts string
 		var role string
@@ -511,20 +677,17 @@ func getUsersMyAlarm(ctx context.Context, client *andromeda.Client, confSDK andr
 
 		userMyAlarmResponse, err := client.GetCustomer(ctx, userMyAlarmRequest)
 		if err != nil {
-			msg := tgbotapi.NewMessage(chatID, "Не удалось получить данные")
-			msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
-			return msg
+			return requestFailed(chatID, operation, err, "Не удалось получить данные")
 		}
 
-		text += fmt.Sprintf("ФИО: %s\nТел.: %s\nРоль: %s\nКТС: %s\n\n", userMyAlarmResponse.ObjCustName, user.MyAlarmPhone, role, kts)
+		items = append(items, fmt.Sprintf("ФИО: %s\nТел.: %s\nРоль: %s\nКТС: %s", userMyAlarmResponse.ObjCustName, user.MyAlarmPhone, role, kts))
 	}
-	msg := tgbotapi.NewMessage(chatID, text)
-	msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
-	return msg
+	return listMessage(chatID, operation, items)
 }
 
-// haveMyAlarmRights проверяет права пользователя на систему MyAlarm и получает данные о пользователях системы MyAlarm
-func haveMyAlarmRights(ctx context.Context, client *andromeda.Client, confSDK andromeda.Config, operation *operation, chatID int64, tgUser map[int64]string, phoneEngineer map[string]string) bool {
+// haveMyAlarmRights проверяет права пользователя на систему MyAlarm и получает данные о пользователях системы MyAlarm.
+// Права есть у пользователя MyAlarm объекта и у инженера, роль которого на объекте дает доступ к MyAlarm
+func haveMyAlarmRights(ctx context.Context, client andromedaClient, confSDK andromeda.Config, operation *operation, phoneUser string) (bool, error) {
 
 	usersMyAlarmRequest := andromeda.GetUsersMyAlarmInput{
 		SiteId: operation.object.Id,
@@ -532,14 +695,10 @@ func haveMyAlarmRights(ctx context.Context, client *andromeda.Client, confSDK an
 	}
 	usersMyAlarmResponse, err := client.GetUsersMyAlarm(ctx, usersMyAlarmRequest)
 	if err != nil {
-		msg := tgbotapi.NewMessage(chatID, "Не удалось получить данные")
-		msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
-		return false
+		return false, err
 	}
 
-	operation.changeValue("usersMyAlarm", usersMyAlarmResponse)
-
-	phoneUser := tgUser[chatID]
+	operation.usersMyAlarm = usersMyAlarmResponse
 
 	var validUser bool
 	for _, user := range operation.usersMyAlarm {
@@ -549,35 +708,42 @@ func haveMyAlarmRights(ctx context.Context, client *andromeda.Client, confSDK an
 		}
 	}
 
-	if !validUser && !isEngineer(phoneUser, phoneEngineer) {
-		return false
+	if !validUser && !(engineerRole(operation.userRole) && operation.permitted("MyAlarm")) {
+		return false, nil
 	}
 
-	return true
+	return true, nil
 }
 
-// getUserObjectMyAlarm получает объекты пользователя MyAlarm
-func getUserObjectMyAlarm(tgUser map[int64]string, chatID int64, phoneEngineer map[string]string, operation *operation, update *tgbotapi.Update, ctx context.Context, client *andromeda.Client, confSDK andromeda.Config) tgbotapi.MessageConfig {
+// getUserObjectMyAlarm получает объекты пользователя MyAlarm. Инженер видит только объекты, закрепленные за ним
+func (a *app) getUserObjectMyAlarm(chatID int64, operation *operation, update *tgbotapi.Update, ctx context.Context, client andromedaClient, confSDK andromeda.Config) tgbotapi.MessageConfig {
 
 	var err error
 
-	phone := tgUser[chatID]
+	phone := a.tgUser.Phone(chatID)
+	e, isEngineer := a.engineers.Get(phone)
+	isEngineer = isEngineer && e.active
+	scope := a.engineerScope(e)
 
-	if isEngineer(phone, phoneEngineer) {
+	if isEngineer {
 		if update.Message == nil {
 			msg := tgbotapi.NewMessage(chatID, "Введите номер телефона пользователя в формате: +7xxxxxxxxxx")
-			msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+			msg.ReplyMarkup = addButtons(operation, false, false)
+			operation.setState(stateAwaitingUserPhone)
 			return msg
 		} else {
 			phone, err = checkFormatPhone(update.Message.Text)
 			if err != nil {
 				msg := tgbotapi.NewMessage(chatID, err.Error())
-				msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+				msg.ReplyMarkup = addButtons(operation, false, false)
+				operation.setState(stateAwaitingUserPhone)
 				return msg
 			}
 		}
 	}
 
+	operation.setState(stateShowingResult)
+
 	userObjectMyAlarmRequest := andromeda.GetUserObjectMyAlarmInput{
 		Phone:  phone,
 		Config: confSDK,
@@ -585,17 +751,15 @@ func getUserObjectMyAlarm(tgUser map[int64]string, chatID int64, phoneEngineer m
 
 	userObjectMyAlarmResponse, err := client.GetUserObjectMyAlarm(ctx, userObjectMyAlarmRequest)
 	if err != nil {
-		msg := tgbotapi.NewMessage(chatID, err.Error())
-		msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
-		return msg
+		return requestFailed(chatID, operation, err, err.Error())
 	}
 	if len(userObjectMyAlarmResponse) == 0 {
 		msg := tgbotapi.NewMessage(chatID, "У пользователя с номером "+phone+" нет объектов в приложении MyAlarm")
-		msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+		msg.ReplyMarkup = addButtons(operation, false, false)
 		return msg
 	}
 
-	text := ""
+	var items, hidden []string
 	for _, object := range userObjectMyAlarmResponse {
 		var kts string
 		var role string
@@ -618,16 +782,24 @@ func getUserObjectMyAlarm(tgUser map[int64]string, chatID int64, phoneEngineer m
 
 		getSiteResponse, err := client.GetSites(ctx, getSiteRequest)
 		if err != nil {
-			msg := tgbotapi.NewMessage(chatID, err.Error())
-			msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
-			return msg
+			return requestFailed(chatID, operation, err, err.Error())
+		}
+
+		if isEngineer && !scope.covers(a.backendOf(operation).name, getSiteResponse.AccountNumber) {
+			hidden = append(hidden, strconv.Itoa(getSiteResponse.AccountNumber))
+			continue
 		}
 
-		text += fmt.Sprintf("№ объекта: %d\nНаименование: %s\nАдрес: %s\nРоль: %s\nКТС: %s\n\n", getSiteResponse.AccountNumber, getSiteResponse.Name, getSiteResponse.Address, role, kts)
+		items = append(items, fmt.Sprintf("№ объекта: %d\nНаименование: %s\nАдрес: %s\nРоль: %s\nКТС: %s", getSiteResponse.AccountNumber, getSiteResponse.Name, getSiteResponse.Address, role, kts))
 	}
-	msg := tgbotapi.NewMessage(chatID, text)
-	msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
-	return msg
+	if len(hidden) > 0 {
+		a.audit(chatID, auditEntry{role: operation.userRole, object: operation.numberObject, server: a.backendOf(operation).name, action: "GetUserObjectMyAlarm", target: phone, result: auditDenied,
+			details: "скрыты объекты, не закрепленные за инженером: " + strings.Join(hidden, ", ")})
+		items = append(items, fmt.Sprintf("Объекты, не закрепленные за вами, скрыты: %d", len(hidden)))
+	} else {
+		a.audit(chatID, auditEntry{role: operation.userRole, object: operation.numberObject, server: a.backendOf(operation).name, action: "GetUserObjectMyAlarm", target: phone, result: auditOK})
+	}
+	return listMessage(chatID, operation, items)
 }
 
 func checkFormatPhone(phone string) (string, error) {
@@ -647,22 +819,13 @@ func checkFormatPhone(phone string) (string, error) {
 	return userPhone, nil
 }
 
-func putChangeUserMyAlarm(operation *operation, phoneUser string, phoneEngineer map[string]string, chatID int64, ctx context.Context, client *andromeda.Client, confSDK andromeda.Config) tgbotapi.MessageConfig {
+func (a *app) putChangeUserMyAlarm(operation *operation, chatID int64, ctx context.Context, client andromedaClient, confSDK andromeda.Config) tgbotapi.MessageConfig {
 
 	if operation.changedUserId == "" {
-		var isAdmin bool
-		for _, user := range operation.usersMyAlarm {
-			if user.MyAlarmPhone == phoneUser {
-				if user.Role == "admin" {
-					isAdmin = true
-				}
-				break
-			}
-		}
-
-		if !isEngineer(phoneUser, phoneEngineer) && !isAdmin {
+		if !operation.permitted(operation.currentRequest) {
 			msg := tgbotapi.NewMessage(chatID, "У вас нет прав управлять пользователями MyAlarm")
-			msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+			msg.ReplyMarkup = addButtons(operation, false, false)
+			operation.setState(stateShowingResult)
 			return msg
 		}
 
@@ -671,7 +834,8 @@ func putChangeUserMyAlarm(operation *operation, phoneUser string, phoneEngineer
 
 			if len(operation.usersMyAlarm) == 0 {
 				msg := tgbotapi.NewMessage(chatID, "Не найдено ни одного пользователя MyAlarm")
-				msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+				msg.ReplyMarkup = addButtons(operation, false, false)
+				operation.setState(stateShowingResult)
 				return msg
 			}
 
@@ -685,7 +849,7 @@ func putChangeUserMyAlarm(operation *operation, phoneUser string, phoneEngineer
 				}
 
 				var row []tgbotapi.InlineKeyboardButton
-				btn := tgbotapi.NewInlineKeyboardButtonData(text, userMyAlarm.CustomerID)
+				btn := callbackButton(operation, text, "SelectUser", userMyAlarm.CustomerID)
 				row = append(row, btn)
 				keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, row)
 			}
@@ -697,16 +861,17 @@ func putChangeUserMyAlarm(operation *operation, phoneUser string, phoneEngineer
 				}
 
 				var row []tgbotapi.InlineKeyboardButton
-				btn := tgbotapi.NewInlineKeyboardButtonData(customer.ObjCustName+", "+customer.ObjCustPhone1, customer.Id)
+				btn := callbackButton(operation, customer.ObjCustName+", "+customer.ObjCustPhone1, "SelectUser", customer.Id)
 				row = append(row, btn)
 				keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, row)
 			}
 		}
 
-		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, addButtons(operation.currentRequest, false, false).InlineKeyboard...)
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, addButtons(operation, false, false).InlineKeyboard...)
 
 		msg := tgbotapi.NewMessage(chatID, "Выберите пользователя")
 		msg.ReplyMarkup = &keyboard
+		operation.setState(stateSelectingUser)
 		return msg
 	}
 
@@ -719,7 +884,8 @@ func putChangeUserMyAlarm(operation *operation, phoneUser string, phoneEngineer
 		role = "user"
 	} else {
 		msg := tgbotapi.NewMessage(chatID, "Выберите права пользователя")
-		msg.ReplyMarkup = addButtons(operation.currentRequest, false, true)
+		msg.ReplyMarkup = addButtons(operation, false, true)
+		operation.setState(stateSelectingRole)
 		return msg
 	}
 
@@ -731,6 +897,15 @@ func putChangeUserMyAlarm(operation *operation, phoneUser string, phoneEngineer
 	}
 
 	putChangeUserMyAlarmResponse, err := client.PutChangeUserMyAlarm(ctx, putChangeUserMyAlarmRequest)
+	entry := auditEntry{role: operation.userRole, object: operation.numberObject, server: a.backendOf(operation).name, action: operation.currentRequest,
+		target: customerTarget(operation, operation.changedUserId), result: auditOK, details: "PutChangeUserMyAlarm: роль " + role}
+	switch {
+	case err != nil:
+		entry.result, entry.details = auditFailed, entry.details+": "+err.Error()
+	case putChangeUserMyAlarmResponse.Message != "":
+		entry.result, entry.details = auditFailed, entry.details+": "+putChangeUserMyAlarmResponse.Message
+	}
+	a.audit(chatID, entry)
 	if err != nil {
 		var text string
 		if strings.Contains(err.Error(), "User already has role,") {
@@ -745,8 +920,8 @@ func putChangeUserMyAlarm(operation *operation, phoneUser string, phoneEngineer
 			text = fmt.Sprintf("Не удалось %s. Попробуйте позже.", data)
 		}
 
-		msg := tgbotapi.NewMessage(chatID, text)
-		msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+		msg := requestFailed(chatID, operation, err, text)
+		operation.setState(stateShowingResult)
 		return msg
 	}
 
@@ -757,34 +932,27 @@ func putChangeUserMyAlarm(operation *operation, phoneUser string, phoneEngineer
 		} else {
 			data = "добавлен"
 		}
-		operation.changeValue("changedUserId", "")
-		operation.changeValue("role", "")
+		operation.changedUserId = ""
+		operation.role = ""
 		msg := tgbotapi.NewMessage(chatID, "Пользователь MyAlarm успешно "+data)
-		msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+		msg.ReplyMarkup = addButtons(operation, false, false)
+		operation.setState(stateShowingResult)
 		return msg
 	}
 
 	msg := tgbotapi.NewMessage(chatID, "Неизвестная команда")
-	msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+	msg.ReplyMarkup = addButtons(operation, false, false)
+	operation.setState(stateShowingResult)
 	return msg
 }
 
-func putChangeVirtualKTS(operation *operation, phoneUser string, phoneEngineer map[string]string, chatID int64, ctx context.Context, client *andromeda.Client, confSDK andromeda.Config) tgbotapi.MessageConfig {
+func (a *app) putChangeVirtualKTS(operation *operation, chatID int64, ctx context.Context, client andromedaClient, confSDK andromeda.Config) tgbotapi.MessageConfig {
 
 	if operation.changedUserId == "" {
-		var isAdmin bool
-		for _, user := range operation.usersMyAlarm {
-			if user.MyAlarmPhone == phoneUser {
-				if user.Role == "admin" {
-					isAdmin = true
-				}
-				break
-			}
-		}
-
-		if !isEngineer(phoneUser, phoneEngineer) && !isAdmin {
+		if !operation.permitted(operation.currentRequest) {
 			msg := tgbotapi.NewMessage(chatID, "У вас нет прав управлять пользователями MyAlarm")
-			msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+			msg.ReplyMarkup = addButtons(operation, false, false)
+			operation.setState(stateShowingResult)
 			return msg
 		}
 
@@ -792,7 +960,8 @@ func putChangeVirtualKTS(operation *operation, phoneUser string, phoneEngineer m
 
 		if len(operation.usersMyAlarm) == 0 {
 			msg := tgbotapi.NewMessage(chatID, "Не найдено ни одного пользователя MyAlarm")
-			msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+			msg.ReplyMarkup = addButtons(operation, false, false)
+			operation.setState(stateShowingResult)
 			return msg
 		}
 
@@ -806,34 +975,36 @@ func putChangeVirtualKTS(operation *operation, phoneUser string, phoneEngineer m
 			}
 
 			var row []tgbotapi.InlineKeyboardButton
-			btn := tgbotapi.NewInlineKeyboardButtonData(text, userMyAlarm.CustomerID)
+			btn := callbackButton(operation, text, "SelectUser", userMyAlarm.CustomerID)
 			row = append(row, btn)
 			keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, row)
 		}
 
-		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, addButtons(operation.currentRequest, false, false).InlineKeyboard...)
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, addButtons(operation, false, false).InlineKeyboard...)
 
 		msg := tgbotapi.NewMessage(chatID, "Выберите пользователя")
 		msg.ReplyMarkup = &keyboard
+		operation.setState(stateSelectingUser)
 		return msg
 	}
 
 	if operation.role == "" {
 		keyboard := tgbotapi.NewInlineKeyboardMarkup()
-		btnTrue := tgbotapi.NewInlineKeyboardButtonData("Разрешить", "true")
+		btnTrue := callbackButton(operation, "Разрешить", "SelectKTS", "true")
 		var rowTrue []tgbotapi.InlineKeyboardButton
 		rowTrue = append(rowTrue, btnTrue)
 		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, rowTrue)
 
-		btnFalse := tgbotapi.NewInlineKeyboardButtonData("Запретить", "false")
+		btnFalse := callbackButton(operation, "Запретить", "SelectKTS", "false")
 		var rowFalse []tgbotapi.InlineKeyboardButton
 		rowFalse = append(rowFalse, btnFalse)
 		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, rowFalse)
 
-		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, addButtons(operation.currentRequest, false, false).InlineKeyboard...)
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, addButtons(operation, false, false).InlineKeyboard...)
 
 		msg := tgbotapi.NewMessage(chatID, "Разрешить или запретить виртуальную КТС?")
 		msg.ReplyMarkup = &keyboard
+		operation.setState(stateSelectingKTS)
 		return msg
 	}
 
@@ -849,8 +1020,15 @@ func putChangeVirtualKTS(operation *operation, phoneUser string, phoneEngineer m
 	}
 
 	err := client.PutChangeKTSUserMyAlarm(ctx, putChangeVirtualKTSRequest)
+	entry := auditEntry{role: operation.userRole, object: operation.numberObject, server: a.backendOf(operation).name, action: operation.currentRequest,
+		target: customerTarget(operation, operation.changedUserId), result: auditOK, details: fmt.Sprintf("PutChangeKTSUserMyAlarm: isPanic %t", isPanic)}
+	if err != nil {
+		entry.result, entry.details = auditFailed, entry.details+": "+err.Error()
+	}
+	a.audit(chatID, entry)
 	if err != nil {
-		msg := tgbotapi.NewMessage(chatID, "Не удалось изменить значение виртуальной КТС")
+		msg := requestFailed(chatID, operation, err, "Не удалось изменить значение виртуальной КТС")
+		operation.setState(stateShowingResult)
 		return msg
 	}
 
@@ -861,23 +1039,62 @@ func putChangeVirtualKTS(operation *operation, phoneUser string, phoneEngineer m
 		data = "запрещена."
 	}
 
-	operation.changeValue("changedUserId", "")
-	operation.changeValue("role", "")
+	operation.changedUserId = ""
+	operation.role = ""
 
 	msg := tgbotapi.NewMessage(chatID, "Виртуальная КТС у пользователя "+data)
+	msg.ReplyMarkup = addButtons(operation, false, false)
+	operation.setState(stateShowingResult)
 	return msg
 }
 
+// customerTarget возвращает ФИО и телефон ответственного лица с идентификатором custID для журнала аудита
+func customerTarget(operation *operation, custID string) string {
+
+	var name, phone string
+	for _, customer := range operation.customers {
+		if customer.Id == custID {
+			name, phone = customer.ObjCustName, customer.ObjCustPhone1
+			break
+		}
+	}
+	for _, user := range operation.usersMyAlarm {
+		if user.CustomerID == custID {
+			phone = user.MyAlarmPhone
+			break
+		}
+	}
+
+	switch {
+	case name != "" && phone != "":
+		return name + ", " + phone
+	case name != "" || phone != "":
+		return name + phone
+	}
+	return custID
+}
+
+// getCustomers выводит список ответственных лиц объекта
+func getCustomers(operation *operation, chatID int64) tgbotapi.MessageConfig {
+
+	var items []string
+	for _, customer := range operation.customers {
+		items = append(items, fmt.Sprintf("№: %d\nФИО: %s\nТел.: %s", customer.UserNumber, customer.ObjCustName, customer.ObjCustPhone1))
+	}
+
+	return listMessage(chatID, operation, items)
+}
+
 func getInfoObject(operation operation, chatID int64) tgbotapi.MessageConfig {
 
 	text := fmt.Sprintf("№ объекта: %d\nНаименование: %s\nАдрес: %s\n", operation.object.AccountNumber, operation.object.Name, operation.object.Address)
 
 	msg := tgbotapi.NewMessage(chatID, text)
-	msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+	msg.ReplyMarkup = addButtons(&operation, false, false)
 	return msg
 }
 
-func GetParts(operation operation, chatID int64, ctx context.Context, client *andromeda.Client, confSDK andromeda.Config) tgbotapi.MessageConfig {
+func (a *app) GetParts(operation *operation, chatID int64, ctx context.Context, client andromedaClient, confSDK andromeda.Config) tgbotapi.MessageConfig {
 
 	getPartsRequest := andromeda.GetPartsInput{
 		SiteId: operation.object.Id,
@@ -885,19 +1102,18 @@ func GetParts(operation operation, chatID int64, ctx context.Context, client *an
 	}
 
 	getPartsResponse, err := client.GetParts(ctx, getPartsRequest)
+	a.auditView(chatID, operation, "GetParts", err)
 	if err != nil {
-		msg := tgbotapi.NewMessage(chatID, "Не удалось получить данные по объекту")
-		msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
-		return msg
+		return requestFailed(chatID, operation, err, "Не удалось получить данные по объекту")
 	}
 
 	if len(getPartsResponse) == 0 {
 		msg := tgbotapi.NewMessage(chatID, "По объекту нет разделов.")
-		msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+		msg.ReplyMarkup = addButtons(operation, false, false)
 		return msg
 	}
 
-	text := ""
+	var items []string
 	for _, part := range getPartsResponse {
 		IsStateArm := ""
 		if part.IsStateArm {
@@ -914,14 +1130,12 @@ func GetParts(operation operation, chatID int64, ctx context.Context, client *an
 
 		date, _ := time.Parse("2006-01-02T15:04:05", part.StateArmDisArmDateTime)
 		dateString := date.Format("02/01/2006 15:04:05")
-		text += fmt.Sprintf("Номер раздела: %d\nОписание раздела: %s\nСостояние раздела: %s\nТревога по разделу: %s\nВремя последнего взятия/снятия: %s\n\n", part.PartNumber, part.PartDesc, IsStateArm, IsStateAlarm, dateString)
+		items = append(items, fmt.Sprintf("Номер раздела: %d\nОписание раздела: %s\nСостояние раздела: %s\nТревога по разделу: %s\nВремя последнего взятия/снятия: %s", part.PartNumber, part.PartDesc, IsStateArm, IsStateAlarm, dateString))
 	}
-	msg := tgbotapi.NewMessage(chatID, text)
-	msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
-	return msg
+	return listMessage(chatID, operation, items)
 }
 
-func GetZones(operation operation, chatID int64, ctx context.Context, client *andromeda.Client, confSDK andromeda.Config) tgbotapi.MessageConfig {
+func (a *app) GetZones(operation *operation, chatID int64, ctx context.Context, client andromedaClient, confSDK andromeda.Config) tgbotapi.MessageConfig {
 
 	getZonesRequest := andromeda.GetZonesInput{
 		SiteId: operation.object.Id,
@@ -929,262 +1143,232 @@ func GetZones(operation operation, chatID int64, ctx context.Context, client *an
 	}
 
 	getZonesResponse, err := client.GetZones(ctx, getZonesRequest)
+	a.auditView(chatID, operation, "GetZones", err)
 	if err != nil {
-		msg := tgbotapi.NewMessage(chatID, "Не удалось получить данные по объекту")
-		msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
-		return msg
+		return requestFailed(chatID, operation, err, "Не удалось получить данные по объекту")
 	}
 
 	if len(getZonesResponse) == 0 {
 		msg := tgbotapi.NewMessage(chatID, "По объекту нет шлейфов.")
-		msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
+		msg.ReplyMarkup = addButtons(operation, false, false)
 		return msg
 	}
 
-	text := ""
+	var items []string
 	for _, part := range getZonesResponse {
-		text += fmt.Sprintf("Номер шлейфа: %d\nОписание шлейфа: %s\n\n", part.ZoneNumber, part.ZoneDesc)
+		items = append(items, fmt.Sprintf("Номер шлейфа: %d\nОписание шлейфа: %s", part.ZoneNumber, part.ZoneDesc))
 	}
-	msg := tgbotapi.NewMessage(chatID, text)
-	msg.ReplyMarkup = addButtons(operation.currentRequest, false, false)
-	return msg
+	return listMessage(chatID, operation, items)
 }
 
-func main() {
+// handleUpdate обрабатывает обновление от Telegram.
+// Вызывается из обработчика чата, поэтому обновления одного чата никогда не обрабатываются параллельно
+func (a *app) handleUpdate(ctx context.Context, update tgbotapi.Update) {
 
-	ctx := context.Background()
+	var msg tgbotapi.MessageConfig
 
-	//	tgUser := *readUsers()
-	tgUser := make(map[int64]string)
-	configuration := readConfig()
+	chatID := updateChatID(update)
+	if chatID == 0 {
+		return
+	}
 
-	// настройте подключение к БД
-	db, err := sql.Open("sqlite", "users.db")
-	if err != nil {
-		log.Fatal(err)
+	if update.Message != nil && !update.Message.Chat.IsPrivate() {
+		msg = tgbotapi.NewMessage(chatID, "Бот работает только в приватных чатах")
+		msg.ReplyToMessageID = update.Message.MessageID
+		_, _ = a.bot.Send(msg)
 		return
 	}
 
-	defer func(db *sql.DB) {
-		err := db.Close()
-		if err != nil {
+	//Все запросы к ПО "Центр охраны" при обработке обновления ограничены общим временем
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.settings().UpdateTimeout)*time.Second)
+	defer cancel()
 
-		}
-	}(db)
+	currentOperation := a.currentOperation.Get(chatID)
+	if currentOperation == nil {
+		currentOperation = newOperation()
+	}
 
-	store := NewUsersStore(db) // создайте объект ParcelStore функцией NewParcelStore
+	//Телефон пользователя читается из БД при первом обновлении чата после запуска бота
+	if _, ok := a.tgUser.Get(chatID); !ok {
+		_ = a.store.Get(chatID, a.tgUser)
+	}
 
-	//Создаем структуру с общими параметрами для SDK
-	confSDK := andromeda.Config{
-		ApiKey: configuration.ApiKey,
-		Host:   configuration.Host,
+	//Обновление данных объекта в сессии, восстановленной после перезапуска бота
+	if currentOperation.restored {
+		srv := a.backendOf(currentOperation)
+		err := refreshOperation(currentOperation, srv.confSDK, srv.client, ctx)
+		if err != nil {
+			//Права на объект по устаревшим данным не проверить: пользователь снова вводит номер объекта
+			log.Printf("Не удалось обновить данные объекта %s для чата %d: %v", currentOperation.numberObject, chatID, err)
+			text := fmt.Sprintf("Завершена работа с объектом %s: не удалось обновить данные объекта после перезапуска бота", currentOperation.numberObject)
+			currentOperation = finishOperation(a.bot, chatID, currentOperation, text)
+		}
 	}
 
-	currentOperation := make(map[int64]*operation)
+	if update.Message != nil && update.Message.IsCommand() {
+		msg = a.handleCommand(&update, currentOperation)
+	} else {
+		msg = a.handleState(ctx, &update, currentOperation)
+	}
+
+	a.reply(update, currentOperation, msg)
+	a.answerCallback(update)
 
-	bot, err := tgbotapi.NewBotAPI(configuration.TelegramBotToken)
+	currentOperation.lastActivity = time.Now()
+	a.currentOperation.Set(chatID, currentOperation)
+
+	err := a.sessions.Save(chatID, currentOperation)
 	if err != nil {
-		log.Panic(err)
+		log.Printf("Не удалось сохранить сессию чата %d: %v", chatID, err)
 	}
-	bot.Debug = false
+}
 
-	log.Printf("Авторизация в аккаунте %s", bot.Self.UserName)
+// updateChatID возвращает идентификатор чата, к которому относится обновление
+func updateChatID(update tgbotapi.Update) int64 {
+	if update.Message != nil {
+		return update.Message.Chat.ID
+	}
+	if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+		return update.CallbackQuery.Message.Chat.ID
+	}
+	return 0
+}
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+// dispatchUpdate передает обновление на обработку обработчику чата. Если чат еще обрабатывает
+// предыдущие обновления и его очередь заполнена, обновление отклоняется и возвращается errChatBusy:
+// уведомление пользователю отправляет вызывающий код
+func (a *app) dispatchUpdate(chats *dispatcher, update tgbotapi.Update) error {
 
-	updates := bot.GetUpdatesChan(u)
+	chatID := updateChatID(update)
+	err := chats.Dispatch(chatID, func() { a.handleUpdate(a.ctx, update) })
+	switch {
+	case errors.Is(err, errChatBusy):
+		log.Printf("Обновление %d чата %d не обработано: %v", update.UpdateID, chatID, err)
+	case err != nil:
+		log.Printf("Обновление %d не обработано: %v", update.UpdateID, err)
+	}
+	return err
+}
 
-	for update := range updates {
+func main() {
 
-		var msg tgbotapi.MessageConfig
+	//Сигнал завершения останавливает прием обновлений, а ctx обработчиков отменяется,
+	//только если они не успели завершиться за время ожидания
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
 
-		client := andromeda.NewClient()
+	ctx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
 
-		if update.Message != nil {
+	configPath := configFlags()
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(configPath, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-			chatID := update.Message.Chat.ID
+	configuration, err := readConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-			if update.Message.Chat.IsPrivate() {
+	db, err := openDB(configuration.DBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-				if update.Message.IsCommand() {
+	store := NewUsersStore(db)
+	sessions := NewSessionsStore(db)
+	auditLog := NewAuditStore(db)
+	grants := NewGrantsStore(db)
 
-					if !checkPhone(&update, &tgUser, store) {
-						msg = requestPhone(chatID)
-						msg.ReplyToMessageID = update.Message.MessageID
-					} else {
-						currentOperation[chatID] = newOperation()
-						msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Введите пультовый номер объекта!")
-						msg.ReplyToMessageID = update.Message.MessageID
-					}
-				} else {
-					if currentOperation[chatID] == nil {
-						currentOperation[chatID] = newOperation()
-					}
-					//Проверка номера объекта и прав пользователя для работы с этим объектом
-					if currentOperation[chatID].numberObject == "" {
-						if !checkPhone(&update, &tgUser, store) {
-							msg = requestPhone(chatID)
-							msg.ReplyToMessageID = update.Message.MessageID
-						} else if update.Message.Contact != nil {
-							msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Введите пультовый номер объекта!")
-							msg.ReplyToMessageID = update.Message.MessageID
-						} else if message, ok := checkNumberObject(update.Message.Text); !ok {
-							text := fmt.Sprintf("%s\nВведите пультовый номер объекта!", message)
-							msg = tgbotapi.NewMessage(update.Message.Chat.ID, text)
-							msg.ReplyToMessageID = update.Message.MessageID
-						} else if object, err := findObject(update.Message.Text, confSDK, client, &ctx); err != nil {
-							text := fmt.Sprintf("%s\nВведите пультовый номер объекта!", err)
-							msg = tgbotapi.NewMessage(update.Message.Chat.ID, text)
-							msg.ReplyToMessageID = update.Message.MessageID
-						} else if !checkUserRights(object, currentOperation[chatID], chatID, confSDK, &tgUser, configuration.PhoneEngineer, client, &ctx) {
-							text := fmt.Sprintf("У вас нет прав на этот объект!\nВведите пультовый номер объекта!")
-							msg = tgbotapi.NewMessage(update.Message.Chat.ID, text)
-							msg.ReplyToMessageID = update.Message.MessageID
-						} else {
-							msg = tgbotapi.NewMessage(chatID, "Работа с объектом "+update.Message.Text)
-							msg.ReplyToMessageID = update.Message.MessageID
-							outMsg, _ := bot.Send(msg)
-							pinMessage := tgbotapi.PinChatMessageConfig{
-								ChatID:              chatID,
-								MessageID:           outMsg.MessageID,
-								DisableNotification: false,
-							}
-							_, _ = bot.Send(pinMessage)
-							msg = createMenu(chatID, currentOperation[chatID])
-						}
-					} else if update.Message.Text != "" {
-						if isEngineer(tgUser[chatID], configuration.PhoneEngineer) &&
-							currentOperation[chatID].currentRequest == "GetUserObjectMyAlarm" {
-							msg = getUserObjectMyAlarm(tgUser, chatID, configuration.PhoneEngineer, currentOperation[chatID], &update, ctx, client, confSDK)
-							msg.ReplyToMessageID = update.Message.MessageID
-						} else {
-							//Обработки ответов пользователя для работы с объектом
-							msg = tgbotapi.NewMessage(chatID, "Работа с объектом "+update.Message.Text)
-							msg.ReplyToMessageID = update.Message.MessageID
-							currentOperation[chatID].changeValue("currentRequest", "")
-							currentOperation[chatID].changeValue("checkPanicId", "")
-							currentOperation[chatID].changeValue("changedUserId", "")
-							msg = createMenu(chatID, currentOperation[chatID])
-						}
-					}
-				}
-			} else {
-				msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Бот работает только в приватных чатах")
-				msg.ReplyToMessageID = update.Message.MessageID
-			}
-		}
+	engineers, err := newEngineersRegistry(NewEngineersStore(db))
+	if err != nil {
+		log.Fatal(err)
+	}
+	engineers.seed(configuration)
 
-		if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+	currentOperation, err := sessions.GetAll()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-			chatID := update.CallbackQuery.Message.Chat.ID
+	bot, err := tgbotapi.NewBotAPIWithAPIEndpoint(configuration.TelegramBotToken, configuration.TelegramAPIEndpoint)
+	if err != nil {
+		log.Panic(err)
+	}
+	bot.Debug = false
 
-			switch update.CallbackQuery.Data {
-			case "Finish":
-				text := fmt.Sprintf("Завершена работа с объектом %s", currentOperation[chatID].numberObject)
-				msg = tgbotapi.NewMessage(chatID, text)
-				_, _ = bot.Send(msg)
-				unpinMessage := tgbotapi.UnpinAllChatMessagesConfig{
-					ChatID: chatID,
-				}
-				_, _ = bot.Send(unpinMessage)
-
-				currentOperation[chatID] = newOperation()
-				msg = tgbotapi.NewMessage(chatID, "Введите пультовый номер объекта!")
-			case "Back":
-				text := fmt.Sprintf("Работа с объектом %s", currentOperation[chatID].numberObject)
-				if currentOperation[chatID].currentMenu == "MyAlarmMenu" && currentOperation[chatID].currentRequest == "MyAlarm" {
-					text += "\nПодменю MyAlarm"
-					msg = tgbotapi.NewMessage(chatID, text)
-					currentOperation[chatID].changeValue("currentRequest", "")
-					currentOperation[chatID].changeValue("currentMenu", "MainMenu")
-				} else if currentOperation[chatID].currentMenu == "MyAlarmMenu" {
-					msg = tgbotapi.NewMessage(chatID, text)
-					text += "\nПодменю MyAlarm"
-					msg = tgbotapi.NewMessage(chatID, text)
-					currentOperation[chatID].changeValue("currentRequest", "MyAlarm")
-				} else {
-					msg = tgbotapi.NewMessage(chatID, text)
-					currentOperation[chatID].changeValue("currentRequest", "")
-				}
-				msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
-				msg = createMenu(chatID, currentOperation[chatID])
-			case "GetCustomers":
-				currentOperation[chatID].changeValue("currentRequest", update.CallbackQuery.Data)
+	log.Printf("Авторизация в аккаунте %s", bot.Self.UserName)
 
-				text := ""
-				for _, customer := range currentOperation[chatID].customers {
-					text += fmt.Sprintf("№: %d\nФИО: %s\nТел.: %s\n\n", customer.UserNumber, customer.ObjCustName, customer.ObjCustPhone1)
-				}
-				msg = tgbotapi.NewMessage(chatID, text)
-				msg.ReplyMarkup = addButtons(currentOperation[chatID].currentRequest, false, false)
-			case "ChecksKTS", "ResultCheckKTS":
-				currentOperation[chatID].changeValue("currentRequest", update.CallbackQuery.Data)
-				msg = checksKTSRequest(currentOperation[chatID], chatID, confSDK, client, ctx)
-				msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
-			case "MyAlarm":
-				if haveMyAlarmRights(ctx, client, confSDK, currentOperation[chatID], chatID, tgUser, configuration.PhoneEngineer) {
-					currentOperation[chatID].changeValue("currentRequest", update.CallbackQuery.Data)
-					currentOperation[chatID].changeValue("currentMenu", "MyAlarmMenu")
-					msg = createMenu(chatID, currentOperation[chatID])
-				} else {
-					msg = tgbotapi.NewMessage(chatID, "У вас нет прав на работу с системой MyAlarm")
-					_, _ = bot.Send(msg)
-					msg = createMenu(chatID, currentOperation[chatID])
-				}
-			case "GetUsersMyAlarm":
-				currentOperation[chatID].changeValue("currentRequest", update.CallbackQuery.Data)
-				msg = getUsersMyAlarm(ctx, client, confSDK, currentOperation[chatID], chatID)
-				msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
-			case "GetUserObjectMyAlarm":
-				currentOperation[chatID].changeValue("currentRequest", update.CallbackQuery.Data)
-				msg = getUserObjectMyAlarm(tgUser, chatID, configuration.PhoneEngineer, currentOperation[chatID], &update, ctx, client, confSDK)
-				msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
-			case "PutDelUserMyAlarm", "PutAddUserMyAlarm":
-				currentOperation[chatID].changeValue("currentRequest", update.CallbackQuery.Data)
-				msg = putChangeUserMyAlarm(currentOperation[chatID], tgUser[chatID], configuration.PhoneEngineer, chatID, ctx, client, confSDK)
-				msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
-			case "PutChangeVirtualKTS":
-				currentOperation[chatID].changeValue("currentRequest", update.CallbackQuery.Data)
-				msg = putChangeVirtualKTS(currentOperation[chatID], tgUser[chatID], configuration.PhoneEngineer, chatID, ctx, client, confSDK)
-				msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
-			case "GetInfoObject":
-				currentOperation[chatID].changeValue("currentRequest", update.CallbackQuery.Data)
-				msg = getInfoObject(*currentOperation[chatID], chatID)
-				msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
-			case "GetParts":
-				currentOperation[chatID].changeValue("currentRequest", update.CallbackQuery.Data)
-				msg = GetParts(*currentOperation[chatID], chatID, ctx, client, confSDK)
-				msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
-			case "GetZones":
-				currentOperation[chatID].changeValue("currentRequest", update.CallbackQuery.Data)
-				msg = GetZones(*currentOperation[chatID], chatID, ctx, client, confSDK)
-				msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
-			default:
-				switch currentOperation[chatID].currentRequest {
-				case "PutDelUserMyAlarm", "PutAddUserMyAlarm":
-					if update.CallbackQuery.Data == "admin" || update.CallbackQuery.Data == "user" {
-						currentOperation[chatID].changeValue("role", update.CallbackQuery.Data)
-						msg = putChangeUserMyAlarm(currentOperation[chatID], tgUser[chatID], configuration.PhoneEngineer, chatID, ctx, client, confSDK)
-						msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
-					} else {
-						currentOperation[chatID].changeValue("changedUserId", update.CallbackQuery.Data)
-						msg = putChangeUserMyAlarm(currentOperation[chatID], tgUser[chatID], configuration.PhoneEngineer, chatID, ctx, client, confSDK)
-						msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
-					}
-				case "PutChangeVirtualKTS":
-					if update.CallbackQuery.Data == "true" || update.CallbackQuery.Data == "false" {
-						currentOperation[chatID].changeValue("role", update.CallbackQuery.Data)
-						msg = putChangeVirtualKTS(currentOperation[chatID], tgUser[chatID], configuration.PhoneEngineer, chatID, ctx, client, confSDK)
-						msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
-					} else {
-						currentOperation[chatID].changeValue("changedUserId", update.CallbackQuery.Data)
-						msg = putChangeVirtualKTS(currentOperation[chatID], tgUser[chatID], configuration.PhoneEngineer, chatID, ctx, client, confSDK)
-						msg.ReplyToMessageID = update.CallbackQuery.Message.MessageID
-					}
-				}
+	setCallbackKey(configuration)
+
+	a := &app{
+		bot:              bot,
+		ctx:              ctx,
+		backends:         newBackends(configuration),
+		store:            store,
+		sessions:         sessions,
+		tgUser:           newUsersCache(),
+		engineers:        engineers,
+		auditLog:         auditLog,
+		grants:           grants,
+		currentOperation: newOperations(currentOperation),
+	}
+	a.configuration.Store(&configuration)
+	a.scheduleGrants()
+
+	a.watchBackends(signals)
+
+	source := startUpdates(bot, configuration)
+
+	chats := newDispatcher()
+
+	expireTicker := time.NewTicker(time.Duration(configuration.SessionCheckInterval) * time.Second)
+	defer expireTicker.Stop()
+
+	//Настройки перечитываются при изменении файла настроек и по сигналу SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	watcher := newConfigWatcher(configPath)
+	reloadTicker := time.NewTicker(time.Duration(configuration.ReloadInterval) * time.Second)
+	defer reloadTicker.Stop()
+
+	lastUpdateID := 0
+	for running := true; running; {
+		select {
+		case <-expireTicker.C:
+			a.expireSessions(chats)
+		case <-reloadTicker.C:
+			if watcher.changed() {
+				log.Printf("Файл настроек %s изменен", configPath)
+				a.reloadConfig(configPath)
 			}
+		case <-reload:
+			log.Printf("Получен сигнал SIGHUP")
+			watcher.changed()
+			a.reloadConfig(configPath)
+		case update, ok := <-source.updates:
+			if !ok {
+				running = false
+				break
+			}
+			lastUpdateID = max(lastUpdateID, update.UpdateID)
+			if err := a.dispatchUpdate(chats, update); errors.Is(err, errChatBusy) {
+				go a.busyNotice(updateChatID(update), update)
+			}
+		case <-signals.Done():
+			running = false
 		}
-		_, _ = bot.Send(msg)
+	}
+
+	//Повторный сигнал завершает процесс сразу
+	stopSignals()
+
+	if err = a.shutdown(source, lastUpdateID, chats, cancelWork, db); err != nil {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/pkg/errors"
+)
+
+const (
+	updateModePolling = "polling" //Получение обновлений длинным опросом getUpdates
+	updateModeWebhook = "webhook" //Получение обновлений через вебхук
+
+	defaultWebhookListen = ":8443"                           //Адрес приема запросов вебхука по умолчанию
+	secretTokenHeader    = "X-Telegram-Bot-Api-Secret-Token" //Заголовок, в котором Telegram передает секрет вебхука
+)
+
+// updateSource источник обновлений от Telegram
+type updateSource struct {
+	updates tgbotapi.UpdatesChannel
+	stop    func()                 //Прекращает получение обновлений
+	confirm func(lastUpdateID int) //Подтверждает обработку обновлений, чтобы Telegram не отдал их повторно после перезапуска
+}
+
+// webhookConfig настройки получения обновлений через вебхук
+type webhookConfig struct {
+	URL               string `json:"url"`                 //Публичный адрес вебхука, например "https://bot.example.ru/telegram"
+	Listen            string `json:"listen"`              //Адрес, на котором бот принимает запросы, по умолчанию ":8443"
+	SecretToken       string `json:"secret_token"`        //Секрет, который Telegram передает в заголовке каждого запроса
+	CertFile          string `json:"cert_file"`           //Сертификат HTTPS. Если не задан, запросы принимаются по HTTP (за обратным прокси)
+	KeyFile           string `json:"key_file"`            //Закрытый ключ сертификата HTTPS
+	UploadCert        bool   `json:"upload_cert"`         //Загрузить сертификат в Telegram, нужно для самоподписанного сертификата
+	MaxConnections    int    `json:"max_connections"`     //Максимальное количество одновременных запросов от Telegram
+	FallbackToPolling bool   `json:"fallback_to_polling"` //При ошибке регистрации вебхука получать обновления опросом
+}
+
+// secretTokenFormat допустимый в Telegram формат секрета вебхука
+var secretTokenFormat = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+// checkWebhook проверяет настройки вебхука и возвращает описания всех найденных ошибок.
+// Без секрета запросы к вебхуку не отличить от поддельных, поэтому секрет обязателен
+func checkWebhook(webhook webhookConfig) []string {
+
+	var problems []string
+	if webhook.URL == "" {
+		problems = append(problems, "не задан адрес вебхука webhook.url")
+	} else if hookURL, err := url.Parse(webhook.URL); err != nil || hookURL.Host == "" || (hookURL.Scheme != "https" && hookURL.Scheme != "http") {
+		problems = append(problems, fmt.Sprintf("неверный адрес вебхука %q", webhook.URL))
+	}
+	if webhook.SecretToken == "" {
+		problems = append(problems, "не задан секрет вебхука: webhook.secret_token или переменная окружения WEBHOOK_SECRET_TOKEN")
+	} else if !secretTokenFormat.MatchString(webhook.SecretToken) {
+		problems = append(problems, "секрет вебхука должен содержать от 1 до 256 символов A-Z, a-z, 0-9, _ и -")
+	}
+	return problems
+}
+
+// startUpdates запускает получение обновлений выбранным в настройках способом
+func startUpdates(bot *tgbotapi.BotAPI, configuration config) updateSource {
+
+	if configuration.UpdateMode == updateModeWebhook {
+		source, err := startWebhook(bot, configuration.Webhook)
+		if err == nil {
+			log.Printf("Обновления принимаются через вебхук %s", configuration.Webhook.URL)
+			return source
+		}
+		if !configuration.Webhook.FallbackToPolling {
+			log.Fatalf("Не удалось запустить вебхук: %v", err)
+		}
+		log.Printf("Не удалось запустить вебхук, обновления будут получены опросом: %v", err)
+	}
+
+	return startPolling(bot)
+}
+
+// startPolling удаляет зарегистрированный ранее вебхук, иначе Telegram не отдает обновления через getUpdates,
+// и запускает длинный опрос
+func startPolling(bot *tgbotapi.BotAPI) updateSource {
+
+	info, err := bot.GetWebhookInfo()
+	if err != nil {
+		log.Printf("Не удалось получить сведения о вебхуке: %v", err)
+	}
+	if info.IsSet() {
+		_, err = bot.Request(tgbotapi.DeleteWebhookConfig{})
+		if err != nil {
+			log.Printf("Не удалось удалить вебхук %s: %v", info.URL, err)
+		} else {
+			log.Printf("Вебхук %s удален, обновления получаются опросом", info.URL)
+		}
+	}
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+
+	return updateSource{
+		updates: bot.GetUpdatesChan(u),
+		stop:    bot.StopReceivingUpdates,
+		confirm: func(lastUpdateID int) {
+			if lastUpdateID == 0 {
+				return
+			}
+			//Telegram считает обновления полученными, когда запрошены обновления с большим номером
+			confirm := tgbotapi.UpdateConfig{Offset: lastUpdateID + 1, Limit: 1}
+			if _, err := bot.GetUpdates(confirm); err != nil {
+				log.Printf("Не удалось подтвердить обработку обновлений: %v", err)
+			}
+		},
+	}
+}
+
+// startWebhook регистрирует вебхук в Telegram и запускает прием обновлений
+func startWebhook(bot *tgbotapi.BotAPI, webhook webhookConfig) (updateSource, error) {
+
+	if problems := checkWebhook(webhook); len(problems) > 0 {
+		return updateSource{}, errors.New(strings.Join(problems, "; "))
+	}
+	hookURL, _ := url.Parse(webhook.URL)
+	if (webhook.CertFile == "") != (webhook.KeyFile == "") {
+		return updateSource{}, errors.New("для HTTPS нужно указать и сертификат, и закрытый ключ")
+	}
+	if webhook.UploadCert && webhook.CertFile == "" {
+		return updateSource{}, errors.New("не указан сертификат для загрузки в Telegram")
+	}
+
+	listen := webhook.Listen
+	if listen == "" {
+		listen = defaultWebhookListen
+	}
+
+	path := hookURL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	updates := make(chan tgbotapi.Update, bot.Buffer)
+
+	mux := http.NewServeMux()
+	mux.Handle(path, webhookHandler(webhook.SecretToken, updates))
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		var err error
+		if webhook.CertFile != "" {
+			err = server.ListenAndServeTLS(webhook.CertFile, webhook.KeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
+
+	//Ошибка запуска (например, занятый порт) проявляется сразу
+	select {
+	case err := <-serverErr:
+		return updateSource{}, errors.WithMessage(err, "не удалось запустить прием запросов")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := setWebhook(bot, webhook); err != nil {
+		_ = server.Close()
+		return updateSource{}, err
+	}
+
+	go func() {
+		if err := <-serverErr; err != nil {
+			log.Printf("Прием запросов вебхука остановлен: %v", err)
+		}
+	}()
+
+	stop := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Не удалось остановить прием запросов вебхука: %v", err)
+		}
+	}
+	//Обновление подтверждается ответом на запрос вебхука
+	return updateSource{updates: updates, stop: stop, confirm: func(int) {}}, nil
+}
+
+// setWebhook регистрирует вебхук в Telegram. WebhookConfig библиотеки не поддерживает секрет вебхука,
+// поэтому запрос формируется вручную
+func setWebhook(bot *tgbotapi.BotAPI, webhook webhookConfig) error {
+
+	params := tgbotapi.Params{}
+	params["url"] = webhook.URL
+	params.AddNonEmpty("secret_token", webhook.SecretToken)
+	params.AddNonZero("max_connections", webhook.MaxConnections)
+	err := params.AddInterface("allowed_updates", []string{"message", "callback_query"})
+	if err != nil {
+		return err
+	}
+
+	var response *tgbotapi.APIResponse
+	if webhook.UploadCert {
+		response, err = bot.UploadFiles("setWebhook", params, []tgbotapi.RequestFile{{
+			Name: "certificate",
+			Data: tgbotapi.FilePath(webhook.CertFile),
+		}})
+	} else {
+		response, err = bot.MakeRequest("setWebhook", params)
+	}
+	if err != nil {
+		return errors.WithMessage(err, "не удалось зарегистрировать вебхук")
+	}
+	if !response.Ok {
+		return errors.Errorf("не удалось зарегистрировать вебхук: %s", response.Description)
+	}
+	return nil
+}
+
+// webhookHandler принимает обновления от Telegram. Запросы без верного секрета отклоняются,
+// а без заданного секрета отклоняются все запросы
+func webhookHandler(secretToken string, updates chan<- tgbotapi.Update) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if secretToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(secretTokenHeader)), []byte(secretToken)) != 1 {
+			log.Printf("Отклонен запрос вебхука с %s: неверный секрет", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var update tgbotapi.Update
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			log.Printf("Не удалось разобрать обновление вебхука: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		select {
+		case updates <- update:
+			w.WriteHeader(http.StatusOK)
+		case <-r.Context().Done():
+			//Telegram повторит доставку обновления
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+}